@@ -29,7 +29,13 @@ func NewAccount(email string, conf *Configuration) *Account {
 	}
 
 	var privKey crypto.PrivateKey
-	if _, err := os.Stat(accKeyPath); os.IsNotExist(err) {
+	if pemKey := conf.context.GlobalString("account-key"); pemKey != "" {
+		var err error
+		privKey, err = acme.ParsePrivateKeyPEM([]byte(pemKey))
+		if err != nil {
+			logger().Fatalf("Could not parse the private key of account %s given by --account-key: %v", email, err)
+		}
+	} else if _, err := os.Stat(accKeyPath); os.IsNotExist(err) {
 
 		logger().Printf("No key found for account %s. Generating a curve P384 EC key.", email)
 		privKey, err = generatePrivateKey(accKeyPath)
@@ -0,0 +1,113 @@
+package acme
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Account is a User that can be saved and loaded again, so that an account
+// registered once can be reused without registering again.
+type Account struct {
+	Email        string
+	Registration *RegistrationResource
+	PrivateKey   crypto.PrivateKey
+}
+
+type accountJSON struct {
+	Email        string                `json:"email,omitempty"`
+	Registration *RegistrationResource `json:"registration"`
+	Key          string                `json:"key"`
+}
+
+// GetEmail returns the email address of the account.
+func (a *Account) GetEmail() string {
+	return a.Email
+}
+
+// GetRegistration returns the registration resource of the account.
+func (a *Account) GetRegistration() *RegistrationResource {
+	return a.Registration
+}
+
+// GetPrivateKey returns the private key of the account.
+func (a *Account) GetPrivateKey() crypto.PrivateKey {
+	return a.PrivateKey
+}
+
+// SaveAccount writes the account as JSON to w. The private key is stored
+// PEM encoded alongside the registration, so w should not be world readable.
+func (a *Account) SaveAccount(w io.Writer) error {
+	if a.Registration == nil || a.Registration.URI == "" {
+		return errors.New("acme: account has no registration URI")
+	}
+
+	var publicKey crypto.PublicKey
+	switch key := a.PrivateKey.(type) {
+	case *rsa.PrivateKey:
+		publicKey = &key.PublicKey
+	case *ecdsa.PrivateKey:
+		publicKey = &key.PublicKey
+	default:
+		return errors.New("acme: unsupported account key type")
+	}
+
+	// The key of a registration that did not come from the CA may be
+	// unset, which cannot be encoded. It is the account key in any case.
+	reg := *a.Registration
+	if reg.Body.Key.Key == nil {
+		reg.Body.Key = *keyAsJWK(publicKey)
+	}
+
+	return json.NewEncoder(w).Encode(accountJSON{
+		Email:        a.Email,
+		Registration: &reg,
+		Key:          string(pemEncode(a.PrivateKey)),
+	})
+}
+
+// LoadAccount reads an account written by SaveAccount from r.
+func LoadAccount(r io.Reader) (*Account, error) {
+	var acc accountJSON
+	if err := json.NewDecoder(r).Decode(&acc); err != nil {
+		return nil, fmt.Errorf("acme: could not parse account: %v", err)
+	}
+
+	if acc.Registration == nil || acc.Registration.URI == "" {
+		return nil, errors.New("acme: account has no registration URI")
+	}
+
+	privKey, err := ParsePrivateKeyPEM([]byte(acc.Key))
+	if err != nil {
+		return nil, fmt.Errorf("acme: could not parse account key: %v", err)
+	}
+
+	return &Account{
+		Email:        acc.Email,
+		Registration: acc.Registration,
+		PrivateKey:   privKey,
+	}, nil
+}
+
+// UseExistingAccount switches the client to an account that is already
+// registered with the CA, e.g. one returned by LoadAccount, so that no new
+// registration is needed.
+func (c *Client) UseExistingAccount(acct *Account) error {
+	if acct == nil || acct.Registration == nil || acct.Registration.URI == "" {
+		return errors.New("acme: account has no registration URI")
+	}
+	if acct.PrivateKey == nil {
+		return errors.New("private key was nil")
+	}
+	if err := checkKeySize(acct.PrivateKey); err != nil {
+		return err
+	}
+
+	c.user = acct
+	c.jws.privKey = acct.PrivateKey
+	return nil
+}
@@ -0,0 +1,131 @@
+package acme
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAccountRoundTrip(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 512)
+	if err != nil {
+		t.Fatal("Could not generate test key:", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("Could not generate test key:", err)
+	}
+
+	for _, key := range []crypto.PrivateKey{rsaKey, ecKey} {
+		acct := &Account{
+			Email: "test@test.com",
+			Registration: &RegistrationResource{
+				URI:         "https://ca.example/acme/reg/1",
+				NewAuthzURL: "https://ca.example/acme/new-authz",
+				TosURL:      "https://ca.example/tos.pdf",
+				Body:        Registration{Agreement: "https://ca.example/tos.pdf"},
+			},
+			PrivateKey: key,
+		}
+
+		var buf bytes.Buffer
+		if err := acct.SaveAccount(&buf); err != nil {
+			t.Fatalf("%T: SaveAccount error: got %v, want nil", key, err)
+		}
+
+		loaded, err := LoadAccount(&buf)
+		if err != nil {
+			t.Fatalf("%T: LoadAccount error: got %v, want nil", key, err)
+		}
+		if loaded.Email != acct.Email {
+			t.Errorf("%T: expected email %q but got %q", key, acct.Email, loaded.Email)
+		}
+		if got, want := loaded.Registration, acct.Registration; got.URI != want.URI || got.NewAuthzURL != want.NewAuthzURL || got.TosURL != want.TosURL || got.Body.Agreement != want.Body.Agreement {
+			t.Errorf("%T: expected registration %+v but got %+v", key, want, got)
+		}
+		if !reflect.DeepEqual(loaded.PrivateKey, key) {
+			t.Errorf("%T: expected the loaded key to equal the saved one", key)
+		}
+	}
+}
+
+func TestSaveAccountErrors(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("Could not generate test key:", err)
+	}
+
+	var buf bytes.Buffer
+	if err := (&Account{PrivateKey: key}).SaveAccount(&buf); err == nil {
+		t.Error("Expected an account without registration to fail to save")
+	}
+	reg := &RegistrationResource{URI: "https://ca.example/acme/reg/1"}
+	if err := (&Account{Registration: reg}).SaveAccount(&buf); err == nil {
+		t.Error("Expected an account without a key to fail to save")
+	}
+}
+
+func TestLoadAccountErrors(t *testing.T) {
+	tests := []string{
+		"not json",
+		`{"registration": {"uri": ""}, "key": ""}`,
+		`{"registration": {"uri": "https://ca.example/acme/reg/1"}, "key": "not pem"}`,
+	}
+	for _, data := range tests {
+		if _, err := LoadAccount(strings.NewReader(data)); err == nil {
+			t.Errorf("%q: expected an error", data)
+		}
+	}
+}
+
+func TestUseExistingAccount(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 512)
+	if err != nil {
+		t.Fatal("Could not generate test key:", err)
+	}
+	accountKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("Could not generate test key:", err)
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := json.Marshal(directory{NewAuthzURL: "http://test", NewCertURL: "http://test", NewRegURL: "http://test", RevokeCertURL: "http://test"})
+		w.Write(data)
+	}))
+	defer ts.Close()
+
+	client, err := NewClient(ts.URL, mockUser{email: "test@test.com", privatekey: key}, RSA2048)
+	if err != nil {
+		t.Fatalf("Could not create client: %v", err)
+	}
+
+	if err := client.UseExistingAccount(&Account{PrivateKey: accountKey}); err == nil {
+		t.Error("Expected an account without registration to be rejected")
+	}
+
+	acct := &Account{
+		Registration: &RegistrationResource{URI: "https://ca.example/acme/reg/1"},
+		PrivateKey:   accountKey,
+	}
+	if err := client.UseExistingAccount(acct); err != nil {
+		t.Fatalf("UseExistingAccount error: got %v, want nil", err)
+	}
+	if client.user != acct {
+		t.Error("Expected the client to use the existing account")
+	}
+	if client.jws.privKey != accountKey {
+		t.Error("Expected requests to be signed with the account key")
+	}
+	if s, ok := client.solvers[HTTP01].(*httpChallenge); !ok || s.jws.privKey != accountKey {
+		t.Error("Expected challenge solvers to sign with the account key")
+	}
+}
@@ -0,0 +1,80 @@
+package acmetest_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"log"
+
+	"github.com/xenolf/lego/acme"
+	"github.com/xenolf/lego/acme/acmetest"
+)
+
+type user struct {
+	key          crypto.PrivateKey
+	registration *acme.RegistrationResource
+}
+
+func (u *user) GetEmail() string                            { return "test@example.com" }
+func (u *user) GetRegistration() *acme.RegistrationResource { return u.registration }
+func (u *user) GetPrivateKey() crypto.PrivateKey            { return u.key }
+
+// presenter is a ChallengeProvider that only records the domains it was
+// asked to present a challenge for.
+type presenter struct {
+	domains []string
+}
+
+func (p *presenter) Present(domain, token, keyAuth string) error {
+	p.domains = append(p.domains, domain)
+	return nil
+}
+
+func (p *presenter) CleanUp(domain, token, keyAuth string) error {
+	return nil
+}
+
+func Example() {
+	server := acmetest.NewServer()
+	defer server.Close()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		log.Fatal(err)
+	}
+	u := &user{key: key}
+
+	client, err := acme.NewClient(server.DirectoryURL(), u, acme.EC256)
+	if err != nil {
+		log.Fatal(err)
+	}
+	p := &presenter{}
+	client.SetChallengeProvider(acme.HTTP01, p)
+
+	u.registration, err = client.Register()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	cert, failures := client.ObtainCertificate([]string{"example.com", "www.example.com"}, true, nil, false)
+	if len(failures) > 0 {
+		log.Fatal(failures)
+	}
+
+	block, _ := pem.Decode(cert.Certificate)
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("presented:", p.domains)
+	fmt.Println("issued for:", leaf.DNSNames)
+	fmt.Println("issuer:", leaf.Issuer.CommonName)
+	// Output:
+	// presented: [example.com www.example.com]
+	// issued for: [example.com www.example.com]
+	// issuer: acmetest CA
+}
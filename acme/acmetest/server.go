@@ -0,0 +1,592 @@
+// Package acmetest provides an in-memory ACME CA for testing clients and
+// challenge providers without a network connection to Boulder or Pebble.
+package acmetest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/square/go-jose.v1"
+)
+
+const (
+	// directoryPath is where the server publishes its directory.
+	directoryPath = "/directory"
+
+	badNonceDetail = "JWS has invalid anti-replay nonce"
+)
+
+// Server is an ACME v1 CA backed by an httptest.Server. It implements the
+// new-reg, new-authz, challenge, new-cert and revoke-cert resources.
+//
+// The server does not connect back to the client to validate challenges:
+// a challenge is valid as soon as the client responds to it with the
+// correct key authorization. This keeps issuance deterministic and offline,
+// while still driving the client's challenge providers through Present and
+// CleanUp.
+type Server struct {
+	*httptest.Server
+
+	caKey  *ecdsa.PrivateKey
+	caCert *x509.Certificate
+
+	challenges []string
+
+	mu       sync.Mutex
+	nonce    int
+	nonces   map[string]bool
+	accounts map[string]*account
+	authzs   []*authz
+	certs    [][]byte
+	revoked  map[string]bool
+}
+
+type account struct {
+	ID      int              `json:"id"`
+	Key     *jose.JsonWebKey `json:"key"`
+	Contact []string         `json:"contact"`
+	Status  string           `json:"status,omitempty"`
+}
+
+type authz struct {
+	account    string
+	Identifier identifier  `json:"identifier"`
+	Status     string      `json:"status"`
+	Expires    time.Time   `json:"expires"`
+	Challenges []challenge `json:"challenges"`
+	Combos     [][]int     `json:"combinations"`
+}
+
+type identifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type challenge struct {
+	Type             string   `json:"type"`
+	Status           string   `json:"status"`
+	URI              string   `json:"uri"`
+	Token            string   `json:"token"`
+	KeyAuthorization string   `json:"keyAuthorization,omitempty"`
+	Error            *problem `json:"error,omitempty"`
+}
+
+type problem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+}
+
+type request struct {
+	Resource         string     `json:"resource"`
+	Contact          []string   `json:"contact"`
+	Identifier       identifier `json:"identifier"`
+	Status           string     `json:"status"`
+	KeyAuthorization string     `json:"keyAuthorization"`
+	Csr              string     `json:"csr"`
+	Certificate      string     `json:"certificate"`
+}
+
+// NewServer starts a Server offering the given challenge types for every
+// authorization, each on its own. Without any, it offers "http-01". The
+// caller should call Close when finished.
+func NewServer(challenges ...string) *Server {
+	if len(challenges) == 0 {
+		challenges = []string{"http-01"}
+	}
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(fmt.Sprintf("acmetest: could not generate CA key: %v", err))
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "acmetest CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, caKey.Public(), caKey)
+	if err != nil {
+		panic(fmt.Sprintf("acmetest: could not create CA certificate: %v", err))
+	}
+	caCert, err := x509.ParseCertificate(der)
+	if err != nil {
+		panic(fmt.Sprintf("acmetest: could not parse CA certificate: %v", err))
+	}
+
+	s := &Server{
+		caKey:      caKey,
+		caCert:     caCert,
+		challenges: challenges,
+		nonces:     make(map[string]bool),
+		accounts:   make(map[string]*account),
+		revoked:    make(map[string]bool),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// DirectoryURL returns the URL of the directory to pass to acme.NewClient.
+func (s *Server) DirectoryURL() string {
+	return s.URL + directoryPath
+}
+
+// CACertificate returns the certificate that issues all certificates of the server.
+func (s *Server) CACertificate() *x509.Certificate {
+	return s.caCert
+}
+
+// Revoked reports whether the certificate in DER form was revoked.
+func (s *Server) Revoked(der []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.revoked[string(der)]
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Replay-Nonce", s.newNonce())
+
+	path := r.URL.Path
+	switch {
+	case path == directoryPath:
+		writeJSON(w, http.StatusOK, map[string]string{
+			"new-reg":     s.URL + "/new-reg",
+			"new-authz":   s.URL + "/new-authz",
+			"new-cert":    s.URL + "/new-cert",
+			"revoke-cert": s.URL + "/revoke-cert",
+		})
+	case path == "/issuer":
+		writeDER(w, http.StatusOK, s.caCert.Raw)
+	case strings.HasPrefix(path, "/cert/") && r.Method == http.MethodGet:
+		s.getCert(w, strings.TrimPrefix(path, "/cert/"))
+	case strings.HasPrefix(path, "/authz/") && r.Method == http.MethodGet:
+		s.getAuthz(w, strings.TrimPrefix(path, "/authz/"))
+	case strings.HasPrefix(path, "/challenge/") && r.Method == http.MethodGet:
+		s.getChallenge(w, strings.TrimPrefix(path, "/challenge/"))
+	case r.Method == http.MethodPost:
+		s.handlePost(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) handlePost(w http.ResponseWriter, r *http.Request) {
+	thumbprint, key, req, err := s.parseRequest(r)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, "malformed", err.Error())
+		return
+	}
+
+	path := r.URL.Path
+	switch {
+	case path == "/new-reg":
+		s.newReg(w, thumbprint, key, req)
+	case strings.HasPrefix(path, "/reg/"):
+		s.updateReg(w, thumbprint, req)
+	case path == "/new-authz":
+		s.newAuthz(w, thumbprint, req)
+	case strings.HasPrefix(path, "/authz/"):
+		s.deactivateAuthz(w, thumbprint, strings.TrimPrefix(path, "/authz/"), req)
+	case strings.HasPrefix(path, "/challenge/"):
+		s.respondChallenge(w, thumbprint, strings.TrimPrefix(path, "/challenge/"), req)
+	case path == "/new-cert":
+		s.newCert(w, thumbprint, req)
+	case path == "/revoke-cert":
+		s.revokeCert(w, thumbprint, req)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// parseRequest verifies the JWS in the body of r against the key embedded
+// in it and returns the key's thumbprint, the key and the decoded payload.
+func (s *Server) parseRequest(r *http.Request) (string, *jose.JsonWebKey, request, error) {
+	var req request
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return "", nil, req, err
+	}
+
+	jws, err := jose.ParseSigned(string(body))
+	if err != nil {
+		return "", nil, req, err
+	}
+	if len(jws.Signatures) != 1 || jws.Signatures[0].Header.JsonWebKey == nil {
+		return "", nil, req, fmt.Errorf("request is not signed with an embedded JWK")
+	}
+	sig := jws.Signatures[0].Header
+
+	if !s.useNonce(sig.Nonce) {
+		return "", nil, req, fmt.Errorf(badNonceDetail)
+	}
+
+	payload, err := jws.Verify(sig.JsonWebKey)
+	if err != nil {
+		return "", nil, req, err
+	}
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return "", nil, req, err
+	}
+
+	thumbprint, err := sig.JsonWebKey.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return "", nil, req, err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(thumbprint), sig.JsonWebKey, req, nil
+}
+
+func (s *Server) newNonce() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nonce++
+	nonce := "nonce-" + strconv.Itoa(s.nonce)
+	s.nonces[nonce] = true
+	return nonce
+}
+
+func (s *Server) useNonce(nonce string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.nonces[nonce] {
+		return false
+	}
+	delete(s.nonces, nonce)
+	return true
+}
+
+func (s *Server) newReg(w http.ResponseWriter, thumbprint string, key *jose.JsonWebKey, req request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if acct, ok := s.accounts[thumbprint]; ok {
+		w.Header().Set("Location", s.regURL(acct))
+		writeProblem(w, http.StatusConflict, "malformed", "Registration key is already in use")
+		return
+	}
+
+	acct := &account{ID: len(s.accounts) + 1, Key: key, Contact: req.Contact}
+	s.accounts[thumbprint] = acct
+
+	w.Header().Set("Location", s.regURL(acct))
+	w.Header().Add("Link", fmt.Sprintf(`<%s/new-authz>;rel="next"`, s.URL))
+	writeJSON(w, http.StatusCreated, acct)
+}
+
+func (s *Server) updateReg(w http.ResponseWriter, thumbprint string, req request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	acct, ok := s.accounts[thumbprint]
+	if !ok {
+		writeProblem(w, http.StatusForbidden, "unauthorized", "No registration exists matching provided key")
+		return
+	}
+	if req.Status == "deactivated" {
+		acct.Status = req.Status
+	}
+
+	w.Header().Add("Link", fmt.Sprintf(`<%s/new-authz>;rel="next"`, s.URL))
+	writeJSON(w, http.StatusAccepted, acct)
+}
+
+func (s *Server) newAuthz(w http.ResponseWriter, thumbprint string, req request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.registered(thumbprint) {
+		writeProblem(w, http.StatusForbidden, "unauthorized", "No registration exists matching provided key")
+		return
+	}
+	if req.Identifier.Type != "dns" || req.Identifier.Value == "" {
+		writeProblem(w, http.StatusBadRequest, "malformed", "Invalid identifier")
+		return
+	}
+
+	id := len(s.authzs)
+	a := &authz{
+		account:    thumbprint,
+		Identifier: req.Identifier,
+		Status:     "pending",
+		Expires:    time.Now().Add(24 * time.Hour),
+	}
+	for i, typ := range s.challenges {
+		a.Challenges = append(a.Challenges, challenge{
+			Type:   typ,
+			Status: "pending",
+			URI:    fmt.Sprintf("%s/challenge/%d/%d", s.URL, id, i),
+			Token:  fmt.Sprintf("token-%d-%d", id, i),
+		})
+		a.Combos = append(a.Combos, []int{i})
+	}
+	s.authzs = append(s.authzs, a)
+
+	w.Header().Set("Location", fmt.Sprintf("%s/authz/%d", s.URL, id))
+	w.Header().Add("Link", fmt.Sprintf(`<%s/new-cert>;rel="next"`, s.URL))
+	writeJSON(w, http.StatusCreated, a)
+}
+
+func (s *Server) getAuthz(w http.ResponseWriter, id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a := s.lookupAuthz(id)
+	if a == nil {
+		writeProblem(w, http.StatusNotFound, "malformed", "Unknown authorization")
+		return
+	}
+	writeJSON(w, http.StatusOK, a)
+}
+
+func (s *Server) deactivateAuthz(w http.ResponseWriter, thumbprint, id string, req request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a := s.lookupAuthz(id)
+	if a == nil || a.account != thumbprint {
+		writeProblem(w, http.StatusNotFound, "malformed", "Unknown authorization")
+		return
+	}
+	if req.Status == "deactivated" {
+		a.Status = req.Status
+	}
+	writeJSON(w, http.StatusOK, a)
+}
+
+func (s *Server) getChallenge(w http.ResponseWriter, id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, chlng := s.lookupChallenge(id)
+	if chlng == nil {
+		writeProblem(w, http.StatusNotFound, "malformed", "Unknown challenge")
+		return
+	}
+	writeJSON(w, http.StatusAccepted, chlng)
+}
+
+func (s *Server) respondChallenge(w http.ResponseWriter, thumbprint, id string, req request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a, chlng := s.lookupChallenge(id)
+	if chlng == nil || a.account != thumbprint {
+		writeProblem(w, http.StatusNotFound, "malformed", "Unknown challenge")
+		return
+	}
+
+	if chlng.Status == "pending" {
+		if req.KeyAuthorization == chlng.Token+"."+thumbprint {
+			chlng.Status = "valid"
+			chlng.KeyAuthorization = req.KeyAuthorization
+			a.Status = "valid"
+		} else {
+			chlng.Status = "invalid"
+			chlng.Error = &problem{Type: "urn:acme:error:unauthorized", Detail: "Incorrect key authorization"}
+			a.Status = "invalid"
+		}
+	}
+	writeJSON(w, http.StatusAccepted, chlng)
+}
+
+func (s *Server) newCert(w http.ResponseWriter, thumbprint string, req request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	csrDER, err := base64.URLEncoding.DecodeString(req.Csr)
+	if err != nil {
+		csrDER, err = base64.RawURLEncoding.DecodeString(req.Csr)
+	}
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, "malformed", "Invalid CSR encoding")
+		return
+	}
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err == nil {
+		err = csr.CheckSignature()
+	}
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, "malformed", "Invalid CSR: "+err.Error())
+		return
+	}
+
+	names := csr.DNSNames
+	if csr.Subject.CommonName != "" {
+		names = append([]string{csr.Subject.CommonName}, names...)
+	}
+	if len(names) == 0 {
+		writeProblem(w, http.StatusBadRequest, "malformed", "CSR contains no names")
+		return
+	}
+	for _, name := range names {
+		if !s.authorized(thumbprint, name) {
+			writeProblem(w, http.StatusForbidden, "unauthorized", "Authorizations for these names not found or expired: "+name)
+			return
+		}
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:    big.NewInt(int64(len(s.certs) + 2)),
+		Subject:         pkix.Name{CommonName: names[0]},
+		DNSNames:        names,
+		NotBefore:       time.Now().Add(-time.Hour),
+		NotAfter:        time.Now().Add(90 * 24 * time.Hour),
+		KeyUsage:        x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		ExtraExtensions: csrExtensions(csr),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, s.caCert, csr.PublicKey, s.caKey)
+	if err != nil {
+		writeProblem(w, http.StatusInternalServerError, "serverInternal", err.Error())
+		return
+	}
+
+	certURL := fmt.Sprintf("%s/cert/%d", s.URL, len(s.certs))
+	s.certs = append(s.certs, der)
+
+	w.Header().Set("Location", certURL)
+	w.Header().Set("Content-Location", certURL)
+	w.Header().Add("Link", fmt.Sprintf(`<%s/issuer>;rel="up"`, s.URL))
+	writeDER(w, http.StatusCreated, der)
+}
+
+func (s *Server) getCert(w http.ResponseWriter, id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i, err := strconv.Atoi(id)
+	if err != nil || i < 0 || i >= len(s.certs) {
+		writeProblem(w, http.StatusNotFound, "malformed", "Unknown certificate")
+		return
+	}
+	w.Header().Add("Link", fmt.Sprintf(`<%s/issuer>;rel="up"`, s.URL))
+	writeDER(w, http.StatusOK, s.certs[i])
+}
+
+func (s *Server) revokeCert(w http.ResponseWriter, thumbprint string, req request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	der, err := base64.URLEncoding.DecodeString(req.Certificate)
+	if err != nil {
+		der, err = base64.RawURLEncoding.DecodeString(req.Certificate)
+	}
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, "malformed", "Invalid certificate encoding")
+		return
+	}
+
+	for _, cert := range s.certs {
+		if string(cert) != string(der) {
+			continue
+		}
+		if s.revoked[string(der)] {
+			writeProblem(w, http.StatusConflict, "malformed", "Certificate already revoked")
+			return
+		}
+		s.revoked[string(der)] = true
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	writeProblem(w, http.StatusNotFound, "malformed", "Unknown certificate")
+}
+
+func (s *Server) regURL(acct *account) string {
+	return fmt.Sprintf("%s/reg/%d", s.URL, acct.ID)
+}
+
+// registered reports whether thumbprint belongs to an active account.
+// s.mu must be held.
+func (s *Server) registered(thumbprint string) bool {
+	acct, ok := s.accounts[thumbprint]
+	return ok && acct.Status != "deactivated"
+}
+
+// authorized reports whether the account has a valid authorization for
+// name. s.mu must be held.
+func (s *Server) authorized(thumbprint, name string) bool {
+	for _, a := range s.authzs {
+		if a.account == thumbprint && a.Status == "valid" && a.Identifier.Value == name && time.Now().Before(a.Expires) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupAuthz returns the authorization with the given id. s.mu must be held.
+func (s *Server) lookupAuthz(id string) *authz {
+	i, err := strconv.Atoi(id)
+	if err != nil || i < 0 || i >= len(s.authzs) {
+		return nil
+	}
+	return s.authzs[i]
+}
+
+// lookupChallenge returns the challenge with the given "authz/index" id and
+// its authorization. s.mu must be held.
+func (s *Server) lookupChallenge(id string) (*authz, *challenge) {
+	parts := strings.SplitN(id, "/", 2)
+	if len(parts) != 2 {
+		return nil, nil
+	}
+	a := s.lookupAuthz(parts[0])
+	if a == nil {
+		return nil, nil
+	}
+	i, err := strconv.Atoi(parts[1])
+	if err != nil || i < 0 || i >= len(a.Challenges) {
+		return nil, nil
+	}
+	return a, &a.Challenges[i]
+}
+
+// csrExtensions returns the extensions requested in csr that the server
+// copies into the certificate, i.e. the OCSP must staple TLS feature.
+func csrExtensions(csr *x509.CertificateRequest) []pkix.Extension {
+	var exts []pkix.Extension
+	for _, ext := range csr.Extensions {
+		if ext.Id.Equal([]int{1, 3, 6, 1, 5, 5, 7, 1, 24}) {
+			exts = append(exts, ext)
+		}
+	}
+	return exts
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeDER(w http.ResponseWriter, status int, der []byte) {
+	w.Header().Set("Content-Type", "application/pkix-cert")
+	w.WriteHeader(status)
+	w.Write(der)
+}
+
+func writeProblem(w http.ResponseWriter, status int, typ, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(problem{Type: "urn:acme:error:" + typ, Detail: detail})
+}
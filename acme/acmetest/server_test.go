@@ -0,0 +1,128 @@
+package acmetest_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	"github.com/xenolf/lego/acme"
+	"github.com/xenolf/lego/acme/acmetest"
+)
+
+func newRegisteredClient(t *testing.T, server *acmetest.Server) (*acme.Client, *presenter, *user) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("Could not generate test key:", err)
+	}
+	u := &user{key: key}
+
+	client, err := acme.NewClient(server.DirectoryURL(), u, acme.EC256)
+	if err != nil {
+		t.Fatalf("Could not create client: %v", err)
+	}
+	p := &presenter{}
+	client.SetChallengeProvider(acme.HTTP01, p)
+
+	if u.registration, err = client.Register(); err != nil {
+		t.Fatalf("Register error: got %v, want nil", err)
+	}
+	return client, p, u
+}
+
+func TestServerIssueAndRevoke(t *testing.T) {
+	server := acmetest.NewServer()
+	defer server.Close()
+
+	client, _, _ := newRegisteredClient(t, server)
+
+	cert, failures := client.ObtainCertificate([]string{"example.com"}, false, nil, true)
+	if len(failures) > 0 {
+		t.Fatalf("ObtainCertificate failures: %v", failures)
+	}
+
+	block, _ := pem.Decode(cert.Certificate)
+	if block == nil {
+		t.Fatal("Expected a PEM encoded certificate")
+	}
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatalf("Could not parse certificate: %v", err)
+	}
+	if err := leaf.CheckSignatureFrom(server.CACertificate()); err != nil {
+		t.Errorf("Expected the certificate to be signed by the CA: %v", err)
+	}
+	if len(leaf.Extensions) == 0 || !hasMustStaple(leaf) {
+		t.Error("Expected the must staple extension to be copied from the CSR")
+	}
+	if len(cert.IssuerCertificate) == 0 {
+		t.Error("Expected the issuer certificate to be fetched")
+	}
+
+	if err := client.RevokeCertificate(cert.Certificate); err != nil {
+		t.Fatalf("RevokeCertificate error: got %v, want nil", err)
+	}
+	if !server.Revoked(leaf.Raw) {
+		t.Error("Expected the server to record the revocation")
+	}
+	if err := client.RevokeCertificate(cert.Certificate); err == nil {
+		t.Error("Expected revoking the certificate twice to fail")
+	}
+}
+
+func TestServerRegisterTwice(t *testing.T) {
+	server := acmetest.NewServer()
+	defer server.Close()
+
+	client, _, _ := newRegisteredClient(t, server)
+
+	reg, err := client.Register()
+	if err != nil {
+		t.Fatalf("Register error: got %v, want nil", err)
+	}
+	if reg.URI != server.URL+"/reg/1" {
+		t.Errorf("Expected the existing registration %s/reg/1 but got %s", server.URL, reg.URI)
+	}
+}
+
+func TestServerObtainWithLoadedAccount(t *testing.T) {
+	server := acmetest.NewServer()
+	defer server.Close()
+
+	_, _, registered := newRegisteredClient(t, server)
+
+	var buf bytes.Buffer
+	acct := &acme.Account{Email: "test@example.com", Registration: registered.registration, PrivateKey: registered.key}
+	if err := acct.SaveAccount(&buf); err != nil {
+		t.Fatalf("SaveAccount error: got %v, want nil", err)
+	}
+	loaded, err := acme.LoadAccount(&buf)
+	if err != nil {
+		t.Fatalf("LoadAccount error: got %v, want nil", err)
+	}
+
+	client, err := acme.NewClient(server.DirectoryURL(), loaded, acme.EC256)
+	if err != nil {
+		t.Fatalf("Could not create client: %v", err)
+	}
+	if err := client.UseExistingAccount(loaded); err != nil {
+		t.Fatalf("UseExistingAccount error: got %v, want nil", err)
+	}
+	client.SetChallengeProvider(acme.HTTP01, &presenter{})
+
+	if _, failures := client.ObtainCertificate([]string{"example.com"}, false, nil, false); len(failures) > 0 {
+		t.Fatalf("ObtainCertificate failures with a loaded account: %v", failures)
+	}
+}
+
+func hasMustStaple(cert *x509.Certificate) bool {
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal([]int{1, 3, 6, 1, 5, 5, 7, 1, 24}) {
+			return true
+		}
+	}
+	return false
+}
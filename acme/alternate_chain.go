@@ -0,0 +1,152 @@
+package acme
+
+import (
+	"bytes"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// GetAlternateCertificates returns the alternate chains the CA offers for the
+// certificate at certURL in Link headers with rel="alternate", e.g. a chain to
+// a different root. Each chain is a PEM bundle of the certificate followed by
+// its issuers. It returns no chains if the CA offers none.
+func (c *Client) GetAlternateCertificates(certURL string) ([][]byte, error) {
+	resp, err := httpGet(certURL)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return nil, fmt.Errorf("acme: could not get certificate %s: %s", certURL, resp.Status)
+	}
+
+	var chains [][]byte
+	for _, url := range linksWithRel(resp.Header["Link"], "alternate") {
+		chain, err := c.getCertificateChain(url)
+		if err != nil {
+			return nil, fmt.Errorf("acme: could not get alternate chain %s: %v", url, err)
+		}
+		chains = append(chains, chain)
+	}
+	return chains, nil
+}
+
+// getCertificateChain downloads the certificate at url as a PEM bundle. The
+// CA may serve the chain as PEM, or the certificate as DER with an "up" link
+// to its issuer.
+func (c *Client) getCertificateChain(url string) ([]byte, error) {
+	resp, err := httpGet(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return nil, handleHTTPError(resp)
+	}
+
+	body, err := ioutil.ReadAll(limitReader(resp.Body, maxBodySize))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.Header.Get("Content-Type") == "application/pem-certificate-chain" {
+		if _, err := parsePEMBundle(body); err != nil {
+			return nil, err
+		}
+		return body, nil
+	}
+
+	if _, err := x509.ParseCertificate(body); err != nil {
+		return nil, err
+	}
+	chain := pemEncode(derCertificateBytes(body))
+
+	if up := parseLinks(resp.Header["Link"])["up"]; up != "" {
+		issuer, err := c.getIssuerCertificate(up)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, pemEncode(derCertificateBytes(issuer))...)
+	}
+	return chain, nil
+}
+
+// SelectChain returns the first of the PEM bundles in chains that leads up to
+// the root with the common name issuerCN: the last certificate of the chain
+// either is that root or is issued by it.
+func SelectChain(chains [][]byte, issuerCN string) ([]byte, bool) {
+	for _, chain := range chains {
+		if chainIssuedBy(chain, issuerCN) {
+			return chain, true
+		}
+	}
+	return nil, false
+}
+
+func chainIssuedBy(chain []byte, issuerCN string) bool {
+	certificates, err := parsePEMBundle(chain)
+	if err != nil {
+		return false
+	}
+	top := certificates[len(certificates)-1]
+	return top.Issuer.CommonName == issuerCN || top.Subject.CommonName == issuerCN
+}
+
+// preferChain replaces the chain of cert with an alternate chain leading up to
+// the root issuerCN, unless its default chain already does. If the CA offers
+// no such chain, cert is returned unchanged.
+func (c *Client) preferChain(cert CertificateResource, bundle bool, issuerCN string) CertificateResource {
+	leaf, _, err := splitPEMChain(cert.Certificate)
+	if err != nil || chainIssuedBy(bytes.Join([][]byte{leaf, cert.IssuerCertificate}, nil), issuerCN) {
+		return cert
+	}
+
+	chains, err := c.GetAlternateCertificates(cert.CertURL)
+	if err != nil {
+		logf("[WARNING][%s] acme: Could not get alternate chains: %v", cert.Domain, err)
+		return cert
+	}
+	chain, ok := SelectChain(chains, issuerCN)
+	if !ok {
+		logf("[INFO][%s] acme: No chain to %s offered; using the default chain", cert.Domain, issuerCN)
+		return cert
+	}
+
+	leaf, issuers, err := splitPEMChain(chain)
+	if err != nil {
+		return cert
+	}
+	cert.IssuerCertificate = issuers
+	cert.Certificate = leaf
+	if bundle {
+		cert.Certificate = chain
+	}
+	return cert
+}
+
+// relParamRegexp matches the rel parameter of a Link header value.
+var relParamRegexp = regexp.MustCompile(`^\s*rel\s*=\s*"?([^"]+)"?\s*$`)
+
+// linksWithRel returns the URLs of all links with the relation rel. Unlike
+// parseLinks, it keeps every link of a relation that may occur several times.
+func linksWithRel(links []string, rel string) []string {
+	var urls []string
+	for _, header := range links {
+		for _, link := range strings.Split(header, ",") {
+			parts := strings.Split(link, ";")
+			url := strings.Trim(strings.TrimSpace(parts[0]), "<>")
+			for _, param := range parts[1:] {
+				if matches := relParamRegexp.FindStringSubmatch(param); matches != nil && matches[1] == rel {
+					urls = append(urls, url)
+				}
+			}
+		}
+	}
+	return urls
+}
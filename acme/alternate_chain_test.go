@@ -0,0 +1,147 @@
+package acme
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newAlternateChainServer serves a certificate issued by "Test CA", whose
+// default chain ends at the self-signed "Test CA", and two alternate chains
+// in which "Test CA" is cross-signed by "Root B".
+func newAlternateChainServer(t *testing.T) (ts *httptest.Server, leafPEM, defaultIssuerPEM, crossPEM []byte) {
+	caKey, caCert, leafKey := newTestCA(t)
+	leaf := newTestLeaf(t, caKey, caCert, leafKey, time.Now().Add(time.Hour), nil)
+
+	rootKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal("Error generating private key:", err)
+	}
+	root := &x509.Certificate{
+		SerialNumber:          big.NewInt(3),
+		Subject:               pkix.Name{CommonName: "Root B"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	cross := *caCert
+	cross.SerialNumber = big.NewInt(4)
+	crossDER, err := x509.CreateCertificate(rand.Reader, &cross, root, &caKey.PublicKey, rootKey)
+	if err != nil {
+		t.Fatal("Error generating cross-signed cert:", err)
+	}
+
+	leafPEM = pemEncode(derCertificateBytes(leaf.Raw))
+	defaultIssuerPEM = pemEncode(derCertificateBytes(caCert.Raw))
+	crossPEM = pemEncode(derCertificateBytes(crossDER))
+
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/cert":
+			w.Header().Add("Link", fmt.Sprintf(`<%s/issuer>;rel="up"`, ts.URL))
+			w.Header().Add("Link", fmt.Sprintf(`<%s/cert/alt-pem>;rel="alternate", <%s/cert/alt-der>; rel=alternate`, ts.URL, ts.URL))
+			w.Write(leaf.Raw)
+		case "/cert/alt-pem":
+			w.Header().Set("Content-Type", "application/pem-certificate-chain")
+			w.Write(bytes.Join([][]byte{leafPEM, crossPEM}, nil))
+		case "/cert/alt-der":
+			w.Header().Add("Link", fmt.Sprintf(`<%s/issuer/cross>;rel="up"`, ts.URL))
+			w.Write(leaf.Raw)
+		case "/issuer":
+			w.Write(caCert.Raw)
+		case "/issuer/cross":
+			w.Write(crossDER)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	return ts, leafPEM, defaultIssuerPEM, crossPEM
+}
+
+func TestGetAlternateCertificates(t *testing.T) {
+	ts, leafPEM, _, crossPEM := newAlternateChainServer(t)
+	defer ts.Close()
+
+	client := &Client{}
+	chains, err := client.GetAlternateCertificates(ts.URL + "/cert")
+	if err != nil {
+		t.Fatalf("GetAlternateCertificates error: got %v, want nil", err)
+	}
+
+	expected := bytes.Join([][]byte{leafPEM, crossPEM}, nil)
+	if len(chains) != 2 || !bytes.Equal(chains[0], expected) || !bytes.Equal(chains[1], expected) {
+		t.Errorf("Expected both alternates to be the cross-signed chain but got %d chains:\n%s", len(chains), bytes.Join(chains, []byte("\n")))
+	}
+
+	if chain, ok := SelectChain(chains, "Root B"); !ok || !bytes.Equal(chain, expected) {
+		t.Error("Expected SelectChain to select the chain to Root B")
+	}
+	if _, ok := SelectChain(chains, "Root C"); ok {
+		t.Error("Expected SelectChain to find no chain to Root C")
+	}
+
+	chains, err = client.GetAlternateCertificates(ts.URL + "/cert/alt-der")
+	if err != nil || len(chains) != 0 {
+		t.Errorf("Expected no alternates for a certificate without alternate links, got %d chains and %v", len(chains), err)
+	}
+}
+
+func TestPreferChain(t *testing.T) {
+	ts, leafPEM, issuerPEM, crossPEM := newAlternateChainServer(t)
+	defer ts.Close()
+
+	client := &Client{}
+	cert := CertificateResource{
+		Domain:            "example.com",
+		CertURL:           ts.URL + "/cert",
+		Certificate:       bytes.Join([][]byte{leafPEM, issuerPEM}, nil),
+		IssuerCertificate: issuerPEM,
+	}
+
+	if got := client.preferChain(cert, true, "Test CA"); !reflect.DeepEqual(got, cert) {
+		t.Error("Expected the default chain to be kept when it leads to the preferred root")
+	}
+	if got := client.preferChain(cert, true, "Root C"); !reflect.DeepEqual(got, cert) {
+		t.Error("Expected the default chain to be kept when no alternate leads to the preferred root")
+	}
+
+	got := client.preferChain(cert, true, "Root B")
+	if !bytes.Equal(got.IssuerCertificate, crossPEM) {
+		t.Errorf("Expected the cross-signed issuer but got:\n%s", got.IssuerCertificate)
+	}
+	if !bytes.Equal(got.Certificate, bytes.Join([][]byte{leafPEM, crossPEM}, nil)) {
+		t.Errorf("Expected the bundle of the alternate chain but got:\n%s", got.Certificate)
+	}
+
+	got = client.preferChain(CertificateResource{CertURL: cert.CertURL, Certificate: leafPEM, IssuerCertificate: issuerPEM}, false, "Root B")
+	if !bytes.Equal(got.Certificate, leafPEM) || !bytes.Equal(got.IssuerCertificate, crossPEM) {
+		t.Error("Expected an unbundled certificate to stay unbundled with the alternate issuer")
+	}
+}
+
+func TestLinksWithRel(t *testing.T) {
+	links := []string{
+		`<https://ca.example/issuer>;rel="up"`,
+		`<https://ca.example/alt/1>;rel="alternate", <https://ca.example/alt/2>; rel=alternate`,
+		`<https://ca.example/alt/3>; title="x"; rel="alternate"`,
+	}
+
+	expected := []string{"https://ca.example/alt/1", "https://ca.example/alt/2", "https://ca.example/alt/3"}
+	if got := linksWithRel(links, "alternate"); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v but got %v", expected, got)
+	}
+	if got := linksWithRel(links, "next"); got != nil {
+		t.Errorf("Expected no next links but got %v", got)
+	}
+}
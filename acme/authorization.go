@@ -0,0 +1,27 @@
+package acme
+
+import "time"
+
+// Authorization is the state of an authorization at the CA, i.e. of the
+// account's permission to get certificates for an identifier.
+type Authorization struct {
+	URL        string
+	Identifier string
+	Status     string
+	Expires    time.Time
+}
+
+// GetAuthorization fetches the authorization at url from the CA.
+func (c *Client) GetAuthorization(url string) (*Authorization, error) {
+	var authz authorization
+	if _, err := getJSON(url, &authz, c.clock); err != nil {
+		return nil, err
+	}
+
+	return &Authorization{
+		URL:        url,
+		Identifier: authz.Identifier.Value,
+		Status:     authz.Status,
+		Expires:    authz.Expires,
+	}, nil
+}
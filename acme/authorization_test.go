@@ -0,0 +1,62 @@
+package acme
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGetAuthorization(t *testing.T) {
+	expires := time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/authz/1" {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSONResponse(w, authorization{Identifier: identifier{Type: "dns", Value: "example.com"}, Status: "valid", Expires: expires})
+	}))
+	defer ts.Close()
+
+	client := &Client{}
+	authz, err := client.GetAuthorization(ts.URL + "/authz/1")
+	if err != nil {
+		t.Fatalf("GetAuthorization error: got %v, want nil", err)
+	}
+	want := &Authorization{URL: ts.URL + "/authz/1", Identifier: "example.com", Status: "valid", Expires: expires}
+	if !reflect.DeepEqual(authz, want) {
+		t.Errorf("Expected %+v but got %+v", want, authz)
+	}
+
+	if _, err := client.GetAuthorization(ts.URL + "/authz/2"); err == nil {
+		t.Error("Expected an unknown authorization to return an error")
+	}
+}
+
+func TestSolveChallengesSkipsValidAuthorization(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("Expected the status of the new-authz response to be used, got a request for %s", r.URL.Path)
+	}))
+	defer ts.Close()
+
+	provider := &recordingProvider{timeout: time.Second}
+	client, authz := newDNSSolveClient(t, provider,
+		func(fqdn, value string) (bool, error) { return true, nil },
+		stubValidate,
+		[]string{"example.com", "www.example.com"})
+	for i := range authz {
+		authz[i].AuthURL = ts.URL + "/authz/" + authz[i].Domain
+		if authz[i].Domain == "example.com" {
+			authz[i].Body.Status = "valid"
+		}
+	}
+
+	if failures := client.solveChallenges(context.Background(), authz); len(failures) > 0 {
+		t.Fatalf("Expected no failures, got %v", failures)
+	}
+	if want := []string{"www.example.com"}; !reflect.DeepEqual(provider.present, want) || !reflect.DeepEqual(provider.cleanUps, want) {
+		t.Errorf("Expected only %v to be presented and cleaned up, presented %v and cleaned up %v", want, provider.present, provider.cleanUps)
+	}
+}
@@ -0,0 +1,85 @@
+package acme
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// caaCriticalFlag is the issuer critical flag of a CAA record.
+const caaCriticalFlag = 128
+
+// CheckCAA reports whether the CAA records of domain permit the CA with the
+// given identity, e.g. "letsencrypt.org", to issue a certificate for it. As in
+// RFC 6844, the records of the closest name up the domain tree that has any
+// apply, and a domain without any CAA records permits every CA. For a
+// wildcard domain like "*.example.com" the issuewild records are used if there
+// are any. CheckCAA asks the RecursiveNameservers.
+func CheckCAA(domain, caaIdentity string) (bool, error) {
+	wildcard := strings.HasPrefix(domain, "*.")
+	fqdn := ToFqdn(strings.TrimPrefix(domain, "*."))
+
+	for _, index := range dns.Split(fqdn) {
+		name := fqdn[index:]
+
+		in, err := dnsQuery(name, dns.TypeCAA, RecursiveNameservers, true)
+		if err != nil {
+			return false, err
+		}
+
+		// Any response code other than NOERROR and NXDOMAIN is treated as error
+		if in.Rcode != dns.RcodeNameError && in.Rcode != dns.RcodeSuccess {
+			return false, fmt.Errorf("Unexpected response code '%s' for CAA records of %s",
+				dns.RcodeToString[in.Rcode], name)
+		}
+
+		var records []*dns.CAA
+		for _, rr := range in.Answer {
+			if caa, ok := rr.(*dns.CAA); ok {
+				records = append(records, caa)
+			}
+		}
+		if len(records) > 0 {
+			return caaPermits(records, caaIdentity, wildcard), nil
+		}
+	}
+
+	return true, nil
+}
+
+// caaPermits reports whether the CAA records of a name permit the CA with
+// the given identity to issue a certificate.
+func caaPermits(records []*dns.CAA, caaIdentity string, wildcard bool) bool {
+	var issue, issueWild []string
+	for _, caa := range records {
+		switch strings.ToLower(caa.Tag) {
+		case "issue":
+			issue = append(issue, caa.Value)
+		case "issuewild":
+			issueWild = append(issueWild, caa.Value)
+		case "iodef":
+		default:
+			// A CA must not issue if it does not understand a critical property.
+			if caa.Flag&caaCriticalFlag != 0 {
+				return false
+			}
+		}
+	}
+
+	values := issue
+	if wildcard && len(issueWild) > 0 {
+		values = issueWild
+	}
+	if len(values) == 0 {
+		return true
+	}
+
+	for _, value := range values {
+		issuer := strings.TrimSpace(strings.SplitN(value, ";", 2)[0])
+		if strings.EqualFold(issuer, caaIdentity) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,112 @@
+package acme
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// serverHandlerCAA returns a handler that answers CAA queries with the given
+// records for each name and everything else with NXDOMAIN. Names listed in
+// failing are answered with SERVFAIL.
+func serverHandlerCAA(records map[string][]string, failing ...string) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+
+		name := req.Question[0].Name
+		for _, f := range failing {
+			if name == f {
+				m.Rcode = dns.RcodeServerFailure
+				w.WriteMsg(m)
+				return
+			}
+		}
+
+		values, ok := records[name]
+		if !ok || req.Question[0].Qtype != dns.TypeCAA {
+			m.Rcode = dns.RcodeNameError
+			w.WriteMsg(m)
+			return
+		}
+		for _, value := range values {
+			rr, _ := dns.NewRR(name + " 300 IN CAA " + value)
+			m.Answer = append(m.Answer, rr)
+		}
+		w.WriteMsg(m)
+	}
+}
+
+var checkCAATests = []struct {
+	domain  string
+	records map[string][]string
+	want    bool
+}{
+	// No CAA records anywhere permit every CA.
+	{"example.com", nil, true},
+	{"example.com", map[string][]string{"example.com.": {`0 issue "letsencrypt.org"`}}, true},
+	{"example.com", map[string][]string{"example.com.": {`0 issue "LetsEncrypt.org; account=1"`}}, true},
+	{"example.com", map[string][]string{"example.com.": {`0 issue "ca.example.net"`}}, false},
+	{"example.com", map[string][]string{"example.com.": {`0 issue "ca.example.net"`, `0 issue "letsencrypt.org"`}}, true},
+	{"example.com", map[string][]string{"example.com.": {`0 issue ";"`}}, false},
+	// Records without an issue property do not restrict issuance.
+	{"example.com", map[string][]string{"example.com.": {`0 iodef "mailto:security@example.com"`}}, true},
+	// The records of the closest name up the tree apply.
+	{"www.sub.example.com", map[string][]string{"example.com.": {`0 issue "ca.example.net"`}}, false},
+	{"www.sub.example.com", map[string][]string{"example.com.": {`0 issue "letsencrypt.org"`}}, true},
+	{"sub.example.com", map[string][]string{
+		"sub.example.com.": {`0 issue "letsencrypt.org"`},
+		"example.com.":     {`0 issue "ca.example.net"`},
+	}, true},
+	{"sub.example.com", map[string][]string{
+		"sub.example.com.": {`0 issue "ca.example.net"`},
+		"example.com.":     {`0 issue "letsencrypt.org"`},
+	}, false},
+	// Wildcards use issuewild if there is any, and issue otherwise.
+	{"*.example.com", map[string][]string{"example.com.": {`0 issue "letsencrypt.org"`, `0 issuewild ";"`}}, false},
+	{"*.example.com", map[string][]string{"example.com.": {`0 issue "ca.example.net"`, `0 issuewild "letsencrypt.org"`}}, true},
+	{"*.example.com", map[string][]string{"example.com.": {`0 issue "letsencrypt.org"`}}, true},
+	{"example.com", map[string][]string{"example.com.": {`0 issue "ca.example.net"`, `0 issuewild "letsencrypt.org"`}}, false},
+	// Unknown properties only forbid issuance if they are critical.
+	{"example.com", map[string][]string{"example.com.": {`0 issue "letsencrypt.org"`, `0 unknown "value"`}}, true},
+	{"example.com", map[string][]string{"example.com.": {`0 issue "letsencrypt.org"`, `128 unknown "value"`}}, false},
+}
+
+func TestCheckCAA(t *testing.T) {
+	defer func(nameservers []string) { RecursiveNameservers = nameservers }(RecursiveNameservers)
+
+	for i, tt := range checkCAATests {
+		server, addr, err := runLocalDNSTestServer("udp", "127.0.0.1:0", serverHandlerCAA(tt.records))
+		if err != nil {
+			t.Fatalf("Failed to start test server: %v", err)
+		}
+		RecursiveNameservers = []string{addr}
+
+		ok, err := CheckCAA(tt.domain, "letsencrypt.org")
+		server.Shutdown()
+		if err != nil {
+			t.Errorf("#%d %s: expected no error, got %v", i, tt.domain, err)
+		}
+		if ok != tt.want {
+			t.Errorf("#%d %s: expected CheckCAA to return %t, got %t", i, tt.domain, tt.want, ok)
+		}
+	}
+}
+
+func TestCheckCAAServerFailure(t *testing.T) {
+	records := map[string][]string{"example.com.": {`0 issue "letsencrypt.org"`}}
+	server, addr, err := runLocalDNSTestServer("udp", "127.0.0.1:0", serverHandlerCAA(records, "sub.example.com."))
+	if err != nil {
+		t.Fatalf("Failed to start test server: %v", err)
+	}
+	defer server.Shutdown()
+
+	defer func(nameservers []string) { RecursiveNameservers = nameservers }(RecursiveNameservers)
+	RecursiveNameservers = []string{addr}
+
+	ok, err := CheckCAA("sub.example.com", "letsencrypt.org")
+	if ok || err == nil || !strings.Contains(err.Error(), "SERVFAIL") {
+		t.Errorf("got (%t, %v); want an error with SERVFAIL", ok, err)
+	}
+}
@@ -0,0 +1,200 @@
+package acme
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// CertificateExport is a JSON friendly description of a CertificateResource
+// for scripts and other tools. The PEM encoded fields are base64 encoded
+// in JSON.
+type CertificateExport struct {
+	Domain            string    `json:"domain"`
+	CertURL           string    `json:"certUrl"`
+	CertStableURL     string    `json:"certStableUrl,omitempty"`
+	Serial            string    `json:"serial"`
+	NotBefore         time.Time `json:"notBefore"`
+	NotAfter          time.Time `json:"notAfter"`
+	SANs              []string  `json:"sans"`
+	IssuerCommonName  string    `json:"issuerCommonName"`
+	Certificate       []byte    `json:"certificate"`
+	IssuerCertificate []byte    `json:"issuerCertificate,omitempty"`
+	PrivateKey        []byte    `json:"privateKey,omitempty"`
+}
+
+// Export describes the certificate resource as a CertificateExport, reading
+// the serial, validity, names and issuer from its leaf certificate. The
+// private key is only included if includePrivateKey is true.
+func (c CertificateResource) Export(includePrivateKey bool) (*CertificateExport, error) {
+	certificates, err := parsePEMBundle(c.Certificate)
+	if err != nil {
+		return nil, err
+	}
+
+	x509Cert := certificates[0]
+	if x509Cert.IsCA {
+		return nil, fmt.Errorf("[%s] Certificate bundle starts with a CA certificate", c.Domain)
+	}
+
+	export := &CertificateExport{
+		Domain:            c.Domain,
+		CertURL:           c.CertURL,
+		CertStableURL:     c.CertStableURL,
+		Serial:            fmt.Sprintf("%x", x509Cert.SerialNumber),
+		NotBefore:         x509Cert.NotBefore,
+		NotAfter:          x509Cert.NotAfter,
+		SANs:              x509Cert.DNSNames,
+		IssuerCommonName:  x509Cert.Issuer.CommonName,
+		Certificate:       c.Certificate,
+		IssuerCertificate: c.IssuerCertificate,
+	}
+	if includePrivateKey {
+		export.PrivateKey = c.PrivateKey
+	}
+
+	return export, nil
+}
+
+// ExportJSON returns the CertificateExport of the certificate resource encoded as JSON.
+func (c CertificateResource) ExportJSON(includePrivateKey bool) ([]byte, error) {
+	export, err := c.Export(includePrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(export)
+}
+
+// WriteFiles writes the certificate resource into dir as separate PEM files
+// for deployment targets that need them apart:
+//
+//	<basename>.crt            the leaf certificate
+//	<basename>.chain.pem      the issuer chain
+//	<basename>.fullchain.pem  the leaf certificate followed by the chain
+//	<basename>.key            the private key, readable by the owner only
+//
+// The chain is taken from a bundled Certificate, or else from
+// IssuerCertificate. If there is no chain, the chain file is not written and
+// the full chain holds the leaf only. Likewise, the key file is not written
+// for a certificate obtained for a CSR, which has no private key.
+func (c CertificateResource) WriteFiles(dir, basename string) error {
+	leaf, chain, err := c.splitChain()
+	if err != nil {
+		return err
+	}
+
+	path := func(ext string) string {
+		return filepath.Join(dir, basename+ext)
+	}
+
+	if err := ioutil.WriteFile(path(".crt"), leaf, 0644); err != nil {
+		return err
+	}
+	if len(chain) > 0 {
+		if err := ioutil.WriteFile(path(".chain.pem"), chain, 0644); err != nil {
+			return err
+		}
+	}
+	if err := ioutil.WriteFile(path(".fullchain.pem"), bytes.Join([][]byte{leaf, chain}, nil), 0644); err != nil {
+		return err
+	}
+	if len(c.PrivateKey) > 0 {
+		if err := writePrivateFile(path(".key"), c.PrivateKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writePrivateFile writes data to a file readable by the owner only. Unlike
+// ioutil.WriteFile, which keeps the permissions of an existing file, it
+// writes a new file and renames it over path, so that a key left readable
+// by others is not rewritten in place.
+func writePrivateFile(path string, data []byte) error {
+	// TempFile creates the file with permissions 0600.
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Leaf returns the issued certificate, i.e. the first certificate of
+// Certificate.
+func (c CertificateResource) Leaf() (*x509.Certificate, error) {
+	leaf, _, err := c.splitChain()
+	if err != nil {
+		return nil, err
+	}
+	certificates, err := parsePEMBundle(leaf)
+	if err != nil {
+		return nil, fmt.Errorf("[%s] %v", c.Domain, err)
+	}
+	return certificates[0], nil
+}
+
+// Issuers returns the issuer chain of the certificate, starting with the
+// certificate that issued the leaf. Like WriteFiles, it takes the chain from
+// a bundled Certificate, or else from IssuerCertificate. It returns no
+// certificates if there is no chain.
+func (c CertificateResource) Issuers() ([]*x509.Certificate, error) {
+	_, chain, err := c.splitChain()
+	if err != nil || len(chain) == 0 {
+		return nil, err
+	}
+	certificates, err := parsePEMBundle(chain)
+	if err != nil {
+		return nil, fmt.Errorf("[%s] %v", c.Domain, err)
+	}
+	return certificates, nil
+}
+
+// splitChain returns the PEM encoded leaf certificate and issuer chain of the
+// certificate resource, taking the chain from a bundled Certificate, or else
+// from IssuerCertificate.
+func (c CertificateResource) splitChain() (leaf, chain []byte, err error) {
+	leaf, chain, err = splitPEMChain(c.Certificate)
+	if err != nil {
+		return nil, nil, fmt.Errorf("[%s] %v", c.Domain, err)
+	}
+	if len(chain) == 0 {
+		chain = c.IssuerCertificate
+	}
+	return leaf, chain, nil
+}
+
+// splitPEMChain splits a PEM bundle into its first certificate and the PEM
+// encoding of the certificates following it.
+func splitPEMChain(bundle []byte) (leaf, chain []byte, err error) {
+	block, rest := pem.Decode(bundle)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, nil, fmt.Errorf("Certificate is not a PEM encoded certificate")
+	}
+	leaf = pem.EncodeToMemory(block)
+
+	for {
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			chain = append(chain, pem.EncodeToMemory(block)...)
+		}
+	}
+	return leaf, chain, nil
+}
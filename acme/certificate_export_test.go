@@ -0,0 +1,323 @@
+package acme
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCertificateResourceExportJSON(t *testing.T) {
+	caKey, caCert, leafKey := newTestCA(t)
+	notAfter := time.Now().Add(24 * time.Hour).UTC().Truncate(time.Second)
+	leaf := newTestLeaf(t, caKey, caCert, leafKey, notAfter, nil)
+
+	cert := CertificateResource{
+		Domain:            "example.com",
+		CertURL:           "https://ca.example.com/cert/1",
+		Certificate:       pemEncode(derCertificateBytes(leaf.Raw)),
+		IssuerCertificate: pemEncode(derCertificateBytes(caCert.Raw)),
+		PrivateKey:        pemEncode(leafKey),
+	}
+
+	data, err := cert.ExportJSON(false)
+	if err != nil {
+		t.Fatalf("ExportJSON error: got %v, want nil", err)
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatalf("ExportJSON produced invalid JSON: %v", err)
+	}
+	for _, field := range []string{"domain", "certUrl", "serial", "notBefore", "notAfter", "sans", "issuerCommonName", "certificate", "issuerCertificate"} {
+		if _, ok := fields[field]; !ok {
+			t.Errorf("Expected field %q in %s", field, data)
+		}
+	}
+	if _, ok := fields["privateKey"]; ok {
+		t.Errorf("Expected the private key to be omitted by default but got %s", data)
+	}
+
+	var export CertificateExport
+	if err := json.Unmarshal(data, &export); err != nil {
+		t.Fatalf("Could not decode export: %v", err)
+	}
+	if export.Serial != "2" {
+		t.Errorf("Expected serial %q but got %q", "2", export.Serial)
+	}
+	if !export.NotAfter.Equal(notAfter) {
+		t.Errorf("Expected notAfter %s but got %s", notAfter, export.NotAfter)
+	}
+	if !reflect.DeepEqual(export.SANs, []string{"example.com"}) {
+		t.Errorf("Expected SANs [example.com] but got %v", export.SANs)
+	}
+	if export.IssuerCommonName != "Test CA" {
+		t.Errorf("Expected issuer %q but got %q", "Test CA", export.IssuerCommonName)
+	}
+	if !bytes.Equal(export.Certificate, cert.Certificate) {
+		t.Error("Expected the PEM certificate to round trip through base64")
+	}
+
+	data, err = cert.ExportJSON(true)
+	if err != nil {
+		t.Fatalf("ExportJSON error: got %v, want nil", err)
+	}
+	export = CertificateExport{}
+	if err := json.Unmarshal(data, &export); err != nil {
+		t.Fatalf("Could not decode export: %v", err)
+	}
+	if !bytes.Equal(export.PrivateKey, cert.PrivateKey) {
+		t.Error("Expected the private key to be included when requested")
+	}
+}
+
+func TestCertificateResourceWriteFiles(t *testing.T) {
+	caKey, caCert, leafKey := newTestCA(t)
+	leaf := newTestLeaf(t, caKey, caCert, leafKey, time.Now().Add(24*time.Hour), nil)
+	leafPEM := pemEncode(derCertificateBytes(leaf.Raw))
+	issuerPEM := pemEncode(derCertificateBytes(caCert.Raw))
+	keyPEM := pemEncode(leafKey)
+
+	tests := []struct {
+		name  string
+		cert  CertificateResource
+		chain []byte
+	}{
+		{"bundled", CertificateResource{Certificate: append(append([]byte{}, leafPEM...), issuerPEM...), IssuerCertificate: issuerPEM, PrivateKey: keyPEM}, issuerPEM},
+		{"unbundled", CertificateResource{Certificate: leafPEM, IssuerCertificate: issuerPEM, PrivateKey: keyPEM}, issuerPEM},
+		{"no chain", CertificateResource{Certificate: leafPEM, PrivateKey: keyPEM}, nil},
+	}
+
+	for _, tt := range tests {
+		dir, err := ioutil.TempDir("", "certs")
+		if err != nil {
+			t.Fatalf("TempDir error: got %v, want nil", err)
+		}
+		defer os.RemoveAll(dir)
+
+		if err := tt.cert.WriteFiles(dir, "example.com"); err != nil {
+			t.Fatalf("%s: WriteFiles error: got %v, want nil", tt.name, err)
+		}
+
+		expected := map[string][]byte{
+			"example.com.crt":           leafPEM,
+			"example.com.fullchain.pem": append(append([]byte{}, leafPEM...), tt.chain...),
+			"example.com.key":           keyPEM,
+		}
+		if tt.chain != nil {
+			expected["example.com.chain.pem"] = tt.chain
+		} else if _, err := os.Stat(filepath.Join(dir, "example.com.chain.pem")); !os.IsNotExist(err) {
+			t.Errorf("%s: expected no chain file to be written", tt.name)
+		}
+
+		for name, content := range expected {
+			data, err := ioutil.ReadFile(filepath.Join(dir, name))
+			if err != nil {
+				t.Errorf("%s: ReadFile error: got %v, want nil", tt.name, err)
+				continue
+			}
+			if !bytes.Equal(data, content) {
+				t.Errorf("%s: unexpected content in %s:\n%s", tt.name, name, data)
+			}
+		}
+
+		info, err := os.Stat(filepath.Join(dir, "example.com.key"))
+		if err != nil {
+			t.Fatalf("%s: Stat error: got %v, want nil", tt.name, err)
+		}
+		if perm := info.Mode().Perm(); perm != 0600 {
+			t.Errorf("%s: expected the key to have permissions 0600 but got %o", tt.name, perm)
+		}
+	}
+}
+
+func TestCertificateResourceWriteFilesReplacesReadableKey(t *testing.T) {
+	caKey, caCert, leafKey := newTestCA(t)
+	leaf := newTestLeaf(t, caKey, caCert, leafKey, time.Now().Add(24*time.Hour), nil)
+	cert := CertificateResource{Certificate: pemEncode(derCertificateBytes(leaf.Raw)), PrivateKey: pemEncode(leafKey)}
+
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatalf("TempDir error: got %v, want nil", err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyFile := filepath.Join(dir, "example.com.key")
+	if err := ioutil.WriteFile(keyFile, []byte("old key"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Undo the umask, which may have masked group and other bits.
+	if err := os.Chmod(keyFile, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cert.WriteFiles(dir, "example.com"); err != nil {
+		t.Fatalf("WriteFiles error: got %v, want nil", err)
+	}
+
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		t.Fatalf("ReadFile error: got %v, want nil", err)
+	}
+	if !bytes.Equal(data, cert.PrivateKey) {
+		t.Errorf("Expected the key to be replaced, got:\n%s", data)
+	}
+	info, err := os.Stat(keyFile)
+	if err != nil {
+		t.Fatalf("Stat error: got %v, want nil", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("Expected the key to have permissions 0600 but got %o", perm)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir error: got %v, want nil", err)
+	}
+	if len(files) != 3 {
+		t.Errorf("Expected the crt, fullchain and key files only, got %d files", len(files))
+	}
+}
+
+// newTestChain returns a leaf issued by an intermediate issued by "Test CA",
+// all PEM encoded.
+func newTestChain(t *testing.T) (leafPEM, intermediatePEM, caPEM []byte) {
+	caKey, caCert, intermediateKey := newTestCA(t)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(3),
+		Subject:               pkix.Name{CommonName: "Test Intermediate"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &intermediateKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal("Error generating intermediate cert:", err)
+	}
+	intermediate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal("Error parsing intermediate cert:", err)
+	}
+
+	leafKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal("Error generating private key:", err)
+	}
+	leaf := newTestLeaf(t, intermediateKey, intermediate, leafKey, time.Now().Add(time.Hour), nil)
+
+	return pemEncode(derCertificateBytes(leaf.Raw)), pemEncode(derCertificateBytes(intermediate.Raw)), pemEncode(derCertificateBytes(caCert.Raw))
+}
+
+func TestCertificateResourceLeafAndIssuers(t *testing.T) {
+	leafPEM, intermediatePEM, caPEM := newTestChain(t)
+	chainPEM := bytes.Join([][]byte{intermediatePEM, caPEM}, nil)
+
+	tests := []struct {
+		name    string
+		cert    CertificateResource
+		issuers []string
+	}{
+		{"bundled", CertificateResource{Certificate: bytes.Join([][]byte{leafPEM, chainPEM}, nil), IssuerCertificate: chainPEM}, []string{"Test Intermediate", "Test CA"}},
+		{"unbundled", CertificateResource{Certificate: leafPEM, IssuerCertificate: chainPEM}, []string{"Test Intermediate", "Test CA"}},
+		{"no chain", CertificateResource{Certificate: leafPEM}, nil},
+	}
+
+	for _, tt := range tests {
+		leaf, err := tt.cert.Leaf()
+		if err != nil {
+			t.Fatalf("%s: Leaf error: got %v, want nil", tt.name, err)
+		}
+		if leaf.Subject.CommonName != "example.com" {
+			t.Errorf("%s: expected the leaf for example.com but got %q", tt.name, leaf.Subject.CommonName)
+		}
+
+		issuers, err := tt.cert.Issuers()
+		if err != nil {
+			t.Fatalf("%s: Issuers error: got %v, want nil", tt.name, err)
+		}
+		var names []string
+		for _, issuer := range issuers {
+			names = append(names, issuer.Subject.CommonName)
+		}
+		if !reflect.DeepEqual(names, tt.issuers) {
+			t.Errorf("%s: expected issuers %v but got %v", tt.name, tt.issuers, names)
+		}
+	}
+
+	if _, err := (CertificateResource{}).Leaf(); err == nil {
+		t.Error("Expected an error for a certificate resource without a certificate")
+	}
+}
+
+func TestCheckCertResponsePEMChain(t *testing.T) {
+	leafPEM, intermediatePEM, caPEM := newTestChain(t)
+	chainPEM := bytes.Join([][]byte{leafPEM, intermediatePEM, caPEM}, nil)
+
+	client := &Client{user: mockUser{regres: &RegistrationResource{URI: "https://ca.example.com/reg/1"}}}
+	for _, bundle := range []bool{false, true} {
+		resp := &http.Response{
+			StatusCode: http.StatusCreated,
+			Header:     http.Header{"Content-Type": {"application/pem-certificate-chain"}},
+			Body:       ioutil.NopCloser(bytes.NewReader(chainPEM)),
+		}
+
+		var certRes CertificateResource
+		done, err := client.checkCertResponse(resp, &certRes, bundle, 0)
+		if err != nil || !done {
+			t.Fatalf("bundle=%t: checkCertResponse: got %t, %v, want true, nil", bundle, done, err)
+		}
+
+		want := leafPEM
+		if bundle {
+			want = chainPEM
+		}
+		if !bytes.Equal(certRes.Certificate, want) {
+			t.Errorf("bundle=%t: unexpected certificate %s", bundle, certRes.Certificate)
+		}
+		if !bytes.Equal(certRes.IssuerCertificate, bytes.Join([][]byte{intermediatePEM, caPEM}, nil)) {
+			t.Errorf("bundle=%t: expected both issuers, got %s", bundle, certRes.IssuerCertificate)
+		}
+	}
+}
+
+func TestCheckCertResponseWithoutIssuerLink(t *testing.T) {
+	caKey, caCert, leafKey := newTestCA(t)
+	leaf := newTestLeaf(t, caKey, caCert, leafKey, time.Now().Add(time.Hour), nil)
+
+	client := &Client{user: mockUser{regres: &RegistrationResource{URI: "https://ca.example.com/reg/1"}}}
+	resp := &http.Response{
+		StatusCode: http.StatusCreated,
+		Header:     http.Header{},
+		Body:       ioutil.NopCloser(bytes.NewReader(leaf.Raw)),
+	}
+
+	var certRes CertificateResource
+	done, err := client.checkCertResponse(resp, &certRes, true, 0)
+	if err != nil || !done {
+		t.Fatalf("checkCertResponse: got %t, %v, want true, nil", done, err)
+	}
+	if !bytes.Equal(certRes.Certificate, pemEncode(derCertificateBytes(leaf.Raw))) {
+		t.Errorf("Expected only the issued certificate, got %s", certRes.Certificate)
+	}
+	if certRes.IssuerCertificate != nil {
+		t.Errorf("Expected no issuer certificate, got %s", certRes.IssuerCertificate)
+	}
+
+	// The certificate names no OCSP server, so there is no OCSP status to get.
+	if _, _, err := GetOCSPForCert(certRes.Certificate); err != ErrNoOCSPServer {
+		t.Errorf("Expected %v but got %v", ErrNoOCSPServer, err)
+	}
+}
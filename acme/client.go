@@ -2,8 +2,10 @@
 package acme
 
 import (
+	"context"
 	"crypto"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
@@ -13,14 +15,23 @@ import (
 	"net"
 	"net/http"
 	"regexp"
-	"strconv"
 	"strings"
 	"time"
+
+	"golang.org/x/crypto/ocsp"
+	"golang.org/x/net/idna"
 )
 
+// StdLogger is the logging interface used by this package. It is satisfied by
+// *log.Logger, but any type providing Printf can be plugged in.
+type StdLogger interface {
+	Printf(format string, args ...interface{})
+}
+
 var (
-	// Logger is an optional custom logger.
-	Logger *log.Logger
+	// Logger is an optional custom logger. Set it to an implementation that
+	// discards its input to silence the package entirely.
+	Logger StdLogger
 )
 
 const (
@@ -31,6 +42,14 @@ const (
 	// “new-reg”, “new-authz” and “new-cert” endpoints. From the documentation the
 	// limitation is 20 requests per second, but using 20 as value doesn't work but 18 do
 	overallRequestLimit = 18
+
+	// defaultPollInterval is how long to wait between polls of the CA if it
+	// does not send a Retry-After header.
+	defaultPollInterval = time.Second
+
+	// defaultCertPollAttempts is how often a certificate is polled for
+	// before giving up, unless set with SetPolling.
+	defaultCertPollAttempts = 1000
 )
 
 // logf writes a log entry. It uses Logger if not
@@ -53,10 +72,10 @@ type User interface {
 
 // Interface for all challenge solvers to implement.
 type solver interface {
-	Solve(challenge challenge, domain string) error
+	Solve(ctx context.Context, challenge challenge, domain string) error
 }
 
-type validateFunc func(j *jws, domain, uri string, chlng challenge) error
+type validateFunc func(ctx context.Context, j *jws, domain, uri string, chlng challenge) error
 
 // Client is the user-friendy way to ACME
 type Client struct {
@@ -65,6 +84,36 @@ type Client struct {
 	jws       *jws
 	keyType   KeyType
 	solvers   map[Challenge]solver
+
+	dnsPreCheck        PreCheckFunc
+	dnsSkipPropagation bool
+
+	pollInterval time.Duration
+	pollAttempts int
+
+	onObtained func(CertificateResource)
+
+	inFlight *challengeTracker
+
+	clock Clock
+}
+
+// Clock tells the current time. The Client asks it instead of the system
+// clock wherever it computes a point in time or a wait: whether a certificate
+// is due for renewal, how long a Retry-After header asks to wait, when a rate
+// limit resets and when a cached zone expires. This lets tests control the
+// time.
+type Clock interface {
+	Now() time.Time
+}
+
+// clockNow returns the current time of clock, or of the system clock if
+// clock is nil.
+func clockNow(clock Clock) time.Time {
+	if clock == nil {
+		return time.Now()
+	}
+	return clock.Now()
 }
 
 // NewClient creates a new ACME client on behalf of the user. The client will depend on
@@ -76,9 +125,15 @@ func NewClient(caDirURL string, user User, keyType KeyType) (*Client, error) {
 	if privKey == nil {
 		return nil, errors.New("private key was nil")
 	}
+	if err := checkKeySize(privKey); err != nil {
+		return nil, err
+	}
+	if _, err := CertPool(); err != nil {
+		return nil, err
+	}
 
 	var dir directory
-	if _, err := getJSON(caDirURL, &dir); err != nil {
+	if _, err := getJSON(caDirURL, &dir, nil); err != nil {
 		return nil, fmt.Errorf("get directory at '%s': %v", caDirURL, err)
 	}
 
@@ -96,32 +151,58 @@ func NewClient(caDirURL string, user User, keyType KeyType) (*Client, error) {
 	}
 
 	jws := &jws{privKey: privKey, directoryURL: caDirURL}
+	c := &Client{directory: dir, user: user, jws: jws, keyType: keyType, inFlight: newChallengeTracker()}
 
 	// REVIEW: best possibility?
 	// Add all available solvers with the right index as per ACME
 	// spec to this map. Otherwise they won`t be found.
-	solvers := make(map[Challenge]solver)
-	solvers[HTTP01] = &httpChallenge{jws: jws, validate: validate, provider: &HTTPProviderServer{}}
-	solvers[TLSSNI01] = &tlsSNIChallenge{jws: jws, validate: validate, provider: &TLSProviderServer{}}
+	c.solvers = make(map[Challenge]solver)
+	c.solvers[HTTP01] = &httpChallenge{jws: jws, validate: c.validate, tracker: c.inFlight, provider: &HTTPProviderServer{}}
+	c.solvers[TLSSNI01] = &tlsSNIChallenge{jws: jws, validate: c.validate, tracker: c.inFlight, provider: &TLSProviderServer{}}
+	c.solvers[TLSALPN01] = &tlsALPNChallenge{jws: jws, validate: c.validate, tracker: c.inFlight, provider: &TLSALPNProviderServer{}}
 
-	return &Client{directory: dir, user: user, jws: jws, keyType: keyType, solvers: solvers}, nil
+	return c, nil
 }
 
 // SetChallengeProvider specifies a custom provider p that can solve the given challenge type.
 func (c *Client) SetChallengeProvider(challenge Challenge, p ChallengeProvider) error {
 	switch challenge {
 	case HTTP01:
-		c.solvers[challenge] = &httpChallenge{jws: c.jws, validate: validate, provider: p}
+		c.solvers[challenge] = &httpChallenge{jws: c.jws, validate: c.validate, tracker: c.inFlight, provider: p}
 	case TLSSNI01:
-		c.solvers[challenge] = &tlsSNIChallenge{jws: c.jws, validate: validate, provider: p}
+		c.solvers[challenge] = &tlsSNIChallenge{jws: c.jws, validate: c.validate, tracker: c.inFlight, provider: p}
+	case TLSALPN01:
+		c.solvers[challenge] = &tlsALPNChallenge{jws: c.jws, validate: c.validate, tracker: c.inFlight, provider: p}
 	case DNS01:
-		c.solvers[challenge] = &dnsChallenge{jws: c.jws, validate: validate, provider: p}
+		c.solvers[challenge] = &dnsChallenge{jws: c.jws, validate: c.validate, tracker: c.inFlight, provider: p, preCheck: c.dnsPreCheck, skipPropagation: c.dnsSkipPropagation}
 	default:
 		return fmt.Errorf("Unknown challenge %v", challenge)
 	}
 	return nil
 }
 
+// SetDNSPreCheck sets the function deciding when a DNS-01 record has propagated
+// far enough to ask the CA to validate it, e.g. once a majority of the authoritative
+// nameservers return it. It applies to the current and any later DNS provider.
+// A nil PreCheckFunc restores the default, PreCheckDNS.
+func (c *Client) SetDNSPreCheck(preCheck PreCheckFunc) {
+	c.dnsPreCheck = preCheck
+	if chlng, ok := c.solvers[DNS01]; ok {
+		chlng.(*dnsChallenge).preCheck = preCheck
+	}
+}
+
+// DisableDNSPropagationCheck makes the DNS-01 solver ask the CA to validate a
+// record as soon as the provider presented it, without waiting for the
+// pre-check to pass. It is meant for setups that make sure the record has
+// propagated themselves. It applies to the current and any later DNS provider.
+func (c *Client) DisableDNSPropagationCheck(disable bool) {
+	c.dnsSkipPropagation = disable
+	if chlng, ok := c.solvers[DNS01]; ok {
+		chlng.(*dnsChallenge).skipPropagation = disable
+	}
+}
+
 // SetHTTPAddress specifies a custom interface:port to be used for HTTP based challenges.
 // If this option is not used, the default port 80 and all interfaces will be used.
 // To only specify a port and no interface use the ":port" notation.
@@ -145,8 +226,8 @@ func (c *Client) SetHTTPAddress(iface string) error {
 // If this option is not used, the default port 443 and all interfaces will be used.
 // To only specify a port and no interface use the ":port" notation.
 //
-// NOTE: This REPLACES any custom TLS-SNI provider previously set by calling
-// c.SetChallengeProvider with the default TLS-SNI challenge provider.
+// NOTE: This REPLACES any custom TLS-SNI and TLS-ALPN providers previously set
+// by calling c.SetChallengeProvider with the default TLS challenge providers.
 func (c *Client) SetTLSAddress(iface string) error {
 	host, port, err := net.SplitHostPort(iface)
 	if err != nil {
@@ -156,9 +237,37 @@ func (c *Client) SetTLSAddress(iface string) error {
 	if chlng, ok := c.solvers[TLSSNI01]; ok {
 		chlng.(*tlsSNIChallenge).provider = NewTLSProviderServer(host, port)
 	}
+	if chlng, ok := c.solvers[TLSALPN01]; ok {
+		chlng.(*tlsALPNChallenge).provider = NewTLSALPNProviderServer(host, port)
+	}
 	return nil
 }
 
+// SetPolling sets how the client polls the CA while it waits for a challenge to
+// be validated and for a certificate to be issued. interval is the time between
+// two polls when the CA does not send a Retry-After header, and maxAttempts caps
+// the number of polls. A zero value keeps the respective default: polling once
+// per second, a challenge until the CA decides on it and a certificate up to
+// 1000 times.
+func (c *Client) SetPolling(interval time.Duration, maxAttempts int) {
+	c.pollInterval = interval
+	c.pollAttempts = maxAttempts
+}
+
+// SetClock sets the Clock of the client. A nil Clock restores the system
+// clock. The zone cache of FindZoneByFqdn is shared by all clients, so it
+// follows the clock that was set last.
+func (c *Client) SetClock(clock Clock) {
+	c.clock = clock
+	c.jws.clock = clock
+	setZoneCacheClock(clock)
+}
+
+// now returns the current time of the client's clock.
+func (c *Client) now() time.Time {
+	return clockNow(c.clock)
+}
+
 // ExcludeChallenges explicitly removes challenges from the pool for solving.
 func (c *Client) ExcludeChallenges(challenges []Challenge) {
 	// Loop through all challenges and delete the requested one if found.
@@ -167,15 +276,107 @@ func (c *Client) ExcludeChallenges(challenges []Challenge) {
 	}
 }
 
-// Register the current account to the ACME server.
+// OnCertificateObtained sets a function that is called with every certificate
+// the client obtains, including renewals, e.g. to reload a TLS server. It is
+// called synchronously, before the certificate is returned, on the goroutine
+// that obtained it. If the client obtains certificates from several goroutines,
+// f must be safe for concurrent use. A nil f removes the hook.
+func (c *Client) OnCertificateObtained(f func(CertificateResource)) {
+	c.onObtained = f
+}
+
+// certificateObtained calls the function set with OnCertificateObtained.
+func (c *Client) certificateObtained(cert CertificateResource) {
+	if c.onObtained != nil {
+		c.onObtained(cert)
+	}
+}
+
+// Register the current account to the ACME server. If the CA requires an
+// external account binding, it returns ErrEABRequired; see
+// RegisterAccountWithEAB.
 func (c *Client) Register() (*RegistrationResource, error) {
 	if c == nil || c.user == nil {
 		return nil, errors.New("acme: cannot register a nil client or user")
 	}
 	logf("[INFO] acme: Registering account for %s", c.user.GetEmail())
 
+	return c.register(nil)
+}
+
+// RegisterAgreeingToTOS registers the current account like Register and
+// agrees to the terms of service at tosURL, which must be the exact version
+// the user accepted. Unlike AgreeToTOS, it never agrees to terms the user
+// has not seen: if the CA announces its current terms of service at a
+// different URL, it returns a TOSChangedError instead. The announcement in
+// the directory is checked before registering; the one with the
+// registration only afterwards, in which case the registration is returned
+// along with the error.
+func (c *Client) RegisterAgreeingToTOS(tosURL string) (*RegistrationResource, error) {
+	if c == nil || c.user == nil {
+		return nil, errors.New("acme: cannot register a nil client or user")
+	}
+
+	var dir directory
+	if _, err := getJSON(c.jws.directoryURL, &dir, c.clock); err != nil {
+		return nil, fmt.Errorf("get directory at '%s': %v", c.jws.directoryURL, err)
+	}
+	if current := dir.Meta.TermsOfService; current != "" && current != tosURL {
+		return nil, TOSChangedError{Accepted: tosURL, Current: current}
+	}
+
+	logf("[INFO] acme: Registering account for %s", c.user.GetEmail())
+	reg, err := c.register(nil)
+	if err != nil {
+		return nil, err
+	}
+	if reg.TosURL != "" && reg.TosURL != tosURL {
+		return reg, TOSChangedError{Accepted: tosURL, Current: reg.TosURL}
+	}
+
+	reg.Body.Agreement = tosURL
+	reg.Body.Resource = "reg"
+	if _, err := postJSON(c.jws, reg.URI, reg.Body, nil); err != nil {
+		return reg, err
+	}
+	return reg, nil
+}
+
+// RegisterAccountWithEAB registers the current account with the CA like
+// Register, binding it to an account the user already holds with the CA
+// (external account binding). kid is the key identifier and hmacEncoded the
+// base64url encoded HMAC key, both provided by the CA for this purpose. If
+// the CA rejects the binding, its RemoteError is returned as is.
+func (c *Client) RegisterAccountWithEAB(kid string, hmacEncoded string) (*RegistrationResource, error) {
+	if c == nil || c.user == nil {
+		return nil, errors.New("acme: cannot register a nil client or user")
+	}
+	logf("[INFO] acme: Registering account (EAB) for %s", c.user.GetEmail())
+
+	hmacKey, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(hmacEncoded, "="))
+	if err != nil {
+		return nil, fmt.Errorf("acme: could not decode the EAB HMAC key: %v", err)
+	}
+
+	eab, err := signEABContent(c.directory.NewRegURL, kid, hmacKey, c.user.GetPrivateKey())
+	if err != nil {
+		return nil, fmt.Errorf("acme: could not sign the external account binding: %v", err)
+	}
+
+	return c.register(eab)
+}
+
+// register sends a new-reg request, including the external account
+// binding eab if it is not nil. It returns ErrEABRequired without sending
+// the request if the directory requires a binding and eab is nil.
+func (c *Client) register(eab json.RawMessage) (*RegistrationResource, error) {
+	if eab == nil && c.directory.Meta.ExternalAccountRequired {
+		return nil, ErrEABRequired
+	}
+
 	regMsg := registrationMessage{
-		Resource: "new-reg",
+		Resource:               "new-reg",
+		ExternalAccountBinding: eab,
 	}
 	if c.user.GetEmail() != "" {
 		regMsg.Contact = []string{"mailto:" + c.user.GetEmail()}
@@ -222,6 +423,48 @@ func (c *Client) Register() (*RegistrationResource, error) {
 	return reg, nil
 }
 
+// RolloverAccountKey replaces the key of the registered account with newKey at the
+// CA, as described in RFC 8555 section 7.3.5. On success the client signs all further
+// requests with newKey; the caller is responsible for storing it in place of the old
+// key. On failure the client keeps using the old key.
+func (c *Client) RolloverAccountKey(newKey crypto.PrivateKey) error {
+	if c.directory.KeyChangeURL == "" {
+		return errors.New("acme: the server does not support account key rollover")
+	}
+	reg := c.user.GetRegistration()
+	if reg == nil || reg.URI == "" {
+		return errors.New("acme: the account must be registered to roll over its key")
+	}
+
+	signer, ok := c.jws.privKey.(crypto.Signer)
+	if !ok {
+		return errors.New("acme: unsupported account key type")
+	}
+	oldKey := keyAsJWK(signer.Public())
+	if oldKey == nil {
+		return errors.New("acme: unsupported account key type")
+	}
+
+	msg, err := json.Marshal(keyChangeMessage{Account: reg.URI, OldKey: oldKey})
+	if err != nil {
+		return err
+	}
+
+	// The inner JWS proves possession of the new key, the outer one
+	// signed with the old key authorizes the change.
+	inner, err := signInnerContent(c.directory.KeyChangeURL, newKey, msg)
+	if err != nil {
+		return err
+	}
+
+	if _, err := postJSON(c.jws, c.directory.KeyChangeURL, json.RawMessage(inner), nil); err != nil {
+		return err
+	}
+
+	c.jws.privKey = newKey
+	return nil
+}
+
 // DeleteRegistration deletes the client's user registration from the ACME
 // server.
 func (c *Client) DeleteRegistration() error {
@@ -302,10 +545,14 @@ func (c *Client) AgreeToTOS() error {
 // your issued certificate as a bundle.
 // This function will never return a partial certificate. If one domain in the list fails,
 // the whole certificate will fail.
+// A CSR without any name is rejected; its error is returned under the empty domain "".
 func (c *Client) ObtainCertificateForCSR(csr x509.CertificateRequest, bundle bool) (CertificateResource, map[string]error) {
 	// figure out what domains it concerns
 	// start with the common name
-	domains := []string{csr.Subject.CommonName}
+	var domains []string
+	if csr.Subject.CommonName != "" {
+		domains = append(domains, csr.Subject.CommonName)
+	}
 
 	// loop over the SubjectAltName DNS names
 DNSNames:
@@ -321,13 +568,17 @@ DNSNames:
 		domains = append(domains, sanName)
 	}
 
+	if len(domains) == 0 {
+		return CertificateResource{}, map[string]error{"": errors.New("acme: the CSR does not contain any domain name")}
+	}
+
 	if bundle {
 		logf("[INFO][%s] acme: Obtaining bundled SAN certificate given a CSR", strings.Join(domains, ", "))
 	} else {
 		logf("[INFO][%s] acme: Obtaining SAN certificate given a CSR", strings.Join(domains, ", "))
 	}
 
-	challenges, failures := c.getChallenges(domains)
+	challenges, failures := c.getChallenges(context.Background(), domains)
 	// If any challenge fails - return. Do not generate partial SAN certificates.
 	if len(failures) > 0 {
 		for _, auth := range challenges {
@@ -337,7 +588,7 @@ DNSNames:
 		return CertificateResource{}, failures
 	}
 
-	errs := c.solveChallenges(challenges)
+	errs := c.solveChallenges(context.Background(), challenges)
 	// If any challenge fails - return. Do not generate partial SAN certificates.
 	if len(errs) > 0 {
 		return CertificateResource{}, errs
@@ -355,9 +606,45 @@ DNSNames:
 	// Add the CSR to the certificate so that it can be used for renewals.
 	cert.CSR = pemEncode(&csr)
 
+	if err == nil {
+		c.certificateObtained(cert)
+	}
 	return cert, failures
 }
 
+// ObtainRequest holds the parameters of a certificate request made
+// with Obtain. Domains, Bundle, PrivateKey and MustStaple have the same
+// meaning as the parameters of ObtainCertificate.
+type ObtainRequest struct {
+	Domains    []string
+	Bundle     bool
+	PrivateKey crypto.PrivateKey
+	MustStaple bool
+
+	// KeyType is the type of key generated for the certificate when
+	// PrivateKey is nil. It defaults to the KeyType the Client was
+	// created with. If PrivateKey is set, KeyType must be empty or
+	// describe that key.
+	KeyType KeyType
+
+	// SignatureAlgorithm is the algorithm the CSR is signed with. It must
+	// suit the certificate key, e.g. x509.ECDSAWithSHA384 for an EC key.
+	// By default the algorithm is chosen by crypto/x509 to match the key:
+	// SHA-256 for RSA and P-256 keys, and SHA-384 for P-384 keys.
+	SignatureAlgorithm x509.SignatureAlgorithm
+
+	// PreferredChain is the common name of the root the certificate chain
+	// should lead up to. If the default chain leads to a different root, an
+	// alternate chain offered by the CA is used instead, if there is one.
+	PreferredChain string
+
+	// Subject holds additional subject fields for the CSR, such as
+	// Organization, OrganizationalUnit and Country. Its CommonName is
+	// ignored; it is always the first domain. Public CAs ignore most of
+	// these fields, but private ACME CAs may rely on them.
+	Subject pkix.Name
+}
+
 // ObtainCertificate tries to obtain a single certificate using all domains passed into it.
 // The first domain in domains is used for the CommonName field of the certificate, all other
 // domains are added using the Subject Alternate Names extension. A new private key is generated
@@ -368,13 +655,88 @@ DNSNames:
 // This function will never return a partial certificate. If one domain in the list fails,
 // the whole certificate will fail.
 func (c *Client) ObtainCertificate(domains []string, bundle bool, privKey crypto.PrivateKey, mustStaple bool) (CertificateResource, map[string]error) {
-	if bundle {
+	return c.Obtain(ObtainRequest{Domains: domains, Bundle: bundle, PrivateKey: privKey, MustStaple: mustStaple})
+}
+
+// Obtain is like ObtainCertificate, but takes its parameters as an
+// ObtainRequest. This allows the key type of the certificate to differ
+// from the one the Client was created with.
+//
+// Internationalized domain names are converted to their ASCII form before
+// they are sent to the CA, so the certificate and any failures refer to
+// e.g. xn--mnchen-3ya.example rather than münchen.example.
+func (c *Client) Obtain(request ObtainRequest) (CertificateResource, map[string]error) {
+	return c.obtain(context.Background(), request)
+}
+
+// ObtainTimeoutError is the failure reported for every domain when
+// ObtainCertificateWithTimeout runs out of time.
+type ObtainTimeoutError struct {
+	Timeout time.Duration
+}
+
+func (e ObtainTimeoutError) Error() string {
+	return fmt.Sprintf("acme: could not obtain the certificate within %s", e.Timeout)
+}
+
+// ObtainCertificateWithTimeout is like Obtain, but gives up once timeout has
+// passed, e.g. when a DNS provider or the propagation check stalls. Any record
+// presented so far is still cleaned up. Once the deadline has passed, the
+// failure of every domain is an ObtainTimeoutError, as it may well wrap the
+// deadline, e.g. "Error presenting token: context deadline exceeded". Only
+// a challenge the CA found invalid is kept as it is.
+//
+// The deadline is checked while the authorizations are requested, while the
+// challenges are solved, which includes waiting for DNS propagation, the calls
+// to a ChallengeProviderWithContext and polling the CA for the outcome of a
+// challenge, and before the certificate is requested.
+func (c *Client) ObtainCertificateWithTimeout(request ObtainRequest, timeout time.Duration) (CertificateResource, map[string]error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cert, failures := c.obtain(ctx, request)
+	if ctx.Err() != context.DeadlineExceeded {
+		return cert, failures
+	}
+	for domain, err := range failures {
+		// The verdict of the CA is kept, even if it came after the deadline.
+		if _, ok := err.(challengeError); !ok {
+			failures[domain] = ObtainTimeoutError{Timeout: timeout}
+		}
+	}
+	return cert, failures
+}
+
+func (c *Client) obtain(ctx context.Context, request ObtainRequest) (CertificateResource, map[string]error) {
+	domains := request.Domains
+
+	keyType, err := c.obtainKeyType(request)
+	if err == nil {
+		err = checkSignatureAlgorithm(request.SignatureAlgorithm, request.PrivateKey, keyType)
+	}
+	if err == nil && request.PrivateKey != nil {
+		err = checkKeySize(request.PrivateKey)
+	}
+	if err != nil {
+		failures := make(map[string]error)
+		for _, domain := range domains {
+			failures[domain] = err
+		}
+		return CertificateResource{}, failures
+	}
+
+	domains, failures := toASCIIDomains(domains)
+	if len(failures) > 0 {
+		return CertificateResource{}, failures
+	}
+
+	if request.Bundle {
 		logf("[INFO][%s] acme: Obtaining bundled SAN certificate", strings.Join(domains, ", "))
 	} else {
 		logf("[INFO][%s] acme: Obtaining SAN certificate", strings.Join(domains, ", "))
 	}
 
-	challenges, failures := c.getChallenges(domains)
+	challenges, failures := c.getChallenges(ctx, domains)
 	// If any challenge fails - return. Do not generate partial SAN certificates.
 	if len(failures) > 0 {
 		for _, auth := range challenges {
@@ -384,7 +746,7 @@ func (c *Client) ObtainCertificate(domains []string, bundle bool, privKey crypto
 		return CertificateResource{}, failures
 	}
 
-	errs := c.solveChallenges(challenges)
+	errs := c.solveChallenges(ctx, challenges)
 	// If any challenge fails - return. Do not generate partial SAN certificates.
 	if len(errs) > 0 {
 		return CertificateResource{}, errs
@@ -392,18 +754,78 @@ func (c *Client) ObtainCertificate(domains []string, bundle bool, privKey crypto
 
 	logf("[INFO][%s] acme: Validations succeeded; requesting certificates", strings.Join(domains, ", "))
 
-	cert, err := c.requestCertificate(challenges, bundle, privKey, mustStaple)
+	// Do not request a certificate that the caller has already given up on.
+	if err := ctx.Err(); err != nil {
+		for _, chln := range challenges {
+			failures[chln.Domain] = err
+		}
+		return CertificateResource{}, failures
+	}
+
+	cert, err := c.requestCertificate(challenges, request, keyType)
 	if err != nil {
 		for _, chln := range challenges {
 			failures[chln.Domain] = err
 		}
+	} else {
+		if request.PreferredChain != "" {
+			cert = c.preferChain(cert, request.Bundle, request.PreferredChain)
+		}
+		c.certificateObtained(cert)
 	}
 
 	return cert, failures
 }
 
+// toASCIIDomains converts internationalized domain names like münchen.example
+// to the ASCII (punycode) form that the CA, the CSR and DNS expect, like
+// xn--mnchen-3ya.example. ASCII domain names are only lower cased.
+func toASCIIDomains(domains []string) ([]string, map[string]error) {
+	ascii := make([]string, len(domains))
+	failures := make(map[string]error)
+	for i, domain := range domains {
+		name, err := idna.ToASCII(strings.ToLower(domain))
+		if err != nil {
+			failures[domain] = fmt.Errorf("acme: invalid domain name %q: %v", domain, err)
+			continue
+		}
+		ascii[i] = name
+	}
+	return ascii, failures
+}
+
+// obtainKeyType returns the KeyType to generate the certificate key
+// with for the request, checking it against a supplied private key.
+func (c *Client) obtainKeyType(request ObtainRequest) (KeyType, error) {
+	if request.KeyType == "" {
+		return c.keyType, nil
+	}
+	if !isValidKeyType(request.KeyType) {
+		return "", fmt.Errorf("Invalid KeyType: %s", request.KeyType)
+	}
+	if request.PrivateKey != nil {
+		keyType, err := getKeyType(request.PrivateKey)
+		if err != nil || keyType != request.KeyType {
+			return "", fmt.Errorf("The supplied private key is not of KeyType %s", request.KeyType)
+		}
+	}
+	return request.KeyType, nil
+}
+
 // RevokeCertificate takes a PEM encoded certificate or bundle and tries to revoke it at the CA.
 func (c *Client) RevokeCertificate(certificate []byte) error {
+	return c.RevokeCertificateWithReason(certificate, ocsp.Unspecified)
+}
+
+// RevokeCertificateWithReason is like RevokeCertificate, but also tells the CA why
+// the certificate is revoked. reason is one of the RFC 5280 revocation reason
+// codes, which are defined as constants in golang.org/x/crypto/ocsp,
+// e.g. ocsp.KeyCompromise.
+func (c *Client) RevokeCertificateWithReason(certificate []byte, reason int) error {
+	if reason < ocsp.Unspecified || reason > ocsp.AACompromise || reason == 7 {
+		return fmt.Errorf("Invalid revocation reason code %d", reason)
+	}
+
 	certificates, err := parsePEMBundle(certificate)
 	if err != nil {
 		return err
@@ -416,10 +838,44 @@ func (c *Client) RevokeCertificate(certificate []byte) error {
 
 	encodedCert := base64.URLEncoding.EncodeToString(x509Cert.Raw)
 
-	_, err = postJSON(c.jws, c.directory.RevokeCertURL, revokeCertMessage{Resource: "revoke-cert", Certificate: encodedCert}, nil)
+	_, err = postJSON(c.jws, c.directory.RevokeCertURL, revokeCertMessage{Resource: "revoke-cert", Certificate: encodedCert, Reason: reason}, nil)
 	return err
 }
 
+// RenewOptions holds the parameters of RenewWithOptions.
+type RenewOptions struct {
+	// DaysRemaining is the renewal window. The certificate is only
+	// renewed once it expires in less than DaysRemaining days.
+	DaysRemaining int
+	Bundle        bool
+	MustStaple    bool
+	// MustRenewWithSameKey requires the renewed certificate to keep the key
+	// of the certificate, e.g. because its public key is pinned. The
+	// PrivateKey, or the CSR, of the CertificateResource must then be the
+	// one of the certificate. RenewCertificate has no such option, as its
+	// signature is kept for existing callers; it reuses a PrivateKey
+	// without checking it against the certificate.
+	MustRenewWithSameKey bool
+}
+
+// RenewWithOptions renews the certificate like RenewCertificate, but only if it
+// expires within opts.DaysRemaining days. Otherwise the passed in CertificateResource
+// is returned unchanged.
+func (c *Client) RenewWithOptions(cert CertificateResource, opts RenewOptions) (CertificateResource, error) {
+	certificates, err := parsePEMBundle(cert.Certificate)
+	if err != nil {
+		return CertificateResource{}, err
+	}
+
+	timeLeft := certificates[0].NotAfter.Sub(c.now())
+	if timeLeft >= time.Duration(opts.DaysRemaining)*24*time.Hour {
+		logf("[INFO][%s] acme: Certificate expires in %d days; no need to renew", cert.Domain, int(timeLeft.Hours()/24))
+		return cert, nil
+	}
+
+	return c.renew(cert, opts)
+}
+
 // RenewCertificate takes a CertificateResource and tries to renew the certificate.
 // If the renewal process succeeds, the new certificate will ge returned in a new CertResource.
 // Please be aware that this function will return a new certificate in ANY case that is not an error.
@@ -429,6 +885,12 @@ func (c *Client) RevokeCertificate(certificate []byte) error {
 // your issued certificate as a bundle.
 // For private key reuse the PrivateKey property of the passed in CertificateResource should be non-nil.
 func (c *Client) RenewCertificate(cert CertificateResource, bundle, mustStaple bool) (CertificateResource, error) {
+	return c.renew(cert, RenewOptions{Bundle: bundle, MustStaple: mustStaple})
+}
+
+// renew renews the certificate with the options of opts other than
+// DaysRemaining.
+func (c *Client) renew(cert CertificateResource, opts RenewOptions) (CertificateResource, error) {
 	// Input certificate is PEM encoded. Decode it here as we may need the decoded
 	// cert later on in the renewal process. The input may be a bundle or a single certificate.
 	certificates, err := parsePEMBundle(cert.Certificate)
@@ -442,7 +904,7 @@ func (c *Client) RenewCertificate(cert CertificateResource, bundle, mustStaple b
 	}
 
 	// This is just meant to be informal for the user.
-	timeLeft := x509Cert.NotAfter.Sub(time.Now().UTC())
+	timeLeft := x509Cert.NotAfter.Sub(c.now())
 	logf("[INFO][%s] acme: Trying renewal with %d hours remaining", cert.Domain, int(timeLeft.Hours()))
 
 	// We always need to request a new certificate to renew.
@@ -453,17 +915,28 @@ func (c *Client) RenewCertificate(cert CertificateResource, bundle, mustStaple b
 		if err != nil {
 			return CertificateResource{}, err
 		}
-		newCert, failures := c.ObtainCertificateForCSR(*csr, bundle)
+		if opts.MustRenewWithSameKey && !publicKeysEqual(x509Cert.PublicKey, csr.PublicKey) {
+			return CertificateResource{}, fmt.Errorf("[%s] CSR does not use the key of the certificate", cert.Domain)
+		}
+		newCert, failures := c.ObtainCertificateForCSR(*csr, opts.Bundle)
 		return newCert, failures[cert.Domain]
 	}
 
 	var privKey crypto.PrivateKey
 	if cert.PrivateKey != nil {
-		privKey, err = parsePEMPrivateKey(cert.PrivateKey)
+		privKey, err = ParsePrivateKeyPEM(cert.PrivateKey)
 		if err != nil {
 			return CertificateResource{}, err
 		}
 	}
+	if opts.MustRenewWithSameKey {
+		if privKey == nil {
+			return CertificateResource{}, fmt.Errorf("[%s] Renewing with the same key needs the private key of the certificate", cert.Domain)
+		}
+		if !publicKeyMatches(x509Cert, privKey) {
+			return CertificateResource{}, fmt.Errorf("[%s] Private key does not match the certificate", cert.Domain)
+		}
+	}
 
 	var domains []string
 	var failures map[string]error
@@ -480,26 +953,45 @@ func (c *Client) RenewCertificate(cert CertificateResource, bundle, mustStaple b
 		domains = append(domains, x509Cert.Subject.CommonName)
 	}
 
-	newCert, failures := c.ObtainCertificate(domains, bundle, privKey, mustStaple)
+	newCert, failures := c.ObtainCertificate(domains, opts.Bundle, privKey, opts.MustStaple)
 	return newCert, failures[cert.Domain]
 }
 
 // Looks through the challenge combinations to find a solvable match.
-// Then solves the challenges in series and returns.
-func (c *Client) solveChallenges(challenges []authorizationResource) map[string]error {
+// Then solves the challenges in series and returns. DNS-01 challenges
+// are solved last and together, see dnsChallenge.solveAll.
+func (c *Client) solveChallenges(ctx context.Context, challenges []authorizationResource) map[string]error {
+	var dnsAuthz []authorizationResource
+	var dnsChallenges []challenge
+	var dnsDomains []string
+
 	// loop through the resources, basically through the domains.
 	failures := make(map[string]error)
 	for _, authz := range challenges {
+		if err := ctx.Err(); err != nil {
+			c.disableAuthz(authz)
+			failures[authz.Domain] = err
+			continue
+		}
+		// The new-authz response tells whether the CA already validated the
+		// identifier, e.g. for another order of the same account, so there is
+		// nothing to present. Boulder might recycle recent validated authz
+		// (see issue #267).
 		if authz.Body.Status == "valid" {
-			// Boulder might recycle recent validated authz (see issue #267)
 			logf("[INFO][%s] acme: Authorization already valid; skipping challenge", authz.Domain)
 			continue
 		}
 		// no solvers - no solving
 		if solvers := c.chooseSolvers(authz.Body, authz.Domain); solvers != nil {
+			if i, ok := singleDNSChallenge(solvers); ok {
+				dnsAuthz = append(dnsAuthz, authz)
+				dnsChallenges = append(dnsChallenges, authz.Body.Challenges[i])
+				dnsDomains = append(dnsDomains, authz.Domain)
+				continue
+			}
 			for i, solver := range solvers {
 				// TODO: do not immediately fail if one domain fails to validate.
-				err := solver.Solve(authz.Body.Challenges[i], authz.Domain)
+				err := solver.Solve(ctx, authz.Body.Challenges[i], authz.Domain)
 				if err != nil {
 					c.disableAuthz(authz)
 					failures[authz.Domain] = err
@@ -511,9 +1003,33 @@ func (c *Client) solveChallenges(challenges []authorizationResource) map[string]
 		}
 	}
 
+	if len(dnsAuthz) > 0 {
+		errs := c.solvers[DNS01].(*dnsChallenge).solveAll(ctx, dnsDomains, dnsChallenges)
+		for _, authz := range dnsAuthz {
+			if err, ok := errs[authz.Domain]; ok {
+				c.disableAuthz(authz)
+				failures[authz.Domain] = err
+			}
+		}
+	}
+
 	return failures
 }
 
+// singleDNSChallenge reports whether solvers consists of the DNS-01 solver
+// only, and the index of its challenge.
+func singleDNSChallenge(solvers map[int]solver) (int, bool) {
+	if len(solvers) != 1 {
+		return 0, false
+	}
+	for i, s := range solvers {
+		if _, ok := s.(*dnsChallenge); ok {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
 // Checks all combinations from the server and returns an array of
 // solvers which should get executed in series.
 func (c *Client) chooseSolvers(auth authorization, domain string) map[int]solver {
@@ -536,13 +1052,23 @@ func (c *Client) chooseSolvers(auth authorization, domain string) map[int]solver
 }
 
 // Get the challenges needed to proof our identifier to the ACME server.
-func (c *Client) getChallenges(domains []string) ([]authorizationResource, map[string]error) {
+// Once ctx is done, no more authorizations are requested and the failure of
+// each remaining domain is ctx.Err().
+func (c *Client) getChallenges(ctx context.Context, domains []string) ([]authorizationResource, map[string]error) {
 	resc, errc := make(chan authorizationResource), make(chan domainError)
 
 	delay := time.Second / overallRequestLimit
 
+	failures := make(map[string]error)
+	var requested int
 	for _, domain := range domains {
-		time.Sleep(delay)
+		select {
+		case <-ctx.Done():
+			failures[domain] = ctx.Err()
+			continue
+		case <-time.After(delay):
+		}
+		requested++
 
 		go func(domain string) {
 			authMsg := authorization{Resource: "new-authz", Identifier: identifier{Type: "dns", Value: domain}}
@@ -565,8 +1091,7 @@ func (c *Client) getChallenges(domains []string) ([]authorizationResource, map[s
 	}
 
 	responses := make(map[string]authorizationResource)
-	failures := make(map[string]error)
-	for i := 0; i < len(domains); i++ {
+	for i := 0; i < requested; i++ {
 		select {
 		case res := <-resc:
 			responses[res.Domain] = res
@@ -603,14 +1128,15 @@ func (c *Client) disableAuthz(auth authorizationResource) error {
 	return err
 }
 
-func (c *Client) requestCertificate(authz []authorizationResource, bundle bool, privKey crypto.PrivateKey, mustStaple bool) (CertificateResource, error) {
+func (c *Client) requestCertificate(authz []authorizationResource, request ObtainRequest, keyType KeyType) (CertificateResource, error) {
 	if len(authz) == 0 {
 		return CertificateResource{}, errors.New("Passed no authorizations to requestCertificate!")
 	}
 
 	var err error
+	privKey := request.PrivateKey
 	if privKey == nil {
-		privKey, err = generatePrivateKey(c.keyType)
+		privKey, err = generatePrivateKey(keyType)
 		if err != nil {
 			return CertificateResource{}, err
 		}
@@ -624,12 +1150,15 @@ func (c *Client) requestCertificate(authz []authorizationResource, bundle bool,
 	}
 
 	// TODO: should the CSR be customizable?
-	csr, err := generateCsr(privKey, commonName.Domain, san, mustStaple)
+	subject := request.Subject
+	subject.CommonName = commonName.Domain
+
+	csr, err := generateCsr(privKey, subject, san, request.MustStaple, request.SignatureAlgorithm)
 	if err != nil {
 		return CertificateResource{}, err
 	}
 
-	return c.requestCertificateForCsr(authz, bundle, csr, pemEncode(privKey))
+	return c.requestCertificateForCsr(authz, request.Bundle, csr, pemEncode(privKey))
 }
 
 func (c *Client) requestCertificateForCsr(authz []authorizationResource, bundle bool, csr []byte, privateKeyPem []byte) (CertificateResource, error) {
@@ -657,9 +1186,12 @@ func (c *Client) requestCertificateForCsr(authz []authorizationResource, bundle
 		PrivateKey: privateKeyPem,
 	}
 
-	maxChecks := 1000
+	maxChecks := defaultCertPollAttempts
+	if c.pollAttempts > 0 {
+		maxChecks = c.pollAttempts
+	}
 	for i := 0; i < maxChecks; i++ {
-		done, err := c.checkCertResponse(resp, &certRes, bundle)
+		done, err := c.checkCertResponse(resp, &certRes, bundle, i)
 		resp.Body.Close()
 		if err != nil {
 			return CertificateResource{}, err
@@ -682,11 +1214,12 @@ func (c *Client) requestCertificateForCsr(authz []authorizationResource, bundle
 // checkCertResponse checks resp to see if a certificate is contained in the
 // response, and if so, loads it into certRes and returns true. If the cert
 // is not yet ready, it returns false. This function honors the waiting period
-// required by the Retry-After header of the response, if specified. This
+// required by the Retry-After header of the response, if specified, backing
+// off by attempt, the number of earlier checks, if Jitter is set. This
 // function may read from resp.Body but does NOT close it. The certRes input
 // should already have the Domain (common name) field populated. If bundle is
 // true, the certificate will be bundled with the issuer's cert.
-func (c *Client) checkCertResponse(resp *http.Response, certRes *CertificateResource, bundle bool) (bool, error) {
+func (c *Client) checkCertResponse(resp *http.Response, certRes *CertificateResource, bundle bool, attempt int) (bool, error) {
 	switch resp.StatusCode {
 	case 201, 202:
 		cert, err := ioutil.ReadAll(limitReader(resp.Body, maxBodySize))
@@ -701,13 +1234,31 @@ func (c *Client) checkCertResponse(resp *http.Response, certRes *CertificateReso
 			certRes.CertStableURL = resp.Header.Get("Content-Location")
 			certRes.AccountRef = c.user.GetRegistration().URI
 
+			// Some CAs serve the whole chain as PEM rather than the
+			// certificate as DER with an "up" link to its issuer.
+			if resp.Header.Get("Content-Type") == "application/pem-certificate-chain" {
+				leaf, issuers, err := splitPEMChain(cert)
+				if err != nil {
+					return false, err
+				}
+				certRes.Certificate = leaf
+				if bundle {
+					certRes.Certificate = cert
+				}
+				certRes.IssuerCertificate = issuers
+				logf("[INFO][%s] Server responded with a certificate chain.", certRes.Domain)
+				return true, nil
+			}
+
 			issuedCert := pemEncode(derCertificateBytes(cert))
 
-			// The issuer certificate link is always supplied via an "up" link
-			// in the response headers of a new certificate.
+			// The issuer certificate link is supplied via an "up" link in the
+			// response headers of a new certificate, except by some private CAs.
 			links := parseLinks(resp.Header["Link"])
-			issuerCert, err := c.getIssuerCertificate(links["up"])
-			if err != nil {
+			var issuerCert []byte
+			if links["up"] == "" {
+				logf("[WARNING][%s] acme: Server did not link the issuer certificate; not bundling it", certRes.Domain)
+			} else if issuerCert, err = c.getIssuerCertificate(links["up"]); err != nil {
 				// If we fail to acquire the issuer cert, return the issued certificate - do not fail.
 				logf("[WARNING][%s] acme: Could not bundle issuer certificate: %v", certRes.Domain, err)
 			} else {
@@ -728,14 +1279,13 @@ func (c *Client) checkCertResponse(resp *http.Response, certRes *CertificateReso
 
 		// The certificate was granted but is not yet issued.
 		// Check retry-after and loop.
-		ra := resp.Header.Get("Retry-After")
-		retryAfter, err := strconv.Atoi(ra)
-		if err != nil {
-			return false, err
+		wait, ok := parseRetryAfter(resp.Header.Get("Retry-After"), c.now())
+		if !ok {
+			wait = c.interval()
 		}
 
-		logf("[INFO][%s] acme: Server responded with status 202; retrying after %ds", certRes.Domain, retryAfter)
-		time.Sleep(time.Duration(retryAfter) * time.Second)
+		logf("[INFO][%s] acme: Server responded with status 202; retrying after %s", certRes.Domain, wait)
+		time.Sleep(backoff(wait, attempt))
 
 		return false, nil
 	default:
@@ -786,7 +1336,28 @@ func parseLinks(links []string) map[string]string {
 
 // validate makes the ACME server start validating a
 // challenge response, only returning once it is done.
-func validate(j *jws, domain, uri string, chlng challenge) error {
+func validate(ctx context.Context, j *jws, domain, uri string, chlng challenge) error {
+	return pollChallenge(ctx, j, domain, uri, chlng, defaultPollInterval, 0)
+}
+
+// validate is like the validate function, but polls as set with SetPolling.
+func (c *Client) validate(ctx context.Context, j *jws, domain, uri string, chlng challenge) error {
+	return pollChallenge(ctx, j, domain, uri, chlng, c.interval(), c.pollAttempts)
+}
+
+// interval returns the time between two polls set with SetPolling.
+func (c *Client) interval() time.Duration {
+	if c.pollInterval > 0 {
+		return c.pollInterval
+	}
+	return defaultPollInterval
+}
+
+// pollChallenge posts chlng to uri and then polls it every interval, unless
+// the server asks for a different Retry-After, until it is no longer pending.
+// If maxAttempts is positive, it gives up after that many polls. It returns
+// ctx.Err() as soon as ctx is done.
+func pollChallenge(ctx context.Context, j *jws, domain, uri string, chlng challenge, interval time.Duration, maxAttempts int) error {
 	var challengeResponse challenge
 
 	hdr, err := postJSON(j, uri, chlng, &challengeResponse)
@@ -796,7 +1367,7 @@ func validate(j *jws, domain, uri string, chlng challenge) error {
 
 	// After the path is sent, the ACME server will access our server.
 	// Repeatedly check the server for an updated status on our request.
-	for {
+	for attempts := 0; ; attempts++ {
 		switch challengeResponse.Status {
 		case "valid":
 			logf("[INFO][%s] The server validated our request", domain)
@@ -809,15 +1380,23 @@ func validate(j *jws, domain, uri string, chlng challenge) error {
 			return errors.New("The server returned an unexpected state.")
 		}
 
-		ra, err := strconv.Atoi(hdr.Get("Retry-After"))
-		if err != nil {
-			// The ACME server MUST return a Retry-After.
-			// If it doesn't, we'll just poll hard.
-			ra = 1
+		if maxAttempts > 0 && attempts >= maxAttempts {
+			return fmt.Errorf("acme: challenge for %s is still pending after %d polls", domain, attempts)
+		}
+
+		// The ACME server MUST return a Retry-After.
+		// If it doesn't, we'll just poll at the configured interval.
+		wait, ok := parseRetryAfter(hdr.Get("Retry-After"), j.now())
+		if !ok {
+			wait = interval
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff(wait, attempts)):
 		}
-		time.Sleep(time.Duration(ra) * time.Second)
 
-		hdr, err = getJSON(uri, &challengeResponse)
+		hdr, err = getJSON(uri, &challengeResponse, j.clock)
 		if err != nil {
 			return err
 		}
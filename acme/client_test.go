@@ -1,18 +1,43 @@
 package acme
 
 import (
+	"bytes"
+	"context"
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
+
+	"golang.org/x/crypto/ocsp"
+	"gopkg.in/square/go-jose.v1"
 )
 
+func TestMain(m *testing.M) {
+	// The tests use tiny RSA keys to stay fast.
+	MinRSAKeySize = 0
+	os.Exit(m.Run())
+}
+
 func TestNewClient(t *testing.T) {
 	keyBits := 32 // small value keeps test fast
 	keyType := RSA2048
@@ -47,7 +72,7 @@ func TestNewClient(t *testing.T) {
 		t.Errorf("Expected keyType to be %s but was %s", keyType, client.keyType)
 	}
 
-	if expected, actual := 2, len(client.solvers); actual != expected {
+	if expected, actual := 3, len(client.solvers); actual != expected {
 		t.Fatalf("Expected %d solver(s), got %d", expected, actual)
 	}
 }
@@ -106,6 +131,20 @@ func TestClientOptPort(t *testing.T) {
 		t.Errorf("Expected tls-sni-01 to have port %s but was %s", optHost, got)
 	}
 
+	alpnSolver, ok := client.solvers[TLSALPN01].(*tlsALPNChallenge)
+	if !ok {
+		t.Fatal("Expected tls-alpn-01 solver to be tlsALPNChallenge type")
+	}
+	if alpnSolver.jws != client.jws {
+		t.Error("Expected tls-alpn-01 to have same jws as client")
+	}
+	if got := alpnSolver.provider.(*TLSALPNProviderServer).port; got != optPort {
+		t.Errorf("Expected tls-alpn-01 to have port %s but was %s", optPort, got)
+	}
+	if got := alpnSolver.provider.(*TLSALPNProviderServer).iface; got != optHost {
+		t.Errorf("Expected tls-alpn-01 to have iface %s but was %s", optHost, got)
+	}
+
 	// test setting different host
 	optHost = "127.0.0.1"
 	client.SetHTTPAddress(net.JoinHostPort(optHost, optPort))
@@ -194,7 +233,7 @@ func TestValidate(t *testing.T) {
 
 	for _, tst := range tsts {
 		statuses = tst.statuses
-		if err := validate(j, "example.com", ts.URL, challenge{Type: "http-01", Token: "token"}); err == nil && tst.want != "" {
+		if err := validate(context.Background(), j, "example.com", ts.URL, challenge{Type: "http-01", Token: "token"}); err == nil && tst.want != "" {
 			t.Errorf("[%s] validate: got error %v, want something with %q", tst.name, err, tst.want)
 		} else if err != nil && !strings.Contains(err.Error(), tst.want) {
 			t.Errorf("[%s] validate: got error %v, want something with %q", tst.name, err, tst.want)
@@ -202,6 +241,458 @@ func TestValidate(t *testing.T) {
 	}
 }
 
+func TestValidateWithPolling(t *testing.T) {
+	var polls int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// No Retry-After, so the client polls at the configured interval.
+		w.Header().Add("Replay-Nonce", "12345")
+		status := "pending"
+		if r.Method == "GET" {
+			polls++
+			if polls == 3 {
+				status = "valid"
+			}
+		}
+		writeJSONResponse(w, &challenge{Type: "http-01", Status: status, URI: "http://example.com/", Token: "token"})
+	}))
+	defer ts.Close()
+
+	privKey, _ := rsa.GenerateKey(rand.Reader, 512)
+	j := &jws{privKey: privKey, directoryURL: ts.URL}
+
+	client := &Client{}
+	client.SetPolling(50*time.Millisecond, 5)
+
+	start := time.Now()
+	if err := client.validate(context.Background(), j, "example.com", ts.URL, challenge{Type: "http-01", Token: "token"}); err != nil {
+		t.Fatalf("validate error: got %v, want nil", err)
+	}
+	if polls != 3 {
+		t.Errorf("Expected 3 polls but got %d", polls)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond || elapsed > time.Second {
+		t.Errorf("Expected 3 polls 50ms apart, took %s", elapsed)
+	}
+
+	polls = 0
+	client.SetPolling(time.Millisecond, 2)
+	err := client.validate(context.Background(), j, "example.com", ts.URL, challenge{Type: "http-01", Token: "token"})
+	if err == nil || !strings.Contains(err.Error(), "still pending after 2 polls") {
+		t.Errorf("Expected validate to give up after 2 polls, got %v", err)
+	}
+}
+
+func TestValidateStopsWhenContextIsDone(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Replay-Nonce", "12345")
+		w.Header().Add("Retry-After", "60")
+		writeJSONResponse(w, &challenge{Type: "http-01", Status: "pending", URI: "http://example.com/", Token: "token"})
+	}))
+	defer ts.Close()
+
+	privKey, _ := rsa.GenerateKey(rand.Reader, 512)
+	j := &jws{privKey: privKey, directoryURL: ts.URL}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if err := validate(ctx, j, "example.com", ts.URL, challenge{Type: "http-01", Token: "token"}); err != context.DeadlineExceeded {
+		t.Errorf("Expected validate to return %v, got %v", context.DeadlineExceeded, err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected validate to give up at the deadline, took %s", elapsed)
+	}
+}
+
+func TestRequestCertificateWithPolling(t *testing.T) {
+	privKey, err := rsa.GenerateKey(rand.Reader, 512)
+	if err != nil {
+		t.Fatal("Could not generate test key:", err)
+	}
+	der, err := generateDerCert(privKey, time.Now().Add(time.Hour), "example.com", nil)
+	if err != nil {
+		t.Fatalf("Could not generate test certificate: %v", err)
+	}
+
+	var polls int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Replay-Nonce", "12345")
+		w.Header().Set("Location", "http://"+r.Host+"/cert")
+		switch r.Method {
+		case "HEAD":
+		case "POST":
+			w.WriteHeader(http.StatusAccepted)
+		case "GET":
+			polls++
+			if polls < 3 {
+				w.WriteHeader(http.StatusAccepted)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+			w.Write(der)
+		}
+	}))
+	defer ts.Close()
+
+	client := &Client{
+		jws:  &jws{privKey: privKey, directoryURL: ts.URL},
+		user: mockUser{email: "test@test.com", regres: new(RegistrationResource), privatekey: privKey},
+	}
+	client.SetPolling(10*time.Millisecond, 5)
+
+	authz := []authorizationResource{{Domain: "example.com", NewCertURL: ts.URL}}
+	cert, err := client.requestCertificate(authz, ObtainRequest{PrivateKey: privKey}, RSA2048)
+	if err != nil {
+		t.Fatalf("requestCertificate error: got %v, want nil", err)
+	}
+	if polls != 3 || len(cert.Certificate) == 0 {
+		t.Errorf("Expected a certificate after 3 polls, got %d polls", polls)
+	}
+
+	polls = 0
+	client.SetPolling(time.Millisecond, 2)
+	if _, err := client.requestCertificate(authz, ObtainRequest{PrivateKey: privKey}, RSA2048); err == nil {
+		t.Error("Expected requestCertificate to give up after 2 polls")
+	}
+}
+
+func TestNewClientKeySize(t *testing.T) {
+	defer func(bits int) { MinRSAKeySize = bits }(MinRSAKeySize)
+	MinRSAKeySize = 2048
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSONResponse(w, directory{NewAuthzURL: "http://test", NewCertURL: "http://test", NewRegURL: "http://test", RevokeCertURL: "http://test"})
+	}))
+	defer ts.Close()
+
+	for _, bits := range []int{1024, 2048} {
+		key, err := rsa.GenerateKey(rand.Reader, bits)
+		if err != nil {
+			t.Fatal("Could not generate test key:", err)
+		}
+
+		_, err = NewClient(ts.URL, mockUser{email: "test@test.com", privatekey: key}, RSA2048)
+		if bits < 2048 {
+			if sizeErr, ok := err.(KeySizeError); !ok || sizeErr.Bits != bits || sizeErr.MinBits != 2048 {
+				t.Errorf("Expected a KeySizeError for a %d bit key, got %v", bits, err)
+			}
+		} else if err != nil {
+			t.Errorf("Expected a %d bit key to be accepted, got %v", bits, err)
+		}
+	}
+}
+
+func TestRequestCertificateSubject(t *testing.T) {
+	privKey, err := rsa.GenerateKey(rand.Reader, 512)
+	if err != nil {
+		t.Fatal("Could not generate test key:", err)
+	}
+	der, err := generateDerCert(privKey, time.Now().Add(time.Hour), "example.com", nil)
+	if err != nil {
+		t.Fatalf("Could not generate test certificate: %v", err)
+	}
+
+	var csr *x509.CertificateRequest
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Replay-Nonce", "12345")
+		if r.Method != "POST" {
+			return
+		}
+		var msg csrMessage
+		if err := json.Unmarshal(jwsPayload(t, r), &msg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		csrDer, err := base64.URLEncoding.DecodeString(msg.Csr)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if csr, err = x509.ParseCertificateRequest(csrDer); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Location", "http://"+r.Host+"/cert")
+		w.WriteHeader(http.StatusCreated)
+		w.Write(der)
+	}))
+	defer ts.Close()
+
+	client := &Client{
+		jws:  &jws{privKey: privKey, directoryURL: ts.URL},
+		user: mockUser{email: "test@test.com", regres: new(RegistrationResource), privatekey: privKey},
+	}
+
+	authz := []authorizationResource{{Domain: "example.com", NewCertURL: ts.URL}, {Domain: "www.example.com", NewCertURL: ts.URL}}
+	request := ObtainRequest{
+		PrivateKey: privKey,
+		Subject: pkix.Name{
+			CommonName:         "ignored.example.org",
+			Organization:       []string{"Example Org"},
+			OrganizationalUnit: []string{"Ops"},
+			Country:            []string{"DE"},
+		},
+	}
+	if _, err := client.requestCertificate(authz, request, RSA2048); err != nil {
+		t.Fatalf("requestCertificate error: got %v, want nil", err)
+	}
+
+	if csr == nil {
+		t.Fatal("Expected the CSR to be sent to the CA")
+	}
+	if csr.Subject.CommonName != "example.com" {
+		t.Errorf("Expected CN example.com, got %q", csr.Subject.CommonName)
+	}
+	if !reflect.DeepEqual(csr.Subject.Organization, []string{"Example Org"}) {
+		t.Errorf("Expected O [Example Org], got %v", csr.Subject.Organization)
+	}
+	if !reflect.DeepEqual(csr.Subject.OrganizationalUnit, []string{"Ops"}) {
+		t.Errorf("Expected OU [Ops], got %v", csr.Subject.OrganizationalUnit)
+	}
+	if !reflect.DeepEqual(csr.Subject.Country, []string{"DE"}) {
+		t.Errorf("Expected C [DE], got %v", csr.Subject.Country)
+	}
+	if !reflect.DeepEqual(csr.DNSNames, []string{"www.example.com"}) {
+		t.Errorf("Expected SANs [www.example.com], got %v", csr.DNSNames)
+	}
+}
+
+// newDNSSolveClient returns a client that solves DNS-01 challenges with
+// provider, preCheck and validate, and a pending authorization with a single
+// DNS-01 challenge for each of domains. The token of a challenge is
+// "token-" followed by its domain.
+func newDNSSolveClient(t *testing.T, provider ChallengeProvider, preCheck PreCheckFunc, validate validateFunc, domains []string) (*Client, []authorizationResource) {
+	privKey, err := rsa.GenerateKey(rand.Reader, 512)
+	if err != nil {
+		t.Fatal("Could not generate test key:", err)
+	}
+
+	dnsSolver := &dnsChallenge{
+		jws:      &jws{privKey: privKey},
+		provider: provider,
+		preCheck: preCheck,
+		validate: validate,
+	}
+	client := &Client{jws: dnsSolver.jws, solvers: map[Challenge]solver{DNS01: dnsSolver}}
+
+	var authz []authorizationResource
+	for _, domain := range domains {
+		authz = append(authz, authorizationResource{
+			Domain: domain,
+			Body: authorization{
+				Challenges:   []challenge{{Type: DNS01, Token: "token-" + domain}},
+				Combinations: [][]int{{0}},
+			},
+		})
+	}
+	return client, authz
+}
+
+func TestSolveChallengesCleansUpAfterFailure(t *testing.T) {
+	validationErr := errors.New("urn:acme:error:unauthorized")
+	provider := &recordingProvider{cleanUpErr: errors.New("API unavailable"), timeout: time.Second}
+	client, authz := newDNSSolveClient(t, provider,
+		func(fqdn, value string) (bool, error) { return true, nil },
+		func(ctx context.Context, j *jws, domain, uri string, chlng challenge) error {
+			return validationErr
+		},
+		[]string{"example.com", "www.example.com"})
+
+	failures := client.solveChallenges(context.Background(), authz)
+	for _, domain := range []string{"example.com", "www.example.com"} {
+		if failures[domain] != validationErr {
+			t.Errorf("%s: expected the validation error, not masked by the cleanup error, but got %v", domain, failures[domain])
+		}
+	}
+	if !reflect.DeepEqual(provider.cleanUps, provider.present) || len(provider.cleanUps) != 2 {
+		t.Errorf("Expected every presented record to be cleaned up, presented %v but cleaned up %v", provider.present, provider.cleanUps)
+	}
+}
+
+func TestSolveChallengesChecksAllDNSRecords(t *testing.T) {
+	domains := []string{"example.com", "www.example.com", "mail.example.com"}
+	checked := make(map[string]string)
+	var validated []string
+	provider := &recordingProvider{timeout: time.Second}
+	client, authz := newDNSSolveClient(t, provider,
+		func(fqdn, value string) (bool, error) {
+			checked[fqdn] = value
+			return true, nil
+		},
+		func(ctx context.Context, j *jws, domain, uri string, chlng challenge) error {
+			if len(checked) != len(domains) {
+				t.Errorf("%s: validated after checking only %v", domain, checked)
+			}
+			validated = append(validated, domain)
+			return nil
+		},
+		domains)
+
+	if failures := client.solveChallenges(context.Background(), authz); len(failures) > 0 {
+		t.Fatalf("Expected no failures, got %v", failures)
+	}
+
+	for _, domain := range domains {
+		keyAuth, err := getKeyAuthorization("token-"+domain, client.jws.privKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fqdn, value, _ := DNS01Record(domain, keyAuth)
+		if checked[fqdn] != value {
+			t.Errorf("Expected %s to be checked for %q, got %q", fqdn, value, checked[fqdn])
+		}
+	}
+	if !reflect.DeepEqual(validated, domains) {
+		t.Errorf("Expected %v to be validated, got %v", domains, validated)
+	}
+	if !reflect.DeepEqual(provider.cleanUps, domains) {
+		t.Errorf("Expected %v to be cleaned up, got %v", domains, provider.cleanUps)
+	}
+}
+
+// newDNSAuthzServer returns a CA that hands out authorizations with a single
+// DNS-01 challenge. POSTs to the challenge are answered by challengeHandler.
+func newDNSAuthzServer(t *testing.T, challengeHandler http.HandlerFunc) *httptest.Server {
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Replay-Nonce", "12345")
+		switch {
+		case r.Method != "POST":
+			writeJSONResponse(w, directory{NewAuthzURL: ts.URL + "/new-authz", NewCertURL: ts.URL + "/new-cert", NewRegURL: ts.URL + "/new-reg", RevokeCertURL: ts.URL + "/revoke-cert"})
+		case r.URL.Path == "/new-authz":
+			var authz authorization
+			if err := json.Unmarshal(jwsPayload(t, r), &authz); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			authz.Status = "pending"
+			authz.Challenges = []challenge{{Type: DNS01, Token: "token", URI: ts.URL + "/challenge"}}
+			authz.Combinations = [][]int{{0}}
+			w.Header().Add("Link", fmt.Sprintf("<%s/new-cert>;rel=\"next\"", ts.URL))
+			w.Header().Set("Location", ts.URL+"/authz/"+authz.Identifier.Value)
+			w.WriteHeader(http.StatusCreated)
+			writeJSONResponse(w, authz)
+		case r.URL.Path == "/challenge":
+			challengeHandler(w, r)
+		default:
+			writeJSONResponse(w, authorization{})
+		}
+	}))
+	return ts
+}
+
+func TestObtainCertificateWithTimeout(t *testing.T) {
+	ts := newDNSAuthzServer(t, func(w http.ResponseWriter, r *http.Request) {
+		writeJSONResponse(w, authorization{})
+	})
+	defer ts.Close()
+
+	privKey, err := rsa.GenerateKey(rand.Reader, 512)
+	if err != nil {
+		t.Fatal("Could not generate test key:", err)
+	}
+	user := mockUser{email: "test@test.com", regres: &RegistrationResource{NewAuthzURL: ts.URL + "/new-authz"}, privatekey: privKey}
+	client, err := NewClient(ts.URL, user, RSA2048)
+	if err != nil {
+		t.Fatalf("Could not create client: %v", err)
+	}
+
+	provider := &recordingProvider{timeout: time.Minute}
+	if err := client.SetChallengeProvider(DNS01, provider); err != nil {
+		t.Fatal(err)
+	}
+	client.ExcludeChallenges([]Challenge{HTTP01, TLSSNI01, TLSALPN01})
+	client.SetDNSPreCheck(func(fqdn, value string) (bool, error) {
+		return false, errors.New("record not propagated")
+	})
+
+	start := time.Now()
+	_, failures := client.ObtainCertificateWithTimeout(ObtainRequest{Domains: []string{"example.com"}, PrivateKey: privKey}, 200*time.Millisecond)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected to give up at the deadline, took %s", elapsed)
+	}
+
+	if _, ok := failures["example.com"].(ObtainTimeoutError); !ok {
+		t.Errorf("Expected an ObtainTimeoutError, got %v", failures["example.com"])
+	}
+	if !reflect.DeepEqual(provider.cleanUps, []string{"example.com"}) {
+		t.Errorf("Expected the presented record to be cleaned up, presented %v but cleaned up %v", provider.present, provider.cleanUps)
+	}
+}
+
+// stallingProvider is a ChallengeProviderWithContext whose PresentContext
+// only returns once ctx is done.
+type stallingProvider struct {
+	contextProvider
+}
+
+func (p *stallingProvider) PresentContext(ctx context.Context, domain, token, keyAuth string) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestObtainCertificateWithTimeoutWrappedDeadline(t *testing.T) {
+	ts := newDNSAuthzServer(t, func(w http.ResponseWriter, r *http.Request) {
+		writeJSONResponse(w, authorization{})
+	})
+	defer ts.Close()
+
+	privKey, err := rsa.GenerateKey(rand.Reader, 512)
+	if err != nil {
+		t.Fatal("Could not generate test key:", err)
+	}
+	user := mockUser{email: "test@test.com", regres: &RegistrationResource{NewAuthzURL: ts.URL + "/new-authz"}, privatekey: privKey}
+	client, err := NewClient(ts.URL, user, RSA2048)
+	if err != nil {
+		t.Fatalf("Could not create client: %v", err)
+	}
+
+	if err := client.SetChallengeProvider(DNS01, &stallingProvider{}); err != nil {
+		t.Fatal(err)
+	}
+	client.ExcludeChallenges([]Challenge{HTTP01, TLSSNI01, TLSALPN01})
+
+	// The provider's error is wrapped in "Error presenting token: ...".
+	_, failures := client.ObtainCertificateWithTimeout(ObtainRequest{Domains: []string{"example.com"}, PrivateKey: privKey}, 100*time.Millisecond)
+	if _, ok := failures["example.com"].(ObtainTimeoutError); !ok {
+		t.Errorf("Expected an ObtainTimeoutError, got %v", failures["example.com"])
+	}
+}
+
+func TestObtainCertificateWithTimeoutKeepsValidationErrors(t *testing.T) {
+	// The CA only finds the challenge invalid after the deadline has passed.
+	ts := newDNSAuthzServer(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		writeJSONResponse(w, challenge{Type: DNS01, Status: "invalid", Error: RemoteError{StatusCode: http.StatusForbidden, Type: "urn:acme:error:unauthorized", Detail: "Incorrect TXT record"}})
+	})
+	defer ts.Close()
+
+	privKey, err := rsa.GenerateKey(rand.Reader, 512)
+	if err != nil {
+		t.Fatal("Could not generate test key:", err)
+	}
+	user := mockUser{email: "test@test.com", regres: &RegistrationResource{NewAuthzURL: ts.URL + "/new-authz"}, privatekey: privKey}
+	client, err := NewClient(ts.URL, user, RSA2048)
+	if err != nil {
+		t.Fatalf("Could not create client: %v", err)
+	}
+
+	if err := client.SetChallengeProvider(DNS01, &recordingProvider{timeout: time.Minute}); err != nil {
+		t.Fatal(err)
+	}
+	client.ExcludeChallenges([]Challenge{HTTP01, TLSSNI01, TLSALPN01})
+	client.SetDNSPreCheck(func(fqdn, value string) (bool, error) { return true, nil })
+
+	_, failures := client.ObtainCertificateWithTimeout(ObtainRequest{Domains: []string{"example.com"}, PrivateKey: privKey}, 100*time.Millisecond)
+	if _, ok := failures["example.com"].(ObtainTimeoutError); ok {
+		t.Fatal("Expected the validation error to be kept, got an ObtainTimeoutError")
+	}
+	if err := failures["example.com"]; err == nil || !strings.Contains(err.Error(), "Incorrect TXT record") {
+		t.Errorf("Expected the validation error, got %v", err)
+	}
+}
+
 func TestGetChallenges(t *testing.T) {
 	var ts *httptest.Server
 	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -233,12 +724,896 @@ func TestGetChallenges(t *testing.T) {
 		t.Fatalf("Could not create client: %v", err)
 	}
 
-	_, failures := client.getChallenges([]string{"example.com"})
+	_, failures := client.getChallenges(context.Background(), []string{"example.com"})
 	if failures["example.com"] == nil {
 		t.Fatal("Expecting \"Server did not provide next link to proceed\" error, got nil")
 	}
 }
 
+func TestObtainKeyType(t *testing.T) {
+	client, ts := newTestClient(t)
+	defer ts.Close()
+
+	cert, failures := client.Obtain(ObtainRequest{Domains: []string{"example.com"}, KeyType: EC384})
+	if len(failures) > 0 {
+		t.Fatalf("Expected Obtain to succeed but got %v", failures)
+	}
+
+	x509Cert, err := pemDecodeTox509(cert.Certificate)
+	if err != nil {
+		t.Fatalf("Could not parse the obtained certificate: %v", err)
+	}
+	pub, ok := x509Cert.PublicKey.(*ecdsa.PublicKey)
+	if x509Cert.PublicKeyAlgorithm != x509.ECDSA || !ok || pub.Curve != elliptic.P384() {
+		t.Errorf("Expected a P-384 ECDSA certificate but got public key algorithm %v", x509Cert.PublicKeyAlgorithm)
+	}
+
+	privKey, err := ParsePrivateKeyPEM(cert.PrivateKey)
+	if err != nil {
+		t.Fatalf("Could not parse the certificate private key: %v", err)
+	}
+	if keyType, _ := getKeyType(privKey); keyType != EC384 {
+		t.Errorf("Expected the certificate private key to be of KeyType %s but was %s", EC384, keyType)
+	}
+}
+
+func TestObtainInternationalizedDomain(t *testing.T) {
+	client, ts := newTestClient(t)
+	defer ts.Close()
+	client.keyType = EC256
+
+	cert, failures := client.Obtain(ObtainRequest{Domains: []string{"München.example", "www.münchen.example"}})
+	if len(failures) > 0 {
+		t.Fatalf("Expected Obtain to succeed but got %v", failures)
+	}
+	if cert.Domain != "xn--mnchen-3ya.example" {
+		t.Errorf("Expected the certificate domain xn--mnchen-3ya.example but got %s", cert.Domain)
+	}
+
+	x509Cert, err := pemDecodeTox509(cert.Certificate)
+	if err != nil {
+		t.Fatalf("Could not parse the obtained certificate: %v", err)
+	}
+	if x509Cert.Subject.CommonName != "xn--mnchen-3ya.example" {
+		t.Errorf("Expected the common name xn--mnchen-3ya.example but got %s", x509Cert.Subject.CommonName)
+	}
+	if !reflect.DeepEqual(x509Cert.DNSNames, []string{"www.xn--mnchen-3ya.example"}) {
+		t.Errorf("Expected the SAN www.xn--mnchen-3ya.example but got %v", x509Cert.DNSNames)
+	}
+}
+
+func TestOnCertificateObtained(t *testing.T) {
+	client, ts := newTestClient(t)
+	defer ts.Close()
+
+	var obtained []CertificateResource
+	client.OnCertificateObtained(func(cert CertificateResource) {
+		obtained = append(obtained, cert)
+	})
+
+	if _, failures := client.Obtain(ObtainRequest{Domains: []string{"example.com"}, KeyType: KeyType("1024")}); len(failures) == 0 {
+		t.Fatal("Expected Obtain with an invalid KeyType to fail")
+	}
+	if len(obtained) != 0 {
+		t.Fatalf("Expected no call for a failed Obtain, got %d", len(obtained))
+	}
+
+	cert, failures := client.Obtain(ObtainRequest{Domains: []string{"example.com"}})
+	if len(failures) > 0 {
+		t.Fatalf("Expected Obtain to succeed but got %v", failures)
+	}
+	renewed, err := client.RenewCertificate(cert, false, false)
+	if err != nil {
+		t.Fatalf("Expected RenewCertificate to succeed but got %v", err)
+	}
+
+	if len(obtained) != 2 {
+		t.Fatalf("Expected a call for Obtain and one for RenewCertificate, got %d", len(obtained))
+	}
+	if !reflect.DeepEqual(obtained[0], cert) {
+		t.Error("Expected the callback to receive the obtained certificate")
+	}
+	if !reflect.DeepEqual(obtained[1], renewed) {
+		t.Error("Expected the callback to receive the renewed certificate")
+	}
+}
+
+func TestObtainKeyTypeInvalid(t *testing.T) {
+	ecKey, err := generatePrivateKey(EC256)
+	if err != nil {
+		t.Fatal("Could not generate test key:", err)
+	}
+
+	tsts := []struct {
+		name    string
+		request ObtainRequest
+		want    string
+	}{
+		{"unknown", ObtainRequest{Domains: []string{"example.com"}, KeyType: KeyType("1024")}, "Invalid KeyType"},
+		{"mismatch", ObtainRequest{Domains: []string{"example.com"}, KeyType: RSA2048, PrivateKey: ecKey}, "not of KeyType 2048"},
+		{"signature algorithm", ObtainRequest{Domains: []string{"example.com"}, SignatureAlgorithm: x509.ECDSAWithSHA384}, "requires an EC key"},
+		{"signature algorithm for key", ObtainRequest{Domains: []string{"example.com"}, PrivateKey: ecKey, SignatureAlgorithm: x509.SHA256WithRSA}, "requires an RSA key"},
+	}
+
+	// The request must be rejected before any call to the server.
+	client := &Client{keyType: RSA2048}
+	for _, tst := range tsts {
+		_, failures := client.Obtain(tst.request)
+		if err := failures["example.com"]; err == nil || !strings.Contains(err.Error(), tst.want) {
+			t.Errorf("[%s] Obtain: got error %v, want something with %q", tst.name, err, tst.want)
+		}
+	}
+}
+
+func TestRegisterAgreeingToTOS(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 512)
+	if err != nil {
+		t.Fatal("Could not generate test key:", err)
+	}
+
+	var dirTOS, regTOS string
+	var registrations int
+	var agreements []string
+
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Replay-Nonce", "12345")
+		switch {
+		case r.Method != "POST":
+			dir := directory{NewAuthzURL: ts.URL, NewCertURL: ts.URL, NewRegURL: ts.URL + "/new-reg", RevokeCertURL: ts.URL}
+			dir.Meta.TermsOfService = dirTOS
+			writeJSONResponse(w, dir)
+		case r.URL.Path == "/new-reg":
+			registrations++
+			w.Header().Set("Location", ts.URL+"/reg/1")
+			w.Header().Add("Link", fmt.Sprintf("<%s/new-authz>;rel=\"next\"", ts.URL))
+			if regTOS != "" {
+				w.Header().Add("Link", fmt.Sprintf("<%s>;rel=\"terms-of-service\"", regTOS))
+			}
+			w.WriteHeader(http.StatusCreated)
+			writeJSONResponse(w, map[string]interface{}{"key": keyAsJWK(&key.PublicKey)})
+		case r.URL.Path == "/reg/1":
+			var reg struct {
+				Agreement string `json:"agreement"`
+			}
+			if err := json.Unmarshal(jwsPayload(t, r), &reg); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			agreements = append(agreements, reg.Agreement)
+			writeJSONResponse(w, map[string]interface{}{"key": keyAsJWK(&key.PublicKey), "agreement": reg.Agreement})
+		}
+	}))
+	defer ts.Close()
+
+	client, err := NewClient(ts.URL, mockUser{email: "test@test.com", privatekey: key}, RSA2048)
+	if err != nil {
+		t.Fatalf("Could not create client: %v", err)
+	}
+
+	tos1, tos2 := "https://ca.example.com/tos-v1.pdf", "https://ca.example.com/tos-v2.pdf"
+
+	dirTOS, regTOS = tos1, tos1
+	if _, err := client.RegisterAgreeingToTOS(tos1); err != nil {
+		t.Fatalf("Expected registration to succeed but got %v", err)
+	}
+	if !reflect.DeepEqual(agreements, []string{tos1}) {
+		t.Errorf("Expected to agree to %s, got %v", tos1, agreements)
+	}
+
+	registrations, agreements = 0, nil
+	dirTOS = tos2
+	_, err = client.RegisterAgreeingToTOS(tos1)
+	if err != (TOSChangedError{Accepted: tos1, Current: tos2}) {
+		t.Errorf("Expected a TOSChangedError from %s to %s, got %v", tos1, tos2, err)
+	}
+	if registrations != 0 || len(agreements) != 0 {
+		t.Errorf("Expected no registration after the directory announced new terms, got %d registrations and agreements %v", registrations, agreements)
+	}
+
+	dirTOS, regTOS = "", tos2
+	reg, err := client.RegisterAgreeingToTOS(tos1)
+	if err != (TOSChangedError{Accepted: tos1, Current: tos2}) {
+		t.Errorf("Expected a TOSChangedError from %s to %s, got %v", tos1, tos2, err)
+	}
+	if reg == nil || reg.TosURL != tos2 {
+		t.Errorf("Expected the registration along with the error, got %+v", reg)
+	}
+	if len(agreements) != 0 {
+		t.Errorf("Expected not to agree to changed terms, got %v", agreements)
+	}
+}
+
+func TestRegisterExternalAccountRequired(t *testing.T) {
+	var regs int
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Replay-Nonce", "12345")
+		if r.Method != "POST" {
+			dir := directory{NewAuthzURL: ts.URL, NewCertURL: ts.URL, NewRegURL: ts.URL + "/new-reg", RevokeCertURL: ts.URL}
+			dir.Meta.ExternalAccountRequired = true
+			writeJSONResponse(w, dir)
+			return
+		}
+
+		regs++
+		w.Header().Set("Location", ts.URL+"/reg/1")
+		w.Header().Add("Link", fmt.Sprintf("<%s/new-authz>;rel=\"next\"", ts.URL))
+		w.WriteHeader(http.StatusCreated)
+		writeJSONResponse(w, map[string]interface{}{})
+	}))
+	defer ts.Close()
+
+	key, err := rsa.GenerateKey(rand.Reader, 512)
+	if err != nil {
+		t.Fatal("Could not generate test key:", err)
+	}
+	client, err := NewClient(ts.URL, mockUser{email: "test@test.com", privatekey: key}, RSA2048)
+	if err != nil {
+		t.Fatalf("Could not create client: %v", err)
+	}
+
+	if _, err := client.Register(); err != ErrEABRequired {
+		t.Errorf("Register: expected %v but got %v", ErrEABRequired, err)
+	}
+	if _, err := client.RegisterAgreeingToTOS("https://ca.example.com/tos"); err != ErrEABRequired {
+		t.Errorf("RegisterAgreeingToTOS: expected %v but got %v", ErrEABRequired, err)
+	}
+	if regs != 0 {
+		t.Errorf("Expected no registration to be sent without EAB, got %d", regs)
+	}
+
+	hmacKey := base64.RawURLEncoding.EncodeToString([]byte("a secret shared with the CA"))
+	if _, err := client.RegisterAccountWithEAB("kid-1", hmacKey); err != nil {
+		t.Errorf("RegisterAccountWithEAB: expected registration to succeed but got %v", err)
+	}
+	if regs != 1 {
+		t.Errorf("Expected the registration with EAB to be sent, got %d registrations", regs)
+	}
+}
+
+func TestRegisterAccountWithEAB(t *testing.T) {
+	kid := "kid-1"
+	hmacKey := []byte("a secret shared with the CA")
+
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Replay-Nonce", "12345")
+		if r.Method != "POST" {
+			writeJSONResponse(w, directory{NewAuthzURL: ts.URL, NewCertURL: ts.URL, NewRegURL: ts.URL + "/new-reg", RevokeCertURL: ts.URL})
+			return
+		}
+
+		var regMsg registrationMessage
+		if err := json.Unmarshal(jwsPayload(t, r), &regMsg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := checkEAB(regMsg.ExternalAccountBinding, kid, ts.URL+"/new-reg", hmacKey); err != nil {
+			w.Header().Set("Content-Type", "application/problem+json")
+			w.WriteHeader(http.StatusForbidden)
+			writeJSONResponse(w, RemoteError{Type: "urn:acme:error:unauthorized", Detail: err.Error()})
+			return
+		}
+
+		w.Header().Set("Location", ts.URL+"/reg/1")
+		w.Header().Add("Link", fmt.Sprintf("<%s/new-authz>;rel=\"next\"", ts.URL))
+		w.WriteHeader(http.StatusCreated)
+		writeJSONResponse(w, map[string]interface{}{"contact": regMsg.Contact})
+	}))
+	defer ts.Close()
+
+	key, err := rsa.GenerateKey(rand.Reader, 512)
+	if err != nil {
+		t.Fatal("Could not generate test key:", err)
+	}
+	client, err := NewClient(ts.URL, mockUser{email: "test@test.com", privatekey: key}, RSA2048)
+	if err != nil {
+		t.Fatalf("Could not create client: %v", err)
+	}
+
+	encodedKey := base64.RawURLEncoding.EncodeToString(hmacKey)
+
+	reg, err := client.RegisterAccountWithEAB(kid, encodedKey)
+	if err != nil {
+		t.Fatalf("Expected registration to succeed but got %v", err)
+	}
+	if reg.URI != ts.URL+"/reg/1" {
+		t.Errorf("Expected registration URI %s but got %s", ts.URL+"/reg/1", reg.URI)
+	}
+
+	if _, err := client.Register(); err == nil || !strings.Contains(err.Error(), "missing external account binding") {
+		t.Errorf("Expected registration without EAB to be rejected but got %v", err)
+	}
+
+	_, err = client.RegisterAccountWithEAB("kid-2", encodedKey)
+	if remoteErr, ok := err.(RemoteError); !ok || remoteErr.StatusCode != http.StatusForbidden || remoteErr.Type != "urn:acme:error:unauthorized" {
+		t.Errorf("Expected registration with an unknown kid to be rejected with the CA's RemoteError but got %#v", err)
+	}
+
+	if _, err := client.RegisterAccountWithEAB(kid, "not+base64url"); err == nil || !strings.Contains(err.Error(), "could not decode the EAB HMAC key") {
+		t.Errorf("Expected an invalid HMAC key to be refused but got %v", err)
+	}
+}
+
+// checkEAB verifies an external account binding the way a CA would.
+func checkEAB(eab json.RawMessage, kid, url string, hmacKey []byte) error {
+	if len(eab) == 0 {
+		return errors.New("missing external account binding")
+	}
+
+	var sig struct {
+		Protected string `json:"protected"`
+		Payload   string `json:"payload"`
+		Signature string `json:"signature"`
+	}
+	if err := json.Unmarshal(eab, &sig); err != nil {
+		return err
+	}
+
+	protected, err := base64.RawURLEncoding.DecodeString(sig.Protected)
+	if err != nil {
+		return err
+	}
+	var header map[string]string
+	if err := json.Unmarshal(protected, &header); err != nil {
+		return err
+	}
+	if header["alg"] != "HS256" || header["kid"] != kid || header["url"] != url {
+		return fmt.Errorf("unexpected protected header %v", header)
+	}
+
+	mac := hmac.New(sha256.New, hmacKey)
+	mac.Write([]byte(sig.Protected + "." + sig.Payload))
+	if want := base64.RawURLEncoding.EncodeToString(mac.Sum(nil)); sig.Signature != want {
+		return errors.New("invalid external account binding signature")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(sig.Payload)
+	if err != nil {
+		return err
+	}
+	var jwk jose.JsonWebKey
+	if err := jwk.UnmarshalJSON(payload); err != nil || !jwk.Valid() {
+		return errors.New("external account binding payload is not a JWK")
+	}
+	return nil
+}
+
+func TestRenewWithOptions(t *testing.T) {
+	client, ts := newTestClient(t)
+	defer ts.Close()
+
+	caKey, caCert, leafKey := newTestCA(t)
+
+	tsts := []struct {
+		name    string
+		expires time.Duration
+		renewed bool
+	}{
+		{"inside-window", 10 * 24 * time.Hour, true},
+		{"outside-window", 60 * 24 * time.Hour, false},
+	}
+
+	for _, tst := range tsts {
+		leaf := newTestLeaf(t, caKey, caCert, leafKey, time.Now().Add(tst.expires), nil)
+		cert := CertificateResource{
+			Domain:      "example.com",
+			CertURL:     "http://example.com/old-cert",
+			Certificate: pemEncode(derCertificateBytes(leaf.Raw)),
+		}
+
+		newCert, err := client.RenewWithOptions(cert, RenewOptions{DaysRemaining: 30})
+		if err != nil {
+			t.Errorf("[%s] RenewWithOptions: got error %v, want nil", tst.name, err)
+			continue
+		}
+		if renewed := newCert.CertURL != cert.CertURL; renewed != tst.renewed {
+			t.Errorf("[%s] RenewWithOptions: got renewed %t, want %t", tst.name, renewed, tst.renewed)
+		}
+		if !tst.renewed && !bytes.Equal(newCert.Certificate, cert.Certificate) {
+			t.Errorf("[%s] RenewWithOptions: expected the certificate to be returned unchanged", tst.name)
+		}
+	}
+}
+
+func TestRenewWithOptionsSameKey(t *testing.T) {
+	client, ts := newTestClient(t)
+	defer ts.Close()
+
+	caKey, caCert, leafKey := newTestCA(t)
+	leaf := newTestLeaf(t, caKey, caCert, leafKey, time.Now().Add(time.Hour), nil)
+	cert := CertificateResource{
+		Domain:      "example.com",
+		Certificate: pemEncode(derCertificateBytes(leaf.Raw)),
+		PrivateKey:  pemEncode(leafKey),
+	}
+	opts := RenewOptions{DaysRemaining: 30, MustRenewWithSameKey: true}
+
+	newCert, err := client.RenewWithOptions(cert, opts)
+	if err != nil {
+		t.Fatalf("RenewWithOptions: got error %v, want nil", err)
+	}
+	newLeaf, err := newCert.Leaf()
+	if err != nil {
+		t.Fatalf("Could not parse the renewed certificate: %v", err)
+	}
+	if !publicKeysEqual(newLeaf.PublicKey, leaf.PublicKey) {
+		t.Error("Expected the renewed certificate to keep the public key")
+	}
+	if !bytes.Equal(newCert.PrivateKey, cert.PrivateKey) {
+		t.Error("Expected the renewed certificate to keep the private key")
+	}
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal("Could not generate test key:", err)
+	}
+	csr, err := generateCsr(otherKey, pkix.Name{CommonName: "example.com"}, nil, false, 0)
+	if err != nil {
+		t.Fatal("Could not generate CSR:", err)
+	}
+
+	tsts := []struct {
+		name string
+		cert CertificateResource
+	}{
+		{"no private key", CertificateResource{Domain: "example.com", Certificate: cert.Certificate}},
+		{"other private key", CertificateResource{Domain: "example.com", Certificate: cert.Certificate, PrivateKey: pemEncode(otherKey)}},
+		{"CSR for another key", CertificateResource{Domain: "example.com", Certificate: cert.Certificate, CSR: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr})}},
+	}
+	for _, tst := range tsts {
+		if _, err := client.RenewWithOptions(tst.cert, opts); err == nil {
+			t.Errorf("[%s] RenewWithOptions: expected an error", tst.name)
+		}
+	}
+}
+
+type fakeClock time.Time
+
+func (c fakeClock) Now() time.Time {
+	return time.Time(c)
+}
+
+func TestRenewWithOptionsClock(t *testing.T) {
+	client, ts := newTestClient(t)
+	defer ts.Close()
+
+	caKey, caCert, leafKey := newTestCA(t)
+	notAfter := time.Now().Add(90 * 24 * time.Hour)
+	leaf := newTestLeaf(t, caKey, caCert, leafKey, notAfter, nil)
+	cert := CertificateResource{
+		Domain:      "example.com",
+		CertURL:     "http://example.com/old-cert",
+		Certificate: pemEncode(derCertificateBytes(leaf.Raw)),
+	}
+
+	tsts := []struct {
+		name    string
+		now     time.Time
+		renewed bool
+	}{
+		{"60 days left", notAfter.Add(-60 * 24 * time.Hour), false},
+		{"30 days and a minute left", notAfter.Add(-30*24*time.Hour - time.Minute), false},
+		{"29 days left", notAfter.Add(-29 * 24 * time.Hour), true},
+		{"expired", notAfter.Add(time.Hour), true},
+	}
+
+	for _, tst := range tsts {
+		client.SetClock(fakeClock(tst.now))
+
+		newCert, err := client.RenewWithOptions(cert, RenewOptions{DaysRemaining: 30})
+		if err != nil {
+			t.Errorf("[%s] RenewWithOptions: got error %v, want nil", tst.name, err)
+			continue
+		}
+		if renewed := newCert.CertURL != cert.CertURL; renewed != tst.renewed {
+			t.Errorf("[%s] RenewWithOptions: got renewed %t, want %t", tst.name, renewed, tst.renewed)
+		}
+	}
+}
+
+func TestSetClock(t *testing.T) {
+	now := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	client := &Client{jws: &jws{}}
+	client.SetClock(fakeClock(now))
+	defer client.SetClock(nil)
+
+	// A Retry-After date is measured from the client's clock.
+	client.jws.recordRateLimit("https://ca.example.com/acme/new-cert", &http.Response{
+		StatusCode: http.StatusTooManyRequests,
+		Header:     http.Header{"Retry-After": []string{now.Add(time.Minute).Format(http.TimeFormat)}},
+	})
+	if rateLimit, ok := client.LastRateLimit(); !ok || !rateLimit.Reset.Equal(now.Add(time.Minute)) {
+		t.Errorf("Expected the rate limit to reset at %s, got %+v", now.Add(time.Minute), rateLimit)
+	}
+
+	// Cached zones expire by the client's clock.
+	ClearFqdnCache()
+	defer ClearFqdnCache()
+	cacheZone("_acme-challenge.example.com.", "example.com.")
+	if _, ok := cachedZone("_acme-challenge.example.com."); !ok {
+		t.Fatal("Expected the zone to be cached")
+	}
+	client.SetClock(fakeClock(now.Add(zoneCacheTTL + time.Second)))
+	if _, ok := cachedZone("_acme-challenge.example.com."); ok {
+		t.Error("Expected the cached zone to expire by the client's clock")
+	}
+}
+
+func TestRevokeCertificateWithReason(t *testing.T) {
+	var got []revokeCertMessage
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Replay-Nonce", "12345")
+		if r.Method != "POST" {
+			writeJSONResponse(w, directory{NewAuthzURL: ts.URL, NewCertURL: ts.URL, NewRegURL: ts.URL, RevokeCertURL: ts.URL + "/revoke-cert"})
+			return
+		}
+
+		var msg revokeCertMessage
+		if err := json.Unmarshal(jwsPayload(t, r), &msg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		got = append(got, msg)
+	}))
+	defer ts.Close()
+
+	key, err := rsa.GenerateKey(rand.Reader, 512)
+	if err != nil {
+		t.Fatal("Could not generate test key:", err)
+	}
+	client, err := NewClient(ts.URL, mockUser{email: "test@test.com", privatekey: key}, RSA2048)
+	if err != nil {
+		t.Fatalf("Could not create client: %v", err)
+	}
+
+	caKey, caCert, leafKey := newTestCA(t)
+	leaf := newTestLeaf(t, caKey, caCert, leafKey, time.Now().Add(time.Hour), nil)
+	cert := pemEncode(derCertificateBytes(leaf.Raw))
+
+	if err := client.RevokeCertificateWithReason(cert, ocsp.KeyCompromise); err != nil {
+		t.Fatalf("Expected revocation to succeed but got %v", err)
+	}
+	if err := client.RevokeCertificate(cert); err != nil {
+		t.Fatalf("Expected revocation to succeed but got %v", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("Expected 2 revocation requests but the CA received %d", len(got))
+	}
+	if got[0].Reason != ocsp.KeyCompromise {
+		t.Errorf("Expected reason %d in the request but got %d", ocsp.KeyCompromise, got[0].Reason)
+	}
+	if got[1].Reason != ocsp.Unspecified {
+		t.Errorf("Expected reason %d in the request but got %d", ocsp.Unspecified, got[1].Reason)
+	}
+
+	for _, reason := range []int{-1, 7, 11} {
+		if err := client.RevokeCertificateWithReason(cert, reason); err == nil {
+			t.Errorf("Expected reason %d to be refused", reason)
+		}
+	}
+	if len(got) != 2 {
+		t.Errorf("Expected refused revocations not to reach the CA")
+	}
+}
+
+func TestObtainCertificateForCSR(t *testing.T) {
+	client, ts := newTestClient(t)
+	defer ts.Close()
+
+	certKey, err := generatePrivateKey(EC256)
+	if err != nil {
+		t.Fatal("Could not generate certificate key:", err)
+	}
+	domains := []string{"example.com", "www.example.com", "mail.example.com"}
+	csrBytes, err := generateCsr(certKey, pkix.Name{CommonName: domains[0]}, domains[1:], false, x509.UnknownSignatureAlgorithm)
+	if err != nil {
+		t.Fatal("Could not generate CSR:", err)
+	}
+	csr, err := x509.ParseCertificateRequest(csrBytes)
+	if err != nil {
+		t.Fatal("Could not parse CSR:", err)
+	}
+
+	cert, failures := client.ObtainCertificateForCSR(*csr, false)
+	if len(failures) > 0 {
+		t.Fatalf("Expected ObtainCertificateForCSR to succeed but got %v", failures)
+	}
+	if cert.PrivateKey != nil {
+		t.Error("Expected no private key in the certificate resource")
+	}
+
+	x509Cert, err := pemDecodeTox509(cert.Certificate)
+	if err != nil {
+		t.Fatalf("Could not parse the obtained certificate: %v", err)
+	}
+	names := append([]string{x509Cert.Subject.CommonName}, x509Cert.DNSNames...)
+	if !reflect.DeepEqual(names, domains) {
+		t.Errorf("Expected the certificate names to be %v but got %v", domains, names)
+	}
+}
+
+func TestObtainCertificateForCSRWithoutNames(t *testing.T) {
+	certKey, err := generatePrivateKey(EC256)
+	if err != nil {
+		t.Fatal("Could not generate certificate key:", err)
+	}
+	csrBytes, err := generateCsr(certKey, pkix.Name{CommonName: ""}, nil, false, x509.UnknownSignatureAlgorithm)
+	if err != nil {
+		t.Fatal("Could not generate CSR:", err)
+	}
+	csr, err := x509.ParseCertificateRequest(csrBytes)
+	if err != nil {
+		t.Fatal("Could not parse CSR:", err)
+	}
+
+	// The CSR must be rejected before any call to the server.
+	client := &Client{}
+	if _, failures := client.ObtainCertificateForCSR(*csr, false); failures[""] == nil {
+		t.Errorf("Expected a CSR without names to be rejected but got %v", failures)
+	}
+}
+
+func TestRolloverAccountKey(t *testing.T) {
+	oldKey, err := rsa.GenerateKey(rand.Reader, 512)
+	if err != nil {
+		t.Fatal("Could not generate test key:", err)
+	}
+	newKey, err := generatePrivateKey(EC256)
+	if err != nil {
+		t.Fatal("Could not generate test key:", err)
+	}
+
+	var reject bool
+	var oldPub, newPub crypto.PublicKey = &oldKey.PublicKey, newKey.(crypto.Signer).Public()
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Replay-Nonce", "12345")
+		if r.Method != "POST" {
+			writeJSONResponse(w, directory{NewAuthzURL: ts.URL, NewCertURL: ts.URL, NewRegURL: ts.URL, RevokeCertURL: ts.URL, KeyChangeURL: ts.URL + "/key-change"})
+			return
+		}
+		if reject {
+			w.Header().Set("Content-Type", "application/problem+json")
+			w.WriteHeader(http.StatusConflict)
+			writeJSONResponse(w, RemoteError{Type: "urn:acme:error:malformed", Detail: "new key is already in use"})
+			return
+		}
+
+		if err := checkKeyChange(r, ts.URL+"/key-change", ts.URL+"/reg/1", oldPub, newPub); err != nil {
+			t.Errorf("Invalid key-change request: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	}))
+	defer ts.Close()
+
+	user := mockUser{
+		email:      "test@test.com",
+		regres:     &RegistrationResource{URI: ts.URL + "/reg/1"},
+		privatekey: oldKey,
+	}
+	client, err := NewClient(ts.URL, user, RSA2048)
+	if err != nil {
+		t.Fatalf("Could not create client: %v", err)
+	}
+
+	reject = true
+	if err := client.RolloverAccountKey(newKey); err == nil {
+		t.Error("Expected a rejected rollover to return an error")
+	}
+	if client.jws.privKey != oldKey {
+		t.Error("Expected the client to keep the old key after a rejected rollover")
+	}
+
+	reject = false
+	if err := client.RolloverAccountKey(newKey); err != nil {
+		t.Fatalf("Expected rollover to succeed but got %v", err)
+	}
+	if client.jws.privKey != newKey {
+		t.Error("Expected the client to use the new key after rollover")
+	}
+
+	for _, keyType := range []KeyType{RSA2048, EC384} {
+		key, err := generatePrivateKey(keyType)
+		if err != nil {
+			t.Fatal("Could not generate test key:", err)
+		}
+		oldPub, newPub = newPub, key.(crypto.Signer).Public()
+		if err := client.RolloverAccountKey(key); err != nil {
+			t.Fatalf("%s: expected rollover to succeed but got %v", keyType, err)
+		}
+	}
+}
+
+// checkKeyChange verifies the nested JWS of a key-change request to url the
+// way a CA would.
+func checkKeyChange(r *http.Request, url, account string, oldPub, newPub crypto.PublicKey) error {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	outer, err := jose.ParseSigned(string(body))
+	if err != nil {
+		return err
+	}
+	innerBytes, err := outer.Verify(oldPub)
+	if err != nil {
+		return fmt.Errorf("outer JWS not signed by the old key: %v", err)
+	}
+
+	inner, err := jose.ParseSigned(string(innerBytes))
+	if err != nil {
+		return err
+	}
+	if jwk := inner.Signatures[0].Header.JsonWebKey; jwk == nil || !reflect.DeepEqual(jwk.Key, newPub) {
+		return errors.New("inner JWS does not embed the new key")
+	}
+	payload, err := inner.Verify(newPub)
+	if err != nil {
+		return fmt.Errorf("inner JWS not signed by the new key: %v", err)
+	}
+
+	var flat struct {
+		Protected string `json:"protected"`
+	}
+	if err := json.Unmarshal(innerBytes, &flat); err != nil {
+		return err
+	}
+	protected, err := base64.RawURLEncoding.DecodeString(flat.Protected)
+	if err != nil {
+		return err
+	}
+	var header struct {
+		URL   string `json:"url"`
+		Nonce string `json:"nonce"`
+	}
+	if err := json.Unmarshal(protected, &header); err != nil {
+		return err
+	}
+	if header.URL != url {
+		return fmt.Errorf("inner JWS url is %q, want %q", header.URL, url)
+	}
+	if header.Nonce != "" {
+		return errors.New("inner JWS must not have a nonce")
+	}
+
+	var msg keyChangeMessage
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		return err
+	}
+	if msg.Account != account {
+		return fmt.Errorf("account is %q, want %q", msg.Account, account)
+	}
+	if msg.OldKey == nil || !reflect.DeepEqual(msg.OldKey.Key, oldPub) {
+		return errors.New("oldKey does not match the old account key")
+	}
+	return nil
+}
+
+func TestLogfCustomLogger(t *testing.T) {
+	defer func(l StdLogger) { Logger = l }(Logger)
+
+	logger := &recordingLogger{}
+	Logger = logger
+	logf("[INFO][%s] acme: %s", "example.com", "hello")
+
+	if len(logger.lines) != 1 || logger.lines[0] != "[INFO][example.com] acme: hello" {
+		t.Errorf("Expected the custom logger to receive the entry, got %q", logger.lines)
+	}
+}
+
+type recordingLogger struct {
+	lines []string
+}
+
+func (l *recordingLogger) Printf(format string, args ...interface{}) {
+	l.lines = append(l.lines, fmt.Sprintf(format, args...))
+}
+
+// newTestClient returns a client registered with a fresh account at a
+// newIssuingServer, which the caller must close.
+func newTestClient(t *testing.T) (*Client, *httptest.Server) {
+	ts := newIssuingServer(t)
+
+	key, err := rsa.GenerateKey(rand.Reader, 512)
+	if err != nil {
+		t.Fatal("Could not generate test key:", err)
+	}
+	user := mockUser{
+		email:      "test@test.com",
+		regres:     &RegistrationResource{NewAuthzURL: ts.URL + "/new-authz"},
+		privatekey: key,
+	}
+
+	client, err := NewClient(ts.URL, user, RSA2048)
+	if err != nil {
+		ts.Close()
+		t.Fatalf("Could not create client: %v", err)
+	}
+	return client, ts
+}
+
+// newIssuingServer starts a stub ACME server which hands out already
+// valid authorizations and signs every CSR it receives.
+func newIssuingServer(t *testing.T) *httptest.Server {
+	caKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal("Could not generate CA key:", err)
+	}
+
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Replay-Nonce", "12345")
+		switch {
+		case r.Method != "POST":
+			writeJSONResponse(w, directory{NewAuthzURL: ts.URL + "/new-authz", NewCertURL: ts.URL + "/new-cert", NewRegURL: ts.URL + "/new-reg", RevokeCertURL: ts.URL + "/revoke-cert"})
+		case r.URL.Path == "/new-authz":
+			var authz authorization
+			if err := json.Unmarshal(jwsPayload(t, r), &authz); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			authz.Status = "valid"
+			w.Header().Add("Link", fmt.Sprintf("<%s/new-cert>;rel=\"next\"", ts.URL))
+			w.Header().Set("Location", ts.URL+"/authz/"+authz.Identifier.Value)
+			w.WriteHeader(http.StatusCreated)
+			writeJSONResponse(w, authz)
+		case r.URL.Path == "/new-cert":
+			var msg csrMessage
+			if err := json.Unmarshal(jwsPayload(t, r), &msg); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			der, err := base64.URLEncoding.DecodeString(msg.Csr)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			csr, err := x509.ParseCertificateRequest(der)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			template := &x509.Certificate{
+				SerialNumber: big.NewInt(1),
+				Subject:      csr.Subject,
+				DNSNames:     csr.DNSNames,
+				NotBefore:    time.Now(),
+				NotAfter:     time.Now().Add(time.Hour),
+			}
+			cert, err := x509.CreateCertificate(rand.Reader, template, template, csr.PublicKey, caKey)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Location", ts.URL+"/cert/1")
+			w.WriteHeader(http.StatusCreated)
+			w.Write(cert)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	return ts
+}
+
+// jwsPayload returns the unverified payload of the JWS posted in r.
+func jwsPayload(t *testing.T, r *http.Request) []byte {
+	var body struct {
+		Payload string `json:"payload"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		t.Errorf("Could not decode JWS: %v", err)
+		return nil
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(body.Payload)
+	if err != nil {
+		t.Errorf("Could not decode JWS payload: %v", err)
+	}
+	return payload
+}
+
 // writeJSONResponse marshals the body as JSON and writes it to the response.
 func writeJSONResponse(w http.ResponseWriter, body interface{}) {
 	bs, err := json.Marshal(body)
@@ -254,7 +1629,7 @@ func writeJSONResponse(w http.ResponseWriter, body interface{}) {
 }
 
 // stubValidate is like validate, except it does nothing.
-func stubValidate(j *jws, domain, uri string, chlng challenge) error {
+func stubValidate(ctx context.Context, j *jws, domain, uri string, chlng challenge) error {
 	return nil
 }
 
@@ -55,12 +55,38 @@ var (
 	ocspMustStapleFeature  = []byte{0x30, 0x03, 0x02, 0x01, 0x05}
 )
 
+// MinRSAKeySize is the smallest RSA key, in bits, accepted for accounts and
+// certificates. Set it to 0 to accept RSA keys of any size.
+var MinRSAKeySize = 2048
+
+// KeySizeError is returned for an RSA key smaller than MinRSAKeySize.
+type KeySizeError struct {
+	Bits    int
+	MinBits int
+}
+
+func (e KeySizeError) Error() string {
+	return fmt.Sprintf("acme: RSA key of %d bits is smaller than the minimum of %d bits", e.Bits, e.MinBits)
+}
+
+// ErrNoOCSPServer is returned by GetOCSPForCert if the certificate does
+// not name an OCSP responder in its AuthorityInfoAccess extension.
+var ErrNoOCSPServer = errors.New("no OCSP server specified in cert")
+
+// ErrNoIssuerCertificate is returned by GetOCSPForCert if the bundle only
+// contains the issued certificate and the certificate does not name a URL
+// for its issuer in its AuthorityInfoAccess extension either. Without the
+// issuer there is no way to ask for the OCSP status of the certificate.
+var ErrNoIssuerCertificate = errors.New("no issuer certificate in bundle and no issuing certificate URL specified in cert")
+
 // GetOCSPForCert takes a PEM encoded cert or cert bundle returning the raw OCSP response,
 // the parsed response, and an error, if any. The returned []byte can be passed directly
 // into the OCSPStaple property of a tls.Certificate. If the bundle only contains the
 // issued certificate, this function will try to get the issuer certificate from the
 // IssuingCertificateURL in the certificate. If the []byte and/or ocsp.Response return
-// values are nil, the OCSP status may be assumed OCSPUnknown.
+// values are nil, the OCSP status may be assumed OCSPUnknown. Certificates of CAs
+// without OCSP, e.g. private CAs issuing certificates without an AuthorityInfoAccess
+// extension, make it return ErrNoOCSPServer or ErrNoIssuerCertificate.
 func GetOCSPForCert(bundle []byte) ([]byte, *ocsp.Response, error) {
 	certificates, err := parsePEMBundle(bundle)
 	if err != nil {
@@ -74,12 +100,12 @@ func GetOCSPForCert(bundle []byte) ([]byte, *ocsp.Response, error) {
 	// we have only one certificate so far, we need to get the issuer cert.
 	issuedCert := certificates[0]
 	if len(issuedCert.OCSPServer) == 0 {
-		return nil, nil, errors.New("no OCSP server specified in cert")
+		return nil, nil, ErrNoOCSPServer
 	}
 	if len(certificates) == 1 {
 		// TODO: build fallback. If this fails, check the remaining array entries.
 		if len(issuedCert.IssuingCertificateURL) == 0 {
-			return nil, nil, errors.New("no issuing certificate URL")
+			return nil, nil, ErrNoIssuerCertificate
 		}
 
 		resp, err := httpGet(issuedCert.IssuingCertificateURL[0])
@@ -118,6 +144,10 @@ func GetOCSPForCert(bundle []byte) ([]byte, *ocsp.Response, error) {
 	defer req.Body.Close()
 
 	ocspResBytes, err := ioutil.ReadAll(limitReader(req.Body, 1024*1024))
+	if err != nil {
+		return nil, nil, err
+	}
+
 	ocspRes, err := ocsp.ParseResponse(ocspResBytes, issuerCert)
 	if err != nil {
 		return nil, nil, err
@@ -183,17 +213,135 @@ func parsePEMBundle(bundle []byte) ([]*x509.Certificate, error) {
 	return certificates, nil
 }
 
-func parsePEMPrivateKey(key []byte) (crypto.PrivateKey, error) {
+// ParsePrivateKeyPEM parses a PEM encoded RSA or EC private key, e.g. an
+// account key passed in through the environment. It accepts PKCS#1 RSA keys,
+// SEC 1 EC keys and PKCS#8 keys of either type. Encrypted keys are not
+// supported.
+func ParsePrivateKeyPEM(key []byte) (crypto.PrivateKey, error) {
 	keyBlock, _ := pem.Decode(key)
+	if keyBlock == nil {
+		return nil, errors.New("No PEM encoded private key found")
+	}
+	if x509.IsEncryptedPEMBlock(keyBlock) || keyBlock.Type == "ENCRYPTED PRIVATE KEY" {
+		return nil, errors.New("Encrypted private keys are not supported")
+	}
 
 	switch keyBlock.Type {
 	case "RSA PRIVATE KEY":
 		return x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
 	case "EC PRIVATE KEY":
 		return x509.ParseECPrivateKey(keyBlock.Bytes)
+	case "PRIVATE KEY":
+		privKey, err := x509.ParsePKCS8PrivateKey(keyBlock.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		switch privKey.(type) {
+		case *rsa.PrivateKey, *ecdsa.PrivateKey:
+			return privKey, nil
+		}
+		return nil, fmt.Errorf("Unsupported PKCS#8 private key type %T", privKey)
 	default:
-		return nil, errors.New("Unknown PEM header value")
+		return nil, fmt.Errorf("Unknown PEM header value %q", keyBlock.Type)
+	}
+}
+
+// publicKeyMatches reports whether privKey is the private key of cert.
+func publicKeyMatches(cert *x509.Certificate, privKey crypto.PrivateKey) bool {
+	signer, ok := privKey.(crypto.Signer)
+	if !ok {
+		return false
+	}
+	return publicKeysEqual(cert.PublicKey, signer.Public())
+}
+
+// publicKeysEqual reports whether a and b are the same public key.
+func publicKeysEqual(a, b crypto.PublicKey) bool {
+	aBytes, err := x509.MarshalPKIXPublicKey(a)
+	if err != nil {
+		return false
+	}
+	bBytes, err := x509.MarshalPKIXPublicKey(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(aBytes, bBytes)
+}
+
+func isValidKeyType(keyType KeyType) bool {
+	switch keyType {
+	case EC256, EC384, RSA2048, RSA4096, RSA8192:
+		return true
+	}
+	return false
+}
+
+// getKeyType returns the KeyType describing privateKey.
+func getKeyType(privateKey crypto.PrivateKey) (KeyType, error) {
+	switch key := privateKey.(type) {
+	case *ecdsa.PrivateKey:
+		switch key.Curve {
+		case elliptic.P256():
+			return EC256, nil
+		case elliptic.P384():
+			return EC384, nil
+		}
+	case *rsa.PrivateKey:
+		switch key.N.BitLen() {
+		case 2048:
+			return RSA2048, nil
+		case 4096:
+			return RSA4096, nil
+		case 8192:
+			return RSA8192, nil
+		}
 	}
+
+	return "", errors.New("Unknown private key type")
+}
+
+// checkKeySize returns a KeySizeError if privateKey is an RSA key smaller than
+// MinRSAKeySize. EC keys on curves smaller than P-256 are accepted with a warning.
+func checkKeySize(privateKey crypto.PrivateKey) error {
+	switch key := privateKey.(type) {
+	case *rsa.PrivateKey:
+		if bits := key.N.BitLen(); bits < MinRSAKeySize {
+			return KeySizeError{Bits: bits, MinBits: MinRSAKeySize}
+		}
+	case *ecdsa.PrivateKey:
+		if size := key.Curve.Params().BitSize; size < 256 {
+			logf("[WARNING] acme: EC key on curve %s is weaker than P-256", key.Curve.Params().Name)
+		}
+	}
+	return nil
+}
+
+// checkSignatureAlgorithm returns an error if a CSR cannot be signed with sigAlg
+// by privateKey or, if that is nil, by a key of keyType. The zero value of sigAlg
+// lets crypto/x509 choose and is always accepted.
+func checkSignatureAlgorithm(sigAlg x509.SignatureAlgorithm, privateKey crypto.PrivateKey, keyType KeyType) error {
+	if sigAlg == x509.UnknownSignatureAlgorithm {
+		return nil
+	}
+
+	isEC := keyType == EC256 || keyType == EC384
+	if privateKey != nil {
+		_, isEC = privateKey.(*ecdsa.PrivateKey)
+	}
+
+	switch sigAlg {
+	case x509.ECDSAWithSHA256, x509.ECDSAWithSHA384, x509.ECDSAWithSHA512:
+		if isEC {
+			return nil
+		}
+		return fmt.Errorf("Signature algorithm %v requires an EC key", sigAlg)
+	case x509.SHA256WithRSA, x509.SHA384WithRSA, x509.SHA512WithRSA:
+		if !isEC {
+			return nil
+		}
+		return fmt.Errorf("Signature algorithm %v requires an RSA key", sigAlg)
+	}
+	return fmt.Errorf("Unsupported signature algorithm %v", sigAlg)
 }
 
 func generatePrivateKey(keyType KeyType) (crypto.PrivateKey, error) {
@@ -214,11 +362,10 @@ func generatePrivateKey(keyType KeyType) (crypto.PrivateKey, error) {
 	return nil, fmt.Errorf("Invalid KeyType: %s", keyType)
 }
 
-func generateCsr(privateKey crypto.PrivateKey, domain string, san []string, mustStaple bool) ([]byte, error) {
+func generateCsr(privateKey crypto.PrivateKey, subject pkix.Name, san []string, mustStaple bool, sigAlg x509.SignatureAlgorithm) ([]byte, error) {
 	template := x509.CertificateRequest{
-		Subject: pkix.Name{
-			CommonName: domain,
-		},
+		Subject:            subject,
+		SignatureAlgorithm: sigAlg,
 	}
 
 	if len(san) > 0 {
@@ -306,8 +453,8 @@ func getCertExpiration(cert []byte) (time.Time, error) {
 	return pCert.NotAfter, nil
 }
 
-func generatePemCert(privKey *rsa.PrivateKey, domain string) ([]byte, error) {
-	derBytes, err := generateDerCert(privKey, time.Time{}, domain)
+func generatePemCert(privKey *rsa.PrivateKey, domain string, extensions []pkix.Extension) ([]byte, error) {
+	derBytes, err := generateDerCert(privKey, time.Time{}, domain, extensions)
 	if err != nil {
 		return nil, err
 	}
@@ -315,7 +462,7 @@ func generatePemCert(privKey *rsa.PrivateKey, domain string) ([]byte, error) {
 	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derBytes}), nil
 }
 
-func generateDerCert(privKey *rsa.PrivateKey, expiration time.Time, domain string) ([]byte, error) {
+func generateDerCert(privKey *rsa.PrivateKey, expiration time.Time, domain string, extensions []pkix.Extension) ([]byte, error) {
 	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
 	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
 	if err != nil {
@@ -337,6 +484,7 @@ func generateDerCert(privKey *rsa.PrivateKey, expiration time.Time, domain strin
 		KeyUsage:              x509.KeyUsageKeyEncipherment,
 		BasicConstraintsValid: true,
 		DNSNames:              []string{domain},
+		ExtraExtensions:       extensions,
 	}
 
 	return x509.CreateCertificate(rand.Reader, &template, &template, &privKey.PublicKey, privKey)
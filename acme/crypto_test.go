@@ -2,10 +2,25 @@ package acme
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
+
+	"golang.org/x/crypto/ocsp"
 )
 
 func TestGeneratePrivateKey(t *testing.T) {
@@ -24,7 +39,7 @@ func TestGenerateCSR(t *testing.T) {
 		t.Fatal("Error generating private key:", err)
 	}
 
-	csr, err := generateCsr(key, "fizz.buzz", nil, true)
+	csr, err := generateCsr(key, pkix.Name{CommonName: "fizz.buzz"}, nil, true, x509.UnknownSignatureAlgorithm)
 	if err != nil {
 		t.Error("Error generating CSR:", err)
 	}
@@ -33,6 +48,131 @@ func TestGenerateCSR(t *testing.T) {
 	}
 }
 
+func TestGenerateCSRMustStaple(t *testing.T) {
+	for _, keyType := range []KeyType{RSA2048, EC256, EC384} {
+		key, err := generatePrivateKey(keyType)
+		if err != nil {
+			t.Fatal("Error generating private key:", err)
+		}
+
+		for _, mustStaple := range []bool{false, true} {
+			der, err := generateCsr(key, pkix.Name{CommonName: "fizz.buzz"}, []string{"www.fizz.buzz"}, mustStaple, x509.UnknownSignatureAlgorithm)
+			if err != nil {
+				t.Fatalf("[%s] Error generating CSR: %v", keyType, err)
+			}
+			csr, err := x509.ParseCertificateRequest(der)
+			if err != nil {
+				t.Fatalf("[%s] Error parsing CSR: %v", keyType, err)
+			}
+
+			var found bool
+			for _, ext := range csr.Extensions {
+				if ext.Id.Equal(tlsFeatureExtensionOID) {
+					found = true
+					if !bytes.Equal(ext.Value, ocspMustStapleFeature) {
+						t.Errorf("[%s] Expected the TLS feature extension to request status_request but was %x", keyType, ext.Value)
+					}
+				}
+			}
+			if found != mustStaple {
+				t.Errorf("[%s] Expected TLS feature extension present to be %t but was %t", keyType, mustStaple, found)
+			}
+		}
+	}
+}
+
+func TestGenerateCSRSignatureAlgorithm(t *testing.T) {
+	tests := []struct {
+		keyType  KeyType
+		sigAlg   x509.SignatureAlgorithm
+		expected x509.SignatureAlgorithm
+	}{
+		{RSA2048, x509.UnknownSignatureAlgorithm, x509.SHA256WithRSA},
+		{RSA2048, x509.SHA512WithRSA, x509.SHA512WithRSA},
+		{EC256, x509.UnknownSignatureAlgorithm, x509.ECDSAWithSHA256},
+		{EC256, x509.ECDSAWithSHA384, x509.ECDSAWithSHA384},
+		{EC384, x509.UnknownSignatureAlgorithm, x509.ECDSAWithSHA384},
+		{EC384, x509.ECDSAWithSHA256, x509.ECDSAWithSHA256},
+	}
+
+	for _, tt := range tests {
+		key, err := generatePrivateKey(tt.keyType)
+		if err != nil {
+			t.Fatal("Error generating private key:", err)
+		}
+		if err := checkSignatureAlgorithm(tt.sigAlg, key, tt.keyType); err != nil {
+			t.Errorf("[%s] Expected %v to be accepted, got %v", tt.keyType, tt.sigAlg, err)
+		}
+
+		der, err := generateCsr(key, pkix.Name{CommonName: "fizz.buzz"}, nil, false, tt.sigAlg)
+		if err != nil {
+			t.Fatalf("[%s] Error generating CSR: %v", tt.keyType, err)
+		}
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil {
+			t.Fatalf("[%s] Error parsing CSR: %v", tt.keyType, err)
+		}
+		if csr.SignatureAlgorithm != tt.expected {
+			t.Errorf("[%s] Expected signature algorithm %v but got %v", tt.keyType, tt.expected, csr.SignatureAlgorithm)
+		}
+		if err := csr.CheckSignature(); err != nil {
+			t.Errorf("[%s] Invalid CSR signature: %v", tt.keyType, err)
+		}
+	}
+}
+
+func TestCheckKeySize(t *testing.T) {
+	defer func(bits int) { MinRSAKeySize = bits }(MinRSAKeySize)
+	MinRSAKeySize = 2048
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal("Error generating private key:", err)
+	}
+	if err, ok := checkKeySize(rsaKey).(KeySizeError); !ok || err.Bits != 1024 {
+		t.Errorf("Expected a KeySizeError for a 1024 bit key, got %v", err)
+	}
+
+	MinRSAKeySize = 1024
+	if err := checkKeySize(rsaKey); err != nil {
+		t.Errorf("Expected a 1024 bit key to be accepted with a minimum of 1024, got %v", err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	if err != nil {
+		t.Fatal("Error generating private key:", err)
+	}
+	if err := checkKeySize(ecKey); err != nil {
+		t.Errorf("Expected a P-224 key to be accepted with a warning, got %v", err)
+	}
+}
+
+func TestCheckSignatureAlgorithmIncompatible(t *testing.T) {
+	ecKey, err := generatePrivateKey(EC256)
+	if err != nil {
+		t.Fatal("Error generating private key:", err)
+	}
+
+	tests := []struct {
+		sigAlg  x509.SignatureAlgorithm
+		privKey interface{}
+		keyType KeyType
+	}{
+		{x509.SHA256WithRSA, nil, EC384},
+		{x509.ECDSAWithSHA256, nil, RSA2048},
+		// A supplied key takes precedence over the key type.
+		{x509.SHA256WithRSA, ecKey, RSA2048},
+		{x509.SHA1WithRSA, nil, RSA2048},
+		{x509.DSAWithSHA256, nil, EC256},
+	}
+
+	for _, tt := range tests {
+		if err := checkSignatureAlgorithm(tt.sigAlg, tt.privKey, tt.keyType); err == nil {
+			t.Errorf("Expected %v to be rejected for %s", tt.sigAlg, tt.keyType)
+		}
+	}
+}
+
 func TestPEMEncode(t *testing.T) {
 	buf := bytes.NewBufferString("TestingRSAIsSoMuchFun")
 
@@ -52,6 +192,89 @@ func TestPEMEncode(t *testing.T) {
 	}
 }
 
+func TestParsePrivateKeyPEM(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 512)
+	if err != nil {
+		t.Fatal("Error generating private key:", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("Error generating private key:", err)
+	}
+	rsaPKCS8, err := marshalPKCS8(asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}, asn1.RawValue{Tag: 5}, x509.MarshalPKCS1PrivateKey(rsaKey))
+	if err != nil {
+		t.Fatal("Error marshalling private key:", err)
+	}
+	ecDER, err := x509.MarshalECPrivateKey(ecKey)
+	if err != nil {
+		t.Fatal("Error marshalling private key:", err)
+	}
+	p256, err := asn1.Marshal(asn1.ObjectIdentifier{1, 2, 840, 10045, 3, 1, 7})
+	if err != nil {
+		t.Fatal("Error marshalling curve:", err)
+	}
+	ecPKCS8, err := marshalPKCS8(asn1.ObjectIdentifier{1, 2, 840, 10045, 2, 1}, asn1.RawValue{FullBytes: p256}, ecDER)
+	if err != nil {
+		t.Fatal("Error marshalling private key:", err)
+	}
+
+	tests := []struct {
+		name     string
+		pem      []byte
+		expected crypto.PrivateKey
+	}{
+		{"PKCS#1 RSA", pemEncode(rsaKey), rsaKey},
+		{"SEC 1 EC", pemEncode(ecKey), ecKey},
+		{"PKCS#8 RSA", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: rsaPKCS8}), rsaKey},
+		{"PKCS#8 EC", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: ecPKCS8}), ecKey},
+	}
+
+	for _, tt := range tests {
+		key, err := ParsePrivateKeyPEM(tt.pem)
+		if err != nil {
+			t.Errorf("%s: ParsePrivateKeyPEM error: got %v, want nil", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(key, tt.expected) {
+			t.Errorf("%s: expected the parsed key to equal the encoded one", tt.name)
+		}
+	}
+}
+
+// marshalPKCS8 wraps the DER encoding of a private key of the given algorithm
+// in a PKCS#8 PrivateKeyInfo. x509.MarshalPKCS8PrivateKey needs Go 1.10.
+func marshalPKCS8(algorithm asn1.ObjectIdentifier, parameters asn1.RawValue, key []byte) ([]byte, error) {
+	return asn1.Marshal(struct {
+		Version    int
+		Algorithm  pkix.AlgorithmIdentifier
+		PrivateKey []byte
+	}{
+		Algorithm:  pkix.AlgorithmIdentifier{Algorithm: algorithm, Parameters: parameters},
+		PrivateKey: key,
+	})
+}
+
+func TestParsePrivateKeyPEMErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		pem  []byte
+		want string
+	}{
+		{"not PEM", []byte("not a key"), "No PEM encoded private key"},
+		{"encrypted PKCS#8", pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: []byte{0}}), "Encrypted"},
+		{"encrypted legacy", pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Headers: map[string]string{"Proc-Type": "4,ENCRYPTED", "DEK-Info": "AES-128-CBC,00000000000000000000000000000000"}, Bytes: []byte{0}}), "Encrypted"},
+		{"certificate", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte{0}}), "Unknown PEM header"},
+		{"malformed", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: []byte{0}}), ""},
+	}
+
+	for _, tt := range tests {
+		_, err := ParsePrivateKeyPEM(tt.pem)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got error %v, want something with %q", tt.name, err, tt.want)
+		}
+	}
+}
+
 func TestPEMCertExpiration(t *testing.T) {
 	privKey, err := generatePrivateKey(RSA2048)
 	if err != nil {
@@ -60,7 +283,7 @@ func TestPEMCertExpiration(t *testing.T) {
 
 	expiration := time.Now().Add(365)
 	expiration = expiration.Round(time.Second)
-	certBytes, err := generateDerCert(privKey.(*rsa.PrivateKey), expiration, "test.com")
+	certBytes, err := generateDerCert(privKey.(*rsa.PrivateKey), expiration, "test.com", nil)
 	if err != nil {
 		t.Fatal("Error generating cert:", err)
 	}
@@ -91,3 +314,120 @@ type MockRandReader struct {
 func (r MockRandReader) Read(p []byte) (int, error) {
 	return r.b.Read(p)
 }
+
+func TestGetOCSPForCert(t *testing.T) {
+	caKey, caCert, leafKey := newTestCA(t)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp, err := ocsp.CreateResponse(caCert, caCert, ocsp.Response{
+			Status:       ocsp.Good,
+			SerialNumber: req.SerialNumber,
+			ThisUpdate:   time.Now(),
+			NextUpdate:   time.Now().Add(time.Hour),
+		}, caKey)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		w.Write(resp)
+	}))
+	defer ts.Close()
+
+	leaf := newTestLeaf(t, caKey, caCert, leafKey, time.Now().Add(time.Hour), []string{ts.URL})
+	bundle := append(pemEncode(derCertificateBytes(leaf.Raw)), pemEncode(derCertificateBytes(caCert.Raw))...)
+
+	raw, resp, err := GetOCSPForCert(bundle)
+	if err != nil {
+		t.Fatalf("Expected GetOCSPForCert to return no error but got %v", err)
+	}
+	if len(raw) == 0 {
+		t.Error("Expected a raw OCSP response to staple")
+	}
+	if resp.Status != ocsp.Good {
+		t.Errorf("Expected OCSP status %d but got %d", ocsp.Good, resp.Status)
+	}
+	if resp.SerialNumber.Cmp(leaf.SerialNumber) != 0 {
+		t.Errorf("Expected OCSP response for serial %v but got %v", leaf.SerialNumber, resp.SerialNumber)
+	}
+}
+
+func TestGetOCSPForCertNoOCSPServer(t *testing.T) {
+	caKey, caCert, leafKey := newTestCA(t)
+	leaf := newTestLeaf(t, caKey, caCert, leafKey, time.Now().Add(time.Hour), nil)
+	bundle := append(pemEncode(derCertificateBytes(leaf.Raw)), pemEncode(derCertificateBytes(caCert.Raw))...)
+
+	if _, _, err := GetOCSPForCert(bundle); err != ErrNoOCSPServer {
+		t.Errorf("Expected %v but got %v", ErrNoOCSPServer, err)
+	}
+}
+
+func TestGetOCSPForCertNoIssuer(t *testing.T) {
+	caKey, caCert, leafKey := newTestCA(t)
+	leaf := newTestLeaf(t, caKey, caCert, leafKey, time.Now().Add(time.Hour), []string{"http://ocsp.example.com"})
+
+	// Without the issuer in the bundle or an issuing certificate URL in the
+	// leaf, the OCSP request cannot be built.
+	if _, _, err := GetOCSPForCert(pemEncode(derCertificateBytes(leaf.Raw))); err != ErrNoIssuerCertificate {
+		t.Errorf("Expected %v but got %v", ErrNoIssuerCertificate, err)
+	}
+}
+
+// newTestCA returns a self-signed CA along with a key for leaf certificates.
+func newTestCA(t *testing.T) (*rsa.PrivateKey, *x509.Certificate, *rsa.PrivateKey) {
+	caKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal("Error generating private key:", err)
+	}
+	leafKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal("Error generating private key:", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal("Error generating CA cert:", err)
+	}
+	caCert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal("Error parsing CA cert:", err)
+	}
+
+	return caKey, caCert, leafKey
+}
+
+// newTestLeaf returns a certificate for leafKey signed by the CA.
+func newTestLeaf(t *testing.T, caKey *rsa.PrivateKey, caCert *x509.Certificate, leafKey *rsa.PrivateKey, notAfter time.Time, ocspServers []string) *x509.Certificate {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		OCSPServer:   ocspServers,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &leafKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal("Error generating leaf cert:", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal("Error parsing leaf cert:", err)
+	}
+	return leaf
+}
@@ -1,28 +1,59 @@
 package acme
 
 import (
+	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	"log"
+	"io/ioutil"
 	"net"
+	"net/http"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/miekg/dns"
 	"golang.org/x/net/publicsuffix"
 )
 
-type preCheckDNSFunc func(fqdn, value string) (bool, error)
+// PreCheckFunc decides whether the TXT record with the given value at fqdn
+// has propagated far enough for the CA to validate the DNS-01 challenge.
+// It is polled until it returns true or the provider's timeout elapses.
+type PreCheckFunc func(fqdn, value string) (bool, error)
 
 var (
 	// PreCheckDNS checks DNS propagation before notifying ACME that
-	// the DNS challenge is ready.
-	PreCheckDNS preCheckDNSFunc = checkDNSPropagation
-	fqdnToZone                  = map[string]string{}
+	// the DNS challenge is ready. It is used unless a PreCheckFunc was set
+	// with Client.SetDNSPreCheck.
+	PreCheckDNS  PreCheckFunc = CheckDNSPropagation
+	fqdnToZone                = map[string]zoneCacheEntry{}
+	muFqdnToZone sync.Mutex
 )
 
+// zoneCacheTTL is how long a zone found by FindZoneByFqdn is remembered.
+var zoneCacheTTL = 5 * time.Minute
+
+// zoneCacheClock is the clock the zone cache expires by, set with
+// Client.SetClock. It is guarded by muFqdnToZone.
+var zoneCacheClock Clock
+
+func setZoneCacheClock(clock Clock) {
+	muFqdnToZone.Lock()
+	defer muFqdnToZone.Unlock()
+
+	zoneCacheClock = clock
+}
+
+type zoneCacheEntry struct {
+	zone    string
+	expires time.Time
+}
+
 const defaultResolvConf = "/etc/resolv.conf"
 
 var defaultNameservers = []string{
@@ -33,8 +64,59 @@ var defaultNameservers = []string{
 var RecursiveNameservers = getNameservers(defaultResolvConf, defaultNameservers)
 
 // DNSTimeout is used to override the default DNS timeout of 10 seconds.
+// It bounds each exchange with a nameserver, so an unresponsive one fails
+// fast and the next candidate is tried.
 var DNSTimeout = 10 * time.Second
 
+// IPFamily represents the IP protocol version used to reach nameservers.
+type IPFamily string
+
+// Constants for all IP families we support.
+const (
+	AnyIPFamily = IPFamily("")
+	IPv4Only    = IPFamily("4")
+	IPv6Only    = IPFamily("6")
+)
+
+// DNSIPFamily restricts the IP family used when dialing nameservers. By default
+// any family is used. Restricting it is useful on hosts where only IPv4 or only
+// IPv6 resolvers are reachable, or where a resolver answers differently on each
+// family: some return SERVFAIL over one family while resolving fine over the
+// other, and as FindZoneByFqdn treats SERVFAIL as fatal the only way around such
+// a resolver is to avoid the broken family altogether.
+var DNSIPFamily = AnyIPFamily
+
+// DNSProtocol represents the protocol used to query nameservers.
+type DNSProtocol string
+
+// Constants for all DNS protocols we support.
+const (
+	UDPProtocol = DNSProtocol("udp")
+	TCPProtocol = DNSProtocol("tcp")
+	DoHProtocol = DNSProtocol("doh")
+)
+
+// DNSQueryProtocol selects how nameservers are queried, e.g. to check that a
+// DNS-01 record has propagated. By default queries are sent over UDP and
+// retried over TCP if the answer is truncated. TCPProtocol only uses TCP, for
+// networks that block DNS over UDP. DoHProtocol sends recursive queries to
+// DNSOverHTTPSURL instead of the RecursiveNameservers, and queries the
+// authoritative nameservers, which do not serve DNS over HTTPS, over TCP.
+var DNSQueryProtocol = UDPProtocol
+
+// DNSOverHTTPSURL is the URL of the DNS over HTTPS (RFC 8484) resolver used
+// with DoHProtocol, e.g. https://cloudflare-dns.com/dns-query.
+var DNSOverHTTPSURL string
+
+// ParseDNSProtocol parses the name of a DNS protocol: udp, tcp or doh.
+func ParseDNSProtocol(name string) (DNSProtocol, error) {
+	switch protocol := DNSProtocol(strings.ToLower(name)); protocol {
+	case UDPProtocol, TCPProtocol, DoHProtocol:
+		return protocol, nil
+	}
+	return "", fmt.Errorf("Unknown DNS protocol %q, supported: udp, tcp, doh", name)
+}
+
 // getNameservers attempts to get systems nameservers before falling back to the defaults
 func getNameservers(path string, defaults []string) []string {
 	config, err := dns.ClientConfigFromFile(path)
@@ -54,6 +136,53 @@ func getNameservers(path string, defaults []string) []string {
 	return systemNameservers
 }
 
+// SetRecursiveNameservers overrides the nameservers used for recursive DNS
+// queries, e.g. to force public resolvers for the propagation check in split
+// horizon setups where the system resolvers cannot see the public TXT record.
+// Entries are given as host:port; a missing port defaults to 53. An error is
+// returned, and RecursiveNameservers left untouched, if any entry is invalid.
+func SetRecursiveNameservers(nameservers []string) error {
+	if len(nameservers) == 0 {
+		return errors.New("No nameservers given")
+	}
+
+	servers := make([]string, 0, len(nameservers))
+	for _, ns := range nameservers {
+		server, err := parseNameserver(ns)
+		if err != nil {
+			return err
+		}
+		servers = append(servers, server)
+	}
+
+	RecursiveNameservers = servers
+	return nil
+}
+
+// parseNameserver validates a host[:port] nameserver address and returns it
+// as host:port.
+func parseNameserver(ns string) (string, error) {
+	ns = strings.TrimSpace(ns)
+
+	host, port, err := net.SplitHostPort(ns)
+	if err != nil {
+		// no port given
+		host, port = strings.Trim(ns, "[]"), "53"
+	}
+
+	if net.ParseIP(host) == nil {
+		if _, ok := dns.IsDomainName(host); !ok || host == "" || strings.ContainsAny(host, " :/") {
+			return "", fmt.Errorf("Invalid nameserver %q: %q is neither an IP address nor a hostname", ns, host)
+		}
+	}
+
+	if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+		return "", fmt.Errorf("Invalid nameserver %q: invalid port %q", ns, port)
+	}
+
+	return net.JoinHostPort(host, port), nil
+}
+
 // DNS01Record returns a DNS record which will fulfill the `dns-01` challenge
 func DNS01Record(domain, keyAuth string) (fqdn string, value string, ttl int) {
 	keyAuthShaBytes := sha256.Sum256([]byte(keyAuth))
@@ -61,44 +190,219 @@ func DNS01Record(domain, keyAuth string) (fqdn string, value string, ttl int) {
 	keyAuthSha := base64.URLEncoding.EncodeToString(keyAuthShaBytes[:sha256.Size])
 	value = strings.TrimRight(keyAuthSha, "=")
 	ttl = 120
-	fqdn = fmt.Sprintf("_acme-challenge.%s.", domain)
+
+	muChallengeRecord.RLock()
+	defer muChallengeRecord.RUnlock()
+	fqdn = fmt.Sprintf("%s.%s.", challengeRecordPrefix, domain)
+	if challengeDelegationZone != "" {
+		fqdn = challengeDelegationTarget(domain)
+	}
 	return
 }
 
+// muChallengeRecord guards challengeRecordPrefix and challengeDelegationZone,
+// which every client shares.
+var muChallengeRecord sync.RWMutex
+
+// defaultChallengeRecordPrefix is the label of the DNS-01 record, see RFC 8555
+// section 8.4.
+const defaultChallengeRecordPrefix = "_acme-challenge"
+
+// challengeRecordPrefix is the label set with SetChallengeRecordPrefix.
+var challengeRecordPrefix = defaultChallengeRecordPrefix
+
+// dnsLabelRegexp matches a single DNS label. Underscores are allowed, as
+// in _acme-challenge.
+var dnsLabelRegexp = regexp.MustCompile(`^[A-Za-z0-9_]([A-Za-z0-9_-]{0,61}[A-Za-z0-9_])?$`)
+
+// SetChallengeRecordPrefix sets the label that DNS01Record puts in front of a
+// domain, _acme-challenge by default. Public CAs only look for the record at
+// _acme-challenge, but some private CAs allow a different label. The prefix
+// must be a single DNS label. An empty prefix restores the default.
+func SetChallengeRecordPrefix(prefix string) error {
+	if prefix == "" {
+		prefix = defaultChallengeRecordPrefix
+	}
+	if !dnsLabelRegexp.MatchString(prefix) {
+		return fmt.Errorf("acme: invalid challenge record prefix %q: not a DNS label", prefix)
+	}
+
+	muChallengeRecord.Lock()
+	defer muChallengeRecord.Unlock()
+	challengeRecordPrefix = prefix
+	return nil
+}
+
+// challengeDelegationZone is the zone set with SetChallengeDelegationZone.
+var challengeDelegationZone string
+
+// SetChallengeDelegationZone delegates the DNS-01 challenges of all domains
+// to zone, like acme-dns does: the _acme-challenge name of every domain must
+// be a CNAME to ChallengeDelegationTarget(domain), and DNS01Record, and with
+// it every DNS provider, returns that name in zone instead. Only zone then
+// needs to be writable by the DNS provider. An empty zone turns delegation
+// off. Like SetChallengeRecordPrefix, it applies to all clients.
+//
+// Delegation can be combined with a prefix set with SetChallengeRecordPrefix:
+// the CA then looks up <prefix>.<domain>, so that is the name which must be
+// the CNAME. DNS01Record returns the delegation target either way, as the
+// record is written in zone.
+func SetChallengeDelegationZone(zone string) {
+	if zone != "" {
+		zone = dns.Fqdn(strings.ToLower(zone))
+	}
+
+	muChallengeRecord.Lock()
+	defer muChallengeRecord.Unlock()
+	challengeDelegationZone = zone
+}
+
+// ChallengeDelegationTarget returns the name that the _acme-challenge CNAME
+// of domain must point to: a hash of domain in the zone set with
+// SetChallengeDelegationZone. It returns "" if no zone is set.
+func ChallengeDelegationTarget(domain string) string {
+	muChallengeRecord.RLock()
+	defer muChallengeRecord.RUnlock()
+	if challengeDelegationZone == "" {
+		return ""
+	}
+	return challengeDelegationTarget(domain)
+}
+
+// challengeDelegationTarget is ChallengeDelegationTarget for a set zone. The
+// caller must hold muChallengeRecord.
+func challengeDelegationTarget(domain string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSuffix(domain, "."))))
+	return hex.EncodeToString(sum[:16]) + "." + challengeDelegationZone
+}
+
 // dnsChallenge implements the dns-01 challenge according to ACME 7.5
 type dnsChallenge struct {
 	jws      *jws
 	validate validateFunc
+	tracker  *challengeTracker
 	provider ChallengeProvider
+	preCheck PreCheckFunc
+	// skipPropagation skips waiting for the pre-check to pass.
+	skipPropagation bool
 }
 
-func (s *dnsChallenge) Solve(chlng challenge, domain string) error {
+func (s *dnsChallenge) Solve(ctx context.Context, chlng challenge, domain string) error {
 	logf("[INFO][%s] acme: Trying to solve DNS-01", domain)
 
+	record, err := s.present(ctx, chlng, domain)
+	if err != nil {
+		return err
+	}
+	defer s.cleanUp(record)
+
+	if err := s.waitForPropagation(ctx, []*dnsRecord{record}); err != nil {
+		return err
+	}
+	return s.validateRecord(ctx, record)
+}
+
+// solveAll solves the DNS-01 challenges of several domains together. It
+// presents every record first and waits until all of them have propagated
+// before it asks the CA to validate any, so that the CA never sees a stale
+// set of records when several domains share a zone. It returns the failure
+// of each domain that could not be solved.
+func (s *dnsChallenge) solveAll(ctx context.Context, domains []string, chlngs []challenge) map[string]error {
+	failures := make(map[string]error)
+
+	var records []*dnsRecord
+	defer func() {
+		for _, record := range records {
+			s.cleanUp(record)
+		}
+	}()
+
+	for i, domain := range domains {
+		logf("[INFO][%s] acme: Trying to solve DNS-01", domain)
+
+		record, err := s.present(ctx, chlngs[i], domain)
+		if err != nil {
+			failures[domain] = err
+			continue
+		}
+		records = append(records, record)
+	}
+
+	if err := s.waitForPropagation(ctx, records); err != nil {
+		for _, record := range records {
+			failures[record.domain] = err
+		}
+		return failures
+	}
+
+	for _, record := range records {
+		if err := s.validateRecord(ctx, record); err != nil {
+			failures[record.domain] = err
+		}
+	}
+	return failures
+}
+
+// dnsRecord is the TXT record presented for the DNS-01 challenge of domain.
+type dnsRecord struct {
+	domain  string
+	chlng   challenge
+	keyAuth string
+	fqdn    string
+	value   string
+}
+
+// present presents the TXT record for the challenge with the provider.
+func (s *dnsChallenge) present(ctx context.Context, chlng challenge, domain string) (*dnsRecord, error) {
 	if s.provider == nil {
-		return errors.New("No DNS Provider configured")
+		return nil, errors.New("No DNS Provider configured")
 	}
 
 	// Generate the Key Authorization for the challenge
 	keyAuth, err := getKeyAuthorization(chlng.Token, s.jws.privKey)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	err = s.provider.Present(domain, chlng.Token, keyAuth)
+	s.tracker.add(domain, chlng)
+	err = presentChallenge(ctx, s.provider, domain, chlng.Token, keyAuth)
 	if err != nil {
-		return fmt.Errorf("Error presenting token: %s", err)
+		s.tracker.remove(domain, chlng.Token)
+		return nil, fmt.Errorf("Error presenting token: %s", err)
 	}
-	defer func() {
-		err := s.provider.CleanUp(domain, chlng.Token, keyAuth)
-		if err != nil {
-			log.Printf("Error cleaning up %s: %v ", domain, err)
-		}
-	}()
+	s.tracker.presented(domain, chlng.Token)
 
 	fqdn, value, _ := DNS01Record(domain, keyAuth)
+	return &dnsRecord{domain: domain, chlng: chlng, keyAuth: keyAuth, fqdn: fqdn, value: value}, nil
+}
+
+// cleanUp removes a presented record. Errors are only logged, so that they
+// do not mask the outcome of the challenge.
+func (s *dnsChallenge) cleanUp(record *dnsRecord) {
+	defer s.tracker.remove(record.domain, record.chlng.Token)
+
+	err := cleanUpChallenge(s.provider, record.domain, record.chlng.Token, record.keyAuth)
+	if err != nil {
+		logf("Error cleaning up %s: %v ", record.domain, err)
+	}
+}
+
+// waitForPropagation waits until the pre-check passes for all records in
+// the same round, within the timeout of the provider.
+func (s *dnsChallenge) waitForPropagation(ctx context.Context, records []*dnsRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
 
-	logf("[INFO][%s] Checking DNS record propagation using %+v", domain, RecursiveNameservers)
+	var domains []string
+	for _, record := range records {
+		domains = append(domains, record.domain)
+	}
+	if s.skipPropagation {
+		logf("[INFO][%s] Skipping the DNS record propagation check", strings.Join(domains, ", "))
+		return nil
+	}
+	logf("[INFO][%s] Checking DNS record propagation using %+v", strings.Join(domains, ", "), RecursiveNameservers)
 
 	var timeout, interval time.Duration
 	switch provider := s.provider.(type) {
@@ -108,18 +412,30 @@ func (s *dnsChallenge) Solve(chlng challenge, domain string) error {
 		timeout, interval = 60*time.Second, 2*time.Second
 	}
 
-	err = WaitFor(timeout, interval, func() (bool, error) {
-		return PreCheckDNS(fqdn, value)
-	})
-	if err != nil {
-		return err
+	preCheck := s.preCheck
+	if preCheck == nil {
+		preCheck = PreCheckDNS
 	}
 
-	return s.validate(s.jws, domain, chlng.URI, challenge{Resource: "challenge", Type: chlng.Type, Token: chlng.Token, KeyAuthorization: keyAuth})
+	return waitFor(ctx, timeout, interval, func() (bool, error) {
+		for _, record := range records {
+			if ok, err := preCheck(record.fqdn, record.value); !ok || err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	})
+}
+
+// validateRecord asks the CA to validate the challenge of a presented record.
+func (s *dnsChallenge) validateRecord(ctx context.Context, record *dnsRecord) error {
+	chlng := record.chlng
+	return s.validate(ctx, s.jws, record.domain, chlng.URI, challenge{Resource: "challenge", Type: chlng.Type, Token: chlng.Token, KeyAuthorization: record.keyAuth})
 }
 
-// checkDNSPropagation checks if the expected TXT record has been propagated to all authoritative nameservers.
-func checkDNSPropagation(fqdn, value string) (bool, error) {
+// CheckDNSPropagation checks if the expected TXT record has been propagated to all
+// authoritative nameservers. It is the default PreCheckFunc.
+func CheckDNSPropagation(fqdn, value string) (bool, error) {
 	// Initial attempt to resolve at the recursive NS
 	r, err := dnsQuery(fqdn, dns.TypeTXT, RecursiveNameservers, true)
 	if err != nil {
@@ -145,10 +461,30 @@ func checkDNSPropagation(fqdn, value string) (bool, error) {
 	return checkAuthoritativeNss(fqdn, value, authoritativeNss)
 }
 
+// CheckAuthoritativeTXT checks if the expected TXT record is served by all
+// authoritative nameservers of the zone of fqdn. Unlike CheckDNSPropagation it
+// does not ask the recursive nameservers for the record first, so a negative
+// answer cached by them cannot delay it, but it does not follow CNAMEs either.
+// It is a PreCheckFunc and can be set with Client.SetDNSPreCheck.
+func CheckAuthoritativeTXT(fqdn, value string) (bool, error) {
+	authoritativeNss, err := lookupNameservers(fqdn)
+	if err != nil {
+		return false, err
+	}
+
+	return checkAuthoritativeNss(fqdn, value, authoritativeNss)
+}
+
 // checkAuthoritativeNss queries each of the given nameservers for the expected TXT record.
+// Nameservers are queried on port 53 unless they include a port.
 func checkAuthoritativeNss(fqdn, value string, nameservers []string) (bool, error) {
 	for _, ns := range nameservers {
-		r, err := dnsQuery(fqdn, dns.TypeTXT, []string{net.JoinHostPort(ns, "53")}, false)
+		addr := ns
+		if _, _, err := net.SplitHostPort(ns); err != nil {
+			addr = net.JoinHostPort(ns, "53")
+		}
+
+		r, err := dnsQuery(fqdn, dns.TypeTXT, []string{addr}, false)
 		if err != nil {
 			return false, err
 		}
@@ -186,18 +522,15 @@ func dnsQuery(fqdn string, rtype uint16, nameservers []string, recursive bool) (
 		m.RecursionDesired = false
 	}
 
-	// Will retry the request based on the number of servers (n+1)
-	for i := 1; i <= len(nameservers)+1; i++ {
-		ns := nameservers[i%len(nameservers)]
-		udp := &dns.Client{Net: "udp", Timeout: DNSTimeout}
-		in, _, err = udp.Exchange(m, ns)
-
-		if err == dns.ErrTruncated {
-			tcp := &dns.Client{Net: "tcp", Timeout: DNSTimeout}
-			// If the TCP request succeeds, the err will reset to nil
-			in, _, err = tcp.Exchange(m, ns)
-		}
+	if recursive && DNSQueryProtocol == DoHProtocol {
+		return dohExchange(m, DNSOverHTTPSURL)
+	}
 
+	// Will retry the request based on the number of servers (n+1), starting
+	// with the first one.
+	for i := 0; i <= len(nameservers); i++ {
+		ns := nameservers[i%len(nameservers)]
+		in, err = dnsExchange(m, ns)
 		if err == nil {
 			break
 		}
@@ -205,6 +538,59 @@ func dnsQuery(fqdn string, rtype uint16, nameservers []string, recursive bool) (
 	return
 }
 
+// dnsExchange sends m to the nameserver ns over the DNSQueryProtocol. Over
+// UDP, an answer that is truncated, or could not be unpacked because it is,
+// is retried over TCP.
+func dnsExchange(m *dns.Msg, ns string) (*dns.Msg, error) {
+	if DNSQueryProtocol == UDPProtocol {
+		udp := &dns.Client{Net: "udp" + string(DNSIPFamily), Timeout: DNSTimeout}
+		in, _, err := udp.Exchange(m, ns)
+		if err != dns.ErrTruncated && (err != nil || !in.Truncated) {
+			return in, err
+		}
+	}
+
+	tcp := &dns.Client{Net: "tcp" + string(DNSIPFamily), Timeout: DNSTimeout}
+	in, _, err := tcp.Exchange(m, ns)
+	return in, err
+}
+
+// dohExchange sends m to the DNS over HTTPS resolver at url, using the POST
+// method of RFC 8484.
+func dohExchange(m *dns.Msg, url string) (*dns.Msg, error) {
+	if url == "" {
+		return nil, errors.New("No DNS over HTTPS URL configured")
+	}
+
+	// RFC 8484 asks for an ID of 0 to make the answers cacheable.
+	query := m.Copy()
+	query.Id = 0
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := httpPost(url, "application/dns-message", bytes.NewReader(packed))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DNS over HTTPS resolver %s returned %s", url, resp.Status)
+	}
+	body, err := ioutil.ReadAll(limitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+
+	in := new(dns.Msg)
+	if err := in.Unpack(body); err != nil {
+		return nil, fmt.Errorf("DNS over HTTPS resolver %s returned an invalid message: %v", url, err)
+	}
+	return in, nil
+}
+
 // lookupNameservers returns the authoritative nameservers for the given fqdn.
 func lookupNameservers(fqdn string) ([]string, error) {
 	var authoritativeNss []string
@@ -233,9 +619,12 @@ func lookupNameservers(fqdn string) ([]string, error) {
 
 // FindZoneByFqdn determines the zone apex for the given fqdn by recursing up the
 // domain labels until the nameserver returns a SOA record in the answer section.
+// Results are cached for a short while, both for the fqdn and for the zone apex
+// itself, so that looking up several names below the same zone only queries the
+// nameservers for the apex once. The cache is safe for concurrent use.
 func FindZoneByFqdn(fqdn string, nameservers []string) (string, error) {
 	// Do we have it cached?
-	if zone, ok := fqdnToZone[fqdn]; ok {
+	if zone, ok := cachedZone(fqdn); ok {
 		return zone, nil
 	}
 
@@ -247,6 +636,12 @@ func FindZoneByFqdn(fqdn string, nameservers []string) (string, error) {
 			break
 		}
 
+		// A parent of fqdn may already be known from an earlier lookup of a sibling.
+		if zone, ok := cachedZone(domain); ok {
+			cacheZone(fqdn, zone)
+			return zone, nil
+		}
+
 		in, err := dnsQuery(domain, dns.TypeSOA, nameservers, true)
 		if err != nil {
 			return "", err
@@ -263,7 +658,8 @@ func FindZoneByFqdn(fqdn string, nameservers []string) (string, error) {
 			for _, ans := range in.Answer {
 				if soa, ok := ans.(*dns.SOA); ok {
 					zone := soa.Hdr.Name
-					fqdnToZone[fqdn] = zone
+					cacheZone(fqdn, zone)
+					cacheZone(domain, zone)
 					return zone, nil
 				}
 			}
@@ -281,9 +677,35 @@ func isTLD(domain string) bool {
 	return false
 }
 
+// cachedZone returns the cached zone for fqdn, if there is one which has not expired.
+func cachedZone(fqdn string) (string, bool) {
+	muFqdnToZone.Lock()
+	defer muFqdnToZone.Unlock()
+
+	entry, ok := fqdnToZone[fqdn]
+	if !ok {
+		return "", false
+	}
+	if clockNow(zoneCacheClock).After(entry.expires) {
+		delete(fqdnToZone, fqdn)
+		return "", false
+	}
+	return entry.zone, true
+}
+
+func cacheZone(fqdn, zone string) {
+	muFqdnToZone.Lock()
+	defer muFqdnToZone.Unlock()
+
+	fqdnToZone[fqdn] = zoneCacheEntry{zone: zone, expires: clockNow(zoneCacheClock).Add(zoneCacheTTL)}
+}
+
 // ClearFqdnCache clears the cache of fqdn to zone mappings. Primarily used in testing.
 func ClearFqdnCache() {
-	fqdnToZone = map[string]string{}
+	muFqdnToZone.Lock()
+	defer muFqdnToZone.Unlock()
+
+	fqdnToZone = map[string]zoneCacheEntry{}
 }
 
 // ToFqdn converts the name into a fqdn appending a trailing dot.
@@ -2,16 +2,25 @@ package acme
 
 import (
 	"bufio"
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"reflect"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/miekg/dns"
 )
 
 var lookupNameserversTestsOK = []struct {
@@ -94,6 +103,86 @@ var checkResolvConfServersTests = []struct {
 	{"testdata/resolv.conf.nonexistant", []string{"127.0.0.1:53"}, []string{"127.0.0.1:53"}},
 }
 
+func TestDNS01RecordDelegation(t *testing.T) {
+	defer SetChallengeDelegationZone("")
+
+	fqdn, value, ttl := DNS01Record("www.example.com", "keyAuth")
+	if fqdn != "_acme-challenge.www.example.com." {
+		t.Errorf("Expected the _acme-challenge name without delegation, got %s", fqdn)
+	}
+
+	SetChallengeDelegationZone("Challenge.Example.NET")
+	target := ChallengeDelegationTarget("www.example.com")
+	if labels := strings.SplitN(target, ".", 2); len(labels[0]) != 32 || labels[1] != "challenge.example.net." {
+		t.Errorf("Expected a hash in challenge.example.net., got %s", target)
+	}
+	if other := ChallengeDelegationTarget("mail.example.com"); other == target {
+		t.Errorf("Expected different targets for different domains, got %s twice", target)
+	}
+
+	delegatedFqdn, delegatedValue, delegatedTTL := DNS01Record("WWW.example.com", "keyAuth")
+	if delegatedFqdn != target {
+		t.Errorf("Expected the record to be delegated to %s, got %s", target, delegatedFqdn)
+	}
+	if delegatedValue != value || delegatedTTL != ttl {
+		t.Errorf("Expected the delegated record to keep value %s and TTL %d, got %s and %d", value, ttl, delegatedValue, delegatedTTL)
+	}
+
+	SetChallengeDelegationZone("")
+	if target := ChallengeDelegationTarget("www.example.com"); target != "" {
+		t.Errorf("Expected no target without a delegation zone, got %s", target)
+	}
+}
+
+func TestDNS01RecordDelegationWithPrefix(t *testing.T) {
+	defer SetChallengeRecordPrefix("")
+	defer SetChallengeDelegationZone("")
+
+	if err := SetChallengeRecordPrefix("_custom-label"); err != nil {
+		t.Fatalf("SetChallengeRecordPrefix error: got %v, want nil", err)
+	}
+	SetChallengeDelegationZone("challenge.example.net")
+
+	// The record is written in the delegation zone, whatever the prefix of
+	// the CNAME pointing there.
+	target := ChallengeDelegationTarget("www.example.com")
+	if fqdn, _, _ := DNS01Record("www.example.com", "keyAuth"); fqdn != target {
+		t.Errorf("Expected the record to be delegated to %s, got %s", target, fqdn)
+	}
+
+	SetChallengeDelegationZone("")
+	if fqdn, _, _ := DNS01Record("www.example.com", "keyAuth"); fqdn != "_custom-label.www.example.com." {
+		t.Errorf("Expected the prefix to apply again without delegation, got %s", fqdn)
+	}
+}
+
+func TestSetChallengeRecordPrefix(t *testing.T) {
+	defer SetChallengeRecordPrefix("")
+
+	if err := SetChallengeRecordPrefix("_custom-label"); err != nil {
+		t.Fatalf("SetChallengeRecordPrefix error: got %v, want nil", err)
+	}
+	if fqdn, _, _ := DNS01Record("www.example.com", "keyAuth"); fqdn != "_custom-label.www.example.com." {
+		t.Errorf("Expected the record at _custom-label.www.example.com., got %s", fqdn)
+	}
+
+	for _, prefix := range []string{"two.labels", "-leading", "trailing-", "white space", strings.Repeat("a", 64)} {
+		if err := SetChallengeRecordPrefix(prefix); err == nil {
+			t.Errorf("Expected %q to be rejected", prefix)
+		}
+	}
+	if fqdn, _, _ := DNS01Record("www.example.com", "keyAuth"); fqdn != "_custom-label.www.example.com." {
+		t.Errorf("Expected an invalid prefix to keep the previous one, got %s", fqdn)
+	}
+
+	if err := SetChallengeRecordPrefix(""); err != nil {
+		t.Fatalf("SetChallengeRecordPrefix error: got %v, want nil", err)
+	}
+	if fqdn, _, _ := DNS01Record("www.example.com", "keyAuth"); fqdn != "_acme-challenge.www.example.com." {
+		t.Errorf("Expected the default record name after a reset, got %s", fqdn)
+	}
+}
+
 func TestDNSValidServerResponse(t *testing.T) {
 	PreCheckDNS = func(fqdn, value string) (bool, error) {
 		return true, nil
@@ -117,11 +206,267 @@ func TestDNSValidServerResponse(t *testing.T) {
 		f.WriteString("\n")
 	}()
 
-	if err := solver.Solve(clientChallenge, "example.com"); err != nil {
+	if err := solver.Solve(context.Background(), clientChallenge, "example.com"); err != nil {
 		t.Errorf("VALID: Expected Solve to return no error but the error was -> %v", err)
 	}
 }
 
+func TestDNSSolveCancelledDuringPropagation(t *testing.T) {
+	defer func(f PreCheckFunc) { PreCheckDNS = f }(PreCheckDNS)
+	PreCheckDNS = func(fqdn, value string) (bool, error) {
+		return false, nil
+	}
+	privKey, _ := rsa.GenerateKey(rand.Reader, 512)
+
+	provider := &contextProvider{}
+	solver := &dnsChallenge{jws: &jws{privKey: privKey}, validate: stubValidate, provider: provider}
+	clientChallenge := challenge{Type: "dns01", Status: "pending", Token: "http8"}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	start := time.Now()
+	err := solver.Solve(ctx, clientChallenge, "example.com")
+	if err != context.Canceled {
+		t.Errorf("Expected Solve to return %v but got %v", context.Canceled, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected Solve to return promptly after cancellation but it took %s", elapsed)
+	}
+	if provider.presentCtx != ctx {
+		t.Error("Expected PresentContext to be called with the solve context")
+	}
+	if !provider.cleanedUp {
+		t.Error("Expected CleanUpContext to be called after cancellation")
+	}
+}
+
+func TestDNSSolveCustomPreCheck(t *testing.T) {
+	defer func(f PreCheckFunc) { PreCheckDNS = f }(PreCheckDNS)
+	PreCheckDNS = func(fqdn, value string) (bool, error) {
+		t.Error("Expected the client's PreCheckFunc to be used instead of PreCheckDNS")
+		return false, nil
+	}
+	privKey, _ := rsa.GenerateKey(rand.Reader, 512)
+
+	clientChallenge := challenge{Type: "dns01", Status: "pending", Token: "http8"}
+	keyAuth, err := getKeyAuthorization(clientChallenge.Token, privKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, value, _ := DNS01Record("example.com", keyAuth)
+
+	// Simulate an anycast setup where one of three authoritative
+	// nameservers has not converged yet.
+	var nameservers []string
+	for _, handler := range []dns.HandlerFunc{serverHandlerTXT(value), serverHandlerTXT(value), serverHandlerSOA("example.com.")} {
+		server, addr, err := runLocalDNSTestServer("udp", "127.0.0.1:0", handler)
+		if err != nil {
+			t.Fatalf("Failed to start test server: %v", err)
+		}
+		defer server.Shutdown()
+		nameservers = append(nameservers, addr)
+	}
+
+	// quorum accepts the record once at least n of the nameservers return it.
+	quorum := func(n int) PreCheckFunc {
+		return func(fqdn, value string) (bool, error) {
+			var agree int
+			for _, ns := range nameservers {
+				if ok, _ := checkAuthoritativeNss(fqdn, value, []string{ns}); ok {
+					agree++
+				}
+			}
+			return agree >= n, nil
+		}
+	}
+
+	tests := []struct {
+		n    int
+		want string
+	}{
+		{2, ""},
+		{3, "Time limit exceeded"},
+	}
+
+	for _, tt := range tests {
+		client := &Client{jws: &jws{privKey: privKey}, solvers: map[Challenge]solver{}}
+		client.SetDNSPreCheck(quorum(tt.n))
+		client.SetChallengeProvider(DNS01, &recordingProvider{timeout: 100 * time.Millisecond})
+		solver := client.solvers[DNS01].(*dnsChallenge)
+		solver.validate = stubValidate
+
+		err := solver.Solve(context.Background(), clientChallenge, "example.com")
+		if tt.want == "" && err != nil {
+			t.Errorf("%d of 3: expected Solve to return no error but the error was -> %v", tt.n, err)
+		}
+		if tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)) {
+			t.Errorf("%d of 3: expected an error with %q, got %v", tt.n, tt.want, err)
+		}
+	}
+}
+
+func TestDNSSolveWithoutPropagationCheck(t *testing.T) {
+	defer func(f PreCheckFunc) { PreCheckDNS = f }(PreCheckDNS)
+	PreCheckDNS = CheckDNSPropagation
+
+	var queries int32
+	server, addr, err := runLocalDNSTestServer("udp", "127.0.0.1:0", func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(&queries, 1)
+		serverHandlerSOA("example.com.")(w, req)
+	})
+	if err != nil {
+		t.Fatalf("Failed to start test server: %v", err)
+	}
+	defer server.Shutdown()
+
+	defer func(nameservers []string) { RecursiveNameservers = nameservers }(RecursiveNameservers)
+	RecursiveNameservers = []string{addr}
+	ClearFqdnCache()
+
+	privKey, _ := rsa.GenerateKey(rand.Reader, 512)
+	client := &Client{jws: &jws{privKey: privKey}, solvers: map[Challenge]solver{}}
+	client.DisableDNSPropagationCheck(true)
+	client.SetChallengeProvider(DNS01, &recordingProvider{timeout: time.Minute})
+	solver := client.solvers[DNS01].(*dnsChallenge)
+
+	var validated bool
+	solver.validate = func(ctx context.Context, j *jws, domain, uri string, chlng challenge) error {
+		validated = true
+		return nil
+	}
+
+	clientChallenge := challenge{Type: "dns01", Status: "pending", Token: "http8"}
+	if err := solver.Solve(context.Background(), clientChallenge, "example.com"); err != nil {
+		t.Fatalf("Expected Solve to return no error but the error was -> %v", err)
+	}
+	if !validated {
+		t.Error("Expected the challenge to be validated")
+	}
+	if n := atomic.LoadInt32(&queries); n != 0 {
+		t.Errorf("Expected no DNS queries with the propagation check disabled, got %d", n)
+	}
+
+	client.DisableDNSPropagationCheck(false)
+	if solver.skipPropagation {
+		t.Error("Expected the propagation check to be enabled again on the current DNS solver")
+	}
+}
+
+func TestParseDNSProtocol(t *testing.T) {
+	for name, want := range map[string]DNSProtocol{"udp": UDPProtocol, "TCP": TCPProtocol, "doh": DoHProtocol} {
+		if protocol, err := ParseDNSProtocol(name); err != nil || protocol != want {
+			t.Errorf("%s: got (%q, %v); want (%q, nil)", name, protocol, err, want)
+		}
+	}
+	if _, err := ParseDNSProtocol("dot"); err == nil {
+		t.Error("Expected an error for an unknown protocol")
+	}
+}
+
+func TestDNSQueryTCPFallback(t *testing.T) {
+	tcpServer, addr, err := runLocalDNSTCPTestServer("127.0.0.1:0", serverHandlerTXT("over tcp"))
+	if err != nil {
+		t.Fatalf("Failed to start test server: %v", err)
+	}
+	defer tcpServer.Shutdown()
+
+	// The UDP server on the same port only returns truncated answers.
+	var udpQueries int32
+	udpServer, _, err := runLocalDNSTestServer("udp", addr, func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(&udpQueries, 1)
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Truncated = true
+		w.WriteMsg(m)
+	})
+	if err != nil {
+		t.Fatalf("Failed to start test server: %v", err)
+	}
+	defer udpServer.Shutdown()
+
+	in, err := dnsQuery("example.com.", dns.TypeTXT, []string{addr}, true)
+	if err != nil {
+		t.Fatalf("dnsQuery error: got %v, want nil", err)
+	}
+	if len(in.Answer) != 1 || strings.Join(in.Answer[0].(*dns.TXT).Txt, "") != "over tcp" {
+		t.Errorf("Expected the answer over TCP, got %v", in.Answer)
+	}
+	if n := atomic.LoadInt32(&udpQueries); n != 1 {
+		t.Errorf("Expected the query to be sent over UDP first, got %d UDP queries", n)
+	}
+}
+
+func TestDNSQueryTCP(t *testing.T) {
+	defer func(protocol DNSProtocol) { DNSQueryProtocol = protocol }(DNSQueryProtocol)
+	DNSQueryProtocol = TCPProtocol
+
+	server, addr, err := runLocalDNSTCPTestServer("127.0.0.1:0", serverHandlerTXT("over tcp"))
+	if err != nil {
+		t.Fatalf("Failed to start test server: %v", err)
+	}
+	defer server.Shutdown()
+
+	in, err := dnsQuery("example.com.", dns.TypeTXT, []string{addr}, true)
+	if err != nil {
+		t.Fatalf("dnsQuery error: got %v, want nil", err)
+	}
+	if len(in.Answer) != 1 {
+		t.Errorf("Expected one answer, got %v", in.Answer)
+	}
+}
+
+func TestDNSQueryDoH(t *testing.T) {
+	defer func(protocol DNSProtocol, url string) {
+		DNSQueryProtocol, DNSOverHTTPSURL = protocol, url
+	}(DNSQueryProtocol, DNSOverHTTPSURL)
+	DNSQueryProtocol = DoHProtocol
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != "POST" || r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		req := new(dns.Msg)
+		if err := req.Unpack(body); err != nil || req.Id != 0 {
+			http.Error(w, "invalid query", http.StatusBadRequest)
+			return
+		}
+
+		m := new(dns.Msg)
+		m.SetReply(req)
+		txt, _ := dns.NewRR(fmt.Sprintf("%s 120 IN TXT %q", req.Question[0].Name, "over https"))
+		m.Answer = []dns.RR{txt}
+		packed, _ := m.Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(packed)
+	}))
+	defer ts.Close()
+
+	if _, err := dnsQuery("example.com.", dns.TypeTXT, []string{"127.0.0.1:1"}, true); err == nil {
+		t.Error("Expected an error without a DNS over HTTPS URL")
+	}
+
+	DNSOverHTTPSURL = ts.URL
+	in, err := dnsQuery("example.com.", dns.TypeTXT, []string{"127.0.0.1:1"}, true)
+	if err != nil {
+		t.Fatalf("dnsQuery error: got %v, want nil", err)
+	}
+	if len(in.Answer) != 1 || strings.Join(in.Answer[0].(*dns.TXT).Txt, "") != "over https" {
+		t.Errorf("Expected the answer of the DNS over HTTPS resolver, got %v", in.Answer)
+	}
+
+	DNSOverHTTPSURL = ts.URL + "/missing"
+	if _, err := dnsQuery("example.com.", dns.TypeTXT, nil, true); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("Expected an error with the status of the resolver, got %v", err)
+	}
+}
+
 func TestPreCheckDNS(t *testing.T) {
 	ok, err := PreCheckDNS("acme-staging.api.letsencrypt.org", "fe01=")
 	if err != nil || !ok {
@@ -193,6 +538,61 @@ func TestCheckAuthoritativeNssErr(t *testing.T) {
 	}
 }
 
+func TestCheckAuthoritativeNssMixed(t *testing.T) {
+	good, goodAddr, err := runLocalDNSTestServer("udp", "127.0.0.1:0", serverHandlerTXT("expected"))
+	if err != nil {
+		t.Fatalf("Failed to start test server: %v", err)
+	}
+	defer good.Shutdown()
+	stale, staleAddr, err := runLocalDNSTestServer("udp", "127.0.0.1:0", serverHandlerTXT("stale"))
+	if err != nil {
+		t.Fatalf("Failed to start test server: %v", err)
+	}
+	defer stale.Shutdown()
+	missing, missingAddr, err := runLocalDNSTestServer("udp", "127.0.0.1:0", serverHandlerSOA("example.com."))
+	if err != nil {
+		t.Fatalf("Failed to start test server: %v", err)
+	}
+	defer missing.Shutdown()
+
+	tests := []struct {
+		nameservers []string
+		want        string
+	}{
+		{[]string{goodAddr}, ""},
+		{[]string{goodAddr, staleAddr}, "did not return the expected TXT record"},
+		{[]string{goodAddr, missingAddr}, "returned NXDOMAIN"},
+	}
+
+	for _, tt := range tests {
+		ok, err := checkAuthoritativeNss("_acme-challenge.example.com.", "expected", tt.nameservers)
+		if tt.want == "" && (!ok || err != nil) {
+			t.Errorf("%v: got (%t, %v); want (true, nil)", tt.nameservers, ok, err)
+		}
+		if tt.want != "" && (ok || err == nil || !strings.Contains(err.Error(), tt.want)) {
+			t.Errorf("%v: got (%t, %v); want an error with %q", tt.nameservers, ok, err, tt.want)
+		}
+	}
+}
+
+func TestCheckAuthoritativeTXTWithoutNameservers(t *testing.T) {
+	server, addr, err := runLocalDNSTestServer("udp", "127.0.0.1:0", serverHandlerSOA("example.com."))
+	if err != nil {
+		t.Fatalf("Failed to start test server: %v", err)
+	}
+	defer server.Shutdown()
+
+	defer func(nameservers []string) { RecursiveNameservers = nameservers }(RecursiveNameservers)
+	RecursiveNameservers = []string{addr}
+	ClearFqdnCache()
+
+	// The zone has no NS records, so there is no authoritative nameserver to ask.
+	ok, err := CheckAuthoritativeTXT("_acme-challenge.example.com.", "expected")
+	if ok || err == nil {
+		t.Errorf("got (%t, %v); want an error", ok, err)
+	}
+}
+
 func TestResolveConfServers(t *testing.T) {
 	for _, tt := range checkResolvConfServersTests {
 		result := getNameservers(tt.fixture, tt.defaults)
@@ -204,3 +604,371 @@ func TestResolveConfServers(t *testing.T) {
 		}
 	}
 }
+
+func TestSetRecursiveNameservers(t *testing.T) {
+	defer func(nameservers []string) { RecursiveNameservers = nameservers }(RecursiveNameservers)
+
+	tests := []struct {
+		input    []string
+		expected []string
+		error    string
+	}{
+		{[]string{"8.8.8.8:53", "8.8.4.4"}, []string{"8.8.8.8:53", "8.8.4.4:53"}, ""},
+		{[]string{" 1.1.1.1:5353 "}, []string{"1.1.1.1:5353"}, ""},
+		{[]string{"[2001:4860:4860::8888]:53", "2001:4860:4860::8844"}, []string{"[2001:4860:4860::8888]:53", "[2001:4860:4860::8844]:53"}, ""},
+		{[]string{"resolver.example.com"}, []string{"resolver.example.com:53"}, ""},
+		{[]string{}, nil, "No nameservers given"},
+		{[]string{"8.8.8.8:53", "8.8.8.8:dns"}, nil, "invalid port"},
+		{[]string{"8.8.8.8:70000"}, nil, "invalid port"},
+		{[]string{":53"}, nil, "neither an IP address nor a hostname"},
+		{[]string{"not a host"}, nil, "neither an IP address nor a hostname"},
+		{[]string{"https://dns.example.com/"}, nil, "Invalid nameserver"},
+	}
+
+	for _, tt := range tests {
+		RecursiveNameservers = []string{"127.0.0.1:53"}
+
+		err := SetRecursiveNameservers(tt.input)
+		if tt.error != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.error) {
+				t.Errorf("%q: expected error containing %q, got %v", tt.input, tt.error, err)
+			}
+			if !reflect.DeepEqual(RecursiveNameservers, []string{"127.0.0.1:53"}) {
+				t.Errorf("%q: expected nameservers to be left untouched on error, got %v", tt.input, RecursiveNameservers)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%q: expected no error, got %v", tt.input, err)
+		}
+		if !reflect.DeepEqual(RecursiveNameservers, tt.expected) {
+			t.Errorf("%q: expected %q, got %q", tt.input, tt.expected, RecursiveNameservers)
+		}
+	}
+}
+
+func TestFindZoneByFqdnIPFamily(t *testing.T) {
+	defer func() { DNSIPFamily = AnyIPFamily }()
+
+	v4, v4Addr, err := runLocalDNSTestServer("udp4", "127.0.0.1:0", serverHandlerSOA("example.com."))
+	if err != nil {
+		t.Fatalf("Failed to start IPv4 test server: %v", err)
+	}
+	defer v4.Shutdown()
+
+	v6, v6Addr, err := runLocalDNSTestServer("udp6", "[::1]:0", serverHandlerSOA("example.com."))
+	if err != nil {
+		t.Skipf("IPv6 loopback not available: %v", err)
+	}
+	defer v6.Shutdown()
+
+	tests := []struct {
+		family      IPFamily
+		nameservers []string
+		ok          bool
+	}{
+		{AnyIPFamily, []string{v4Addr}, true},
+		{AnyIPFamily, []string{v6Addr}, true},
+		{IPv4Only, []string{v4Addr}, true},
+		{IPv4Only, []string{v6Addr}, false},
+		{IPv6Only, []string{v6Addr}, true},
+		{IPv6Only, []string{v4Addr}, false},
+		{IPv4Only, []string{v6Addr, v4Addr}, true},
+		{IPv6Only, []string{v6Addr, v4Addr}, true},
+	}
+
+	for _, tt := range tests {
+		ClearFqdnCache()
+		DNSIPFamily = tt.family
+
+		zone, err := FindZoneByFqdn("_acme-challenge.example.com.", tt.nameservers)
+		if tt.ok && (err != nil || zone != "example.com.") {
+			t.Errorf("family %q via %v: got (%q, %v); want example.com.", tt.family, tt.nameservers, zone, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("family %q via %v: got %q; want error", tt.family, tt.nameservers, zone)
+		}
+	}
+}
+
+func TestFindZoneByFqdnServfailOnOneFamily(t *testing.T) {
+	defer func() { DNSIPFamily = AnyIPFamily }()
+
+	v4, v4Addr, err := runLocalDNSTestServer("udp4", "127.0.0.1:0", serverHandlerServfail)
+	if err != nil {
+		t.Fatalf("Failed to start IPv4 test server: %v", err)
+	}
+	defer v4.Shutdown()
+
+	v6, v6Addr, err := runLocalDNSTestServer("udp6", "[::1]:0", serverHandlerSOA("example.com."))
+	if err != nil {
+		t.Skipf("IPv6 loopback not available: %v", err)
+	}
+	defer v6.Shutdown()
+
+	ClearFqdnCache()
+	DNSIPFamily = IPv4Only
+	if _, err := FindZoneByFqdn("_acme-challenge.example.com.", []string{v4Addr, v6Addr}); err == nil {
+		t.Error("Expected SERVFAIL over IPv4 to return an error")
+	}
+
+	ClearFqdnCache()
+	DNSIPFamily = IPv6Only
+	zone, err := FindZoneByFqdn("_acme-challenge.example.com.", []string{v4Addr, v6Addr})
+	if err != nil {
+		t.Fatalf("Expected lookup over IPv6 to succeed, got %v", err)
+	}
+	if zone != "example.com." {
+		t.Errorf("Expected zone example.com., got %s", zone)
+	}
+}
+
+func TestFindZoneByFqdnUnresponsiveResolver(t *testing.T) {
+	defer func(timeout time.Duration) { DNSTimeout = timeout }(DNSTimeout)
+	DNSTimeout = 200 * time.Millisecond
+
+	// A resolver that accepts queries but never answers them.
+	dead, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start unresponsive resolver: %v", err)
+	}
+	defer dead.Close()
+	var deadQueries int32
+	go func() {
+		buf := make([]byte, dns.MaxMsgSize)
+		for {
+			if _, _, err := dead.ReadFrom(buf); err != nil {
+				return
+			}
+			atomic.AddInt32(&deadQueries, 1)
+		}
+	}()
+
+	live, liveAddr, err := runLocalDNSTestServer("udp", "127.0.0.1:0", serverHandlerSOA("example.com."))
+	if err != nil {
+		t.Fatalf("Failed to start test server: %v", err)
+	}
+	defer live.Shutdown()
+
+	ClearFqdnCache()
+	start := time.Now()
+	_, err = FindZoneByFqdn("_acme-challenge.example.com.", []string{dead.LocalAddr().String()})
+	if err == nil {
+		t.Error("Expected an unresponsive resolver to return an error")
+	}
+	// One query and one retry, each bounded by DNSTimeout.
+	if elapsed := time.Since(start); elapsed > 4*DNSTimeout {
+		t.Errorf("Expected the lookup to give up within %s, took %s", 4*DNSTimeout, elapsed)
+	}
+
+	// The unresponsive resolver is tried first, then the next one answers.
+	ClearFqdnCache()
+	atomic.StoreInt32(&deadQueries, 0)
+	start = time.Now()
+	zone, err := FindZoneByFqdn("_acme-challenge.example.com.", []string{dead.LocalAddr().String(), liveAddr})
+	if err != nil {
+		t.Fatalf("Expected the lookup to fall back to the next resolver, got %v", err)
+	}
+	if n := atomic.LoadInt32(&deadQueries); n == 0 {
+		t.Error("Expected the unresponsive resolver to be queried first")
+	}
+	if zone != "example.com." {
+		t.Errorf("Expected zone example.com., got %s", zone)
+	}
+	if elapsed := time.Since(start); elapsed > 8*DNSTimeout {
+		t.Errorf("Expected the fallback within %s, took %s", 8*DNSTimeout, elapsed)
+	}
+}
+
+func TestFindZoneByFqdnCache(t *testing.T) {
+	var mu sync.Mutex
+	var queries []string
+	soa := serverHandlerSOA("example.com.")
+	server, addr, err := runLocalDNSTestServer("udp", "127.0.0.1:0", func(w dns.ResponseWriter, req *dns.Msg) {
+		mu.Lock()
+		queries = append(queries, req.Question[0].Name)
+		mu.Unlock()
+		soa(w, req)
+	})
+	if err != nil {
+		t.Fatalf("Failed to start test server: %v", err)
+	}
+	defer server.Shutdown()
+
+	lookup := func(fqdn string) []string {
+		mu.Lock()
+		queries = nil
+		mu.Unlock()
+
+		zone, err := FindZoneByFqdn(fqdn, []string{addr})
+		if err != nil {
+			t.Fatalf("FindZoneByFqdn failed for %s: %v", fqdn, err)
+		}
+		if zone != "example.com." {
+			t.Errorf("%s: got %s; want example.com.", fqdn, zone)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		return queries
+	}
+
+	ClearFqdnCache()
+
+	if got := lookup("_acme-challenge.www.example.com."); len(got) != 3 {
+		t.Errorf("Expected the first lookup to query every label, got %v", got)
+	}
+	if got := lookup("_acme-challenge.www.example.com."); len(got) != 0 {
+		t.Errorf("Expected a repeated lookup to be served from the cache, got %v", got)
+	}
+	// The apex is cached as well, so a sibling only needs its own labels queried.
+	if got := lookup("_acme-challenge.mail.example.com."); !reflect.DeepEqual(got, []string{"_acme-challenge.mail.example.com.", "mail.example.com."}) {
+		t.Errorf("Expected the apex of a sibling to be served from the cache, got %v", got)
+	}
+
+	ClearFqdnCache()
+	lookup("_acme-challenge.www.example.com.")
+	if got := lookup("_acme-challenge.www.example.com."); len(got) != 0 {
+		t.Errorf("Expected a lookup after ClearFqdnCache to be cached again, got %v", got)
+	}
+
+	// Expired entries are looked up again.
+	defer func(ttl time.Duration) { zoneCacheTTL = ttl }(zoneCacheTTL)
+	zoneCacheTTL = -time.Second
+	ClearFqdnCache()
+	lookup("_acme-challenge.www.example.com.")
+	if got := lookup("_acme-challenge.www.example.com."); len(got) != 3 {
+		t.Errorf("Expected an expired entry to be looked up again, got %v", got)
+	}
+}
+
+func TestFindZoneByFqdnCacheConcurrent(t *testing.T) {
+	server, addr, err := runLocalDNSTestServer("udp", "127.0.0.1:0", serverHandlerSOA("example.com."))
+	if err != nil {
+		t.Fatalf("Failed to start test server: %v", err)
+	}
+	defer server.Shutdown()
+
+	ClearFqdnCache()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			fqdn := fmt.Sprintf("_acme-challenge.host%d.example.com.", i%3)
+			if zone, err := FindZoneByFqdn(fqdn, []string{addr}); err != nil || zone != "example.com." {
+				t.Errorf("%s: got (%q, %v); want example.com.", fqdn, zone, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+// runLocalDNSTestServer starts a DNS server on the given network and address
+// which answers every query using handler.
+func runLocalDNSTestServer(network, listenAddr string, handler dns.HandlerFunc) (*dns.Server, string, error) {
+	pc, err := net.ListenPacket(network, listenAddr)
+	if err != nil {
+		return nil, "", err
+	}
+	server := &dns.Server{PacketConn: pc, Handler: handler, ReadTimeout: time.Hour, WriteTimeout: time.Hour}
+
+	waitLock := sync.Mutex{}
+	waitLock.Lock()
+	server.NotifyStartedFunc = waitLock.Unlock
+
+	go func() {
+		server.ActivateAndServe()
+		pc.Close()
+	}()
+
+	waitLock.Lock()
+	return server, pc.LocalAddr().String(), nil
+}
+
+// runLocalDNSTCPTestServer is like runLocalDNSTestServer, except that the
+// server answers over TCP.
+func runLocalDNSTCPTestServer(listenAddr string, handler dns.HandlerFunc) (*dns.Server, string, error) {
+	l, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return nil, "", err
+	}
+	server := &dns.Server{Listener: l, Handler: handler, ReadTimeout: time.Hour, WriteTimeout: time.Hour}
+
+	waitLock := sync.Mutex{}
+	waitLock.Lock()
+	server.NotifyStartedFunc = waitLock.Unlock
+
+	go func() {
+		server.ActivateAndServe()
+		l.Close()
+	}()
+
+	waitLock.Lock()
+	return server, l.Addr().String(), nil
+}
+
+// serverHandlerSOA returns a handler that answers SOA queries for zone with a
+// SOA record and everything else with NXDOMAIN.
+func serverHandlerSOA(zone string) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		if req.Question[0].Qtype == dns.TypeSOA && req.Question[0].Name == zone {
+			soa, _ := dns.NewRR(fmt.Sprintf("%s 120 IN SOA ns1.%s admin.%s 2016022801 28800 7200 2419200 1200", zone, zone, zone))
+			m.Answer = []dns.RR{soa}
+		} else {
+			m.Rcode = dns.RcodeNameError
+		}
+		w.WriteMsg(m)
+	}
+}
+
+// serverHandlerTXT returns a handler that answers every query with a TXT
+// record with value.
+func serverHandlerTXT(value string) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		txt, _ := dns.NewRR(fmt.Sprintf("%s 120 IN TXT %q", req.Question[0].Name, value))
+		m.Answer = []dns.RR{txt}
+		w.WriteMsg(m)
+	}
+}
+
+func serverHandlerServfail(w dns.ResponseWriter, req *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetRcode(req, dns.RcodeServerFailure)
+	w.WriteMsg(m)
+}
+
+// contextProvider is a ChallengeProviderWithContext that records how
+// it was called. Its long Timeout keeps a solve polling until cancelled.
+type contextProvider struct {
+	presentCtx context.Context
+	cleanedUp  bool
+}
+
+func (p *contextProvider) Present(domain, token, keyAuth string) error {
+	return errors.New("Present called instead of PresentContext")
+}
+
+func (p *contextProvider) CleanUp(domain, token, keyAuth string) error {
+	return errors.New("CleanUp called instead of CleanUpContext")
+}
+
+func (p *contextProvider) PresentContext(ctx context.Context, domain, token, keyAuth string) error {
+	p.presentCtx = ctx
+	return nil
+}
+
+func (p *contextProvider) CleanUpContext(ctx context.Context, domain, token, keyAuth string) error {
+	p.cleanedUp = true
+	return nil
+}
+
+func (p *contextProvider) Timeout() (timeout, interval time.Duration) {
+	return time.Minute, 10 * time.Millisecond
+}
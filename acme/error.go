@@ -2,10 +2,12 @@ package acme
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"strings"
+	"time"
 )
 
 const (
@@ -13,6 +15,12 @@ const (
 	invalidNonceError = "JWS has invalid anti-replay nonce"
 )
 
+// ErrEABRequired is returned when registering without an external account
+// binding at a CA whose directory announces that it only accepts accounts
+// bound to an external account. Use RegisterAccountWithEAB with the
+// credentials the CA provides instead.
+var ErrEABRequired = errors.New("acme: the CA requires an external account binding; register with RegisterAccountWithEAB")
+
 // RemoteError is the base type for all errors specific to the ACME protocol.
 type RemoteError struct {
 	StatusCode int    `json:"status,omitempty"`
@@ -37,6 +45,29 @@ type NonceError struct {
 	RemoteError
 }
 
+// RateLimitError represents the error which is returned if the server
+// rate limited a request and asked to retry it after a longer time than
+// MaxRetryAfter.
+type RateLimitError struct {
+	RemoteError
+	RetryAfter time.Duration
+}
+
+func (e RateLimitError) Error() string {
+	return fmt.Sprintf("%s - retry after %s", e.RemoteError.Error(), e.RetryAfter)
+}
+
+// TOSChangedError is returned by RegisterAgreeingToTOS if the terms of
+// service of the CA are no longer the ones the user accepted.
+type TOSChangedError struct {
+	Accepted string
+	Current  string
+}
+
+func (e TOSChangedError) Error() string {
+	return fmt.Sprintf("acme: the terms of service changed from %s to %s; they must be accepted again", e.Accepted, e.Current)
+}
+
 type domainError struct {
 	Domain string
 	Error  error
@@ -82,7 +113,7 @@ func handleHTTPError(resp *http.Response) error {
 		return TOSError{errorDetail}
 	}
 
-	if errorDetail.StatusCode == http.StatusBadRequest && strings.HasPrefix(errorDetail.Detail, invalidNonceError) {
+	if errorDetail.StatusCode == http.StatusBadRequest && (strings.HasPrefix(errorDetail.Detail, invalidNonceError) || strings.HasSuffix(errorDetail.Type, ":badNonce")) {
 		return NonceError{errorDetail}
 	}
 
@@ -1,21 +1,49 @@
 package acme
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"os"
+	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 // UserAgent (if non-empty) will be tacked onto the User-Agent string in requests.
 var UserAgent string
 
-// HTTPClient is an HTTP client with a reasonable timeout value.
+const (
+	// caCertificatesEnvVar is a list of files, separated like PATH, with PEM
+	// encoded CA certificates to trust instead of the system's, e.g. the root
+	// of a private ACME CA.
+	caCertificatesEnvVar = "LEGO_CA_CERTIFICATES"
+
+	// caSystemCertPoolEnvVar, if true, adds the certificates of
+	// caCertificatesEnvVar to the system's instead of replacing them.
+	caSystemCertPoolEnvVar = "LEGO_CA_SYSTEM_CERT_POOL"
+)
+
+// caCertPool holds the CA certificates set with LEGO_CA_CERTIFICATES once
+// CertPool has read them.
+var (
+	caCertPoolOnce sync.Once
+	caCertPool     *x509.CertPool
+	caCertPoolErr  error
+)
+
+// HTTPClient is an HTTP client with a reasonable timeout value. Once CertPool
+// has been called, which NewClient does, it trusts the CA certificates it
+// returns.
 var HTTPClient = http.Client{
 	Transport: &http.Transport{
 		Dial: (&net.Dialer{
@@ -25,9 +53,67 @@ var HTTPClient = http.Client{
 		TLSHandshakeTimeout:   15 * time.Second,
 		ResponseHeaderTimeout: 15 * time.Second,
 		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig:       &tls.Config{},
 	},
 }
 
+// CertPool returns the CA certificates to trust for TLS connections, read
+// from the files in LEGO_CA_CERTIFICATES. If LEGO_CA_SYSTEM_CERT_POOL is
+// true, they are added to the system's certificates. It returns nil, i.e.
+// the system's certificates, if LEGO_CA_CERTIFICATES is not set. DNS
+// providers for self-hosted APIs use it as well.
+//
+// The files are only read by the first call. An unreadable bundle is a
+// configuration error that must not silently fall back to the system's
+// certificates, so it is returned by this and every later call.
+func CertPool() (*x509.CertPool, error) {
+	caCertPoolOnce.Do(func() {
+		caCertPool, caCertPoolErr = newCertPool(os.Getenv(caCertificatesEnvVar), os.Getenv(caSystemCertPoolEnvVar))
+		if caCertPoolErr != nil {
+			caCertPoolErr = fmt.Errorf("acme: invalid %s: %v", caCertificatesEnvVar, caCertPoolErr)
+			return
+		}
+		if t, ok := HTTPClient.Transport.(*http.Transport); ok && t.TLSClientConfig != nil && t.TLSClientConfig.RootCAs == nil {
+			t.TLSClientConfig.RootCAs = caCertPool
+		}
+	})
+	return caCertPool, caCertPoolErr
+}
+
+// newCertPool returns a pool with the certificates in the files listed in
+// paths, starting from the system's certificates if useSystem parses as true.
+// It returns nil if paths is empty.
+func newCertPool(paths, useSystem string) (*x509.CertPool, error) {
+	if paths == "" {
+		return nil, nil
+	}
+
+	pool := x509.NewCertPool()
+	if ok, _ := strconv.ParseBool(useSystem); ok {
+		systemPool, err := x509.SystemCertPool()
+		if err != nil {
+			return nil, err
+		}
+		pool = systemPool
+	}
+
+	for _, path := range filepath.SplitList(paths) {
+		bundle, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(bundle) {
+			return nil, fmt.Errorf("no PEM encoded certificates in %s", path)
+		}
+	}
+	return pool, nil
+}
+
+// MaxRetryAfter is the longest wait requested by the Retry-After header
+// of a 429 or 503 response that is honoured before retrying the request
+// once. Longer waits fail with a RateLimitError.
+var MaxRetryAfter = 60 * time.Second
+
 const (
 	// defaultGoUserAgent is the Go HTTP package user agent string. Too
 	// bad it isn't exported. If it changes, we should update it here, too.
@@ -81,8 +167,9 @@ func httpGet(url string) (resp *http.Response, err error) {
 }
 
 // getJSON performs an HTTP GET request and parses the response body
-// as JSON, into the provided respBody object.
-func getJSON(uri string, respBody interface{}) (http.Header, error) {
+// as JSON, into the provided respBody object. A Retry-After date is
+// measured with clock, or the system clock if it is nil.
+func getJSON(uri string, respBody interface{}, clock Clock) (http.Header, error) {
 	resp, err := httpGet(uri)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get json %q: %v", uri, err)
@@ -90,66 +177,129 @@ func getJSON(uri string, respBody interface{}) (http.Header, error) {
 	defer resp.Body.Close()
 
 	if resp.StatusCode >= http.StatusBadRequest {
-		return resp.Header, handleHTTPError(resp)
+		err := handleHTTPError(resp)
+		if err = waitRetryAfter(resp, err, clockNow(clock)); err != nil {
+			return resp.Header, err
+		}
+
+		retryResp, err := httpGet(uri)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get json %q: %v", uri, err)
+		}
+		defer retryResp.Body.Close()
+
+		if retryResp.StatusCode >= http.StatusBadRequest {
+			return retryResp.Header, handleHTTPError(retryResp)
+		}
+
+		return retryResp.Header, json.NewDecoder(retryResp.Body).Decode(respBody)
 	}
 
 	return resp.Header, json.NewDecoder(resp.Body).Decode(respBody)
 }
 
+// maxBadNonceRetries is how often postJSON signs a request again with a
+// fresh nonce after the server rejected the nonce.
+const maxBadNonceRetries = 3
+
 // postJSON performs an HTTP POST request and parses the response body
-// as JSON, into the provided respBody object.
+// as JSON, into the provided respBody object. A request whose nonce the
+// server rejects is signed again with a fresh nonce up to maxBadNonceRetries
+// times, and a request the server asks to back off briefly is retried once.
 func postJSON(j *jws, uri string, reqBody, respBody interface{}) (http.Header, error) {
 	jsonBytes, err := json.Marshal(reqBody)
 	if err != nil {
 		return nil, errors.New("Failed to marshal network message...")
 	}
 
-	resp, err := j.post(uri, jsonBytes)
-	if err != nil {
-		return nil, fmt.Errorf("Failed to post JWS message. -> %v", err)
-	}
-
-	defer resp.Body.Close()
-
-	if resp.StatusCode >= http.StatusBadRequest {
-
-		err := handleHTTPError(resp)
-
-		switch err.(type) {
+	var nonceRetries int
+	var retriedAfter bool
+	for {
+		resp, err := j.post(uri, jsonBytes)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to post JWS message. -> %v", err)
+		}
 
-		case NonceError:
+		if resp.StatusCode < http.StatusBadRequest {
+			defer resp.Body.Close()
+			if respBody == nil {
+				return resp.Header, nil
+			}
+			return resp.Header, json.NewDecoder(resp.Body).Decode(respBody)
+		}
 
-			// Retry once if the nonce was invalidated
+		err = handleHTTPError(resp)
+		resp.Body.Close()
 
-			retryResp, err := j.post(uri, jsonBytes)
-			if err != nil {
-				return nil, fmt.Errorf("Failed to post JWS message. -> %v", err)
+		// j.post has kept the fresh nonce of the response for the retry.
+		if _, ok := err.(NonceError); ok {
+			if nonceRetries >= maxBadNonceRetries {
+				return resp.Header, err
 			}
+			nonceRetries++
+			continue
+		}
 
-			defer retryResp.Body.Close()
+		if retriedAfter {
+			return resp.Header, err
+		}
+		if err = waitRetryAfter(resp, err, j.now()); err != nil {
+			return resp.Header, err
+		}
+		retriedAfter = true
+	}
+}
 
-			if retryResp.StatusCode >= http.StatusBadRequest {
-				return retryResp.Header, handleHTTPError(retryResp)
-			}
+// waitRetryAfter waits out the Retry-After header of a rate limited (429) or
+// unavailable (503) response, so that the request can be retried once. It
+// returns err unchanged if resp does not ask for a retry, and a RateLimitError
+// if the requested wait exceeds MaxRetryAfter. A Retry-After date is measured
+// from now.
+func waitRetryAfter(resp *http.Response, err error, now time.Time) error {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return err
+	}
 
-			if respBody == nil {
-				return retryResp.Header, nil
-			}
+	wait, ok := parseRetryAfter(resp.Header.Get("Retry-After"), now)
+	if !ok {
+		return err
+	}
 
-			return retryResp.Header, json.NewDecoder(retryResp.Body).Decode(respBody)
+	if wait > MaxRetryAfter {
+		remoteErr, _ := err.(RemoteError)
+		remoteErr.StatusCode = resp.StatusCode
+		return RateLimitError{RemoteError: remoteErr, RetryAfter: wait}
+	}
 
-		default:
-			return resp.Header, err
+	logf("[INFO] acme: Server responded with status %d; retrying after %s", resp.StatusCode, wait)
+	time.Sleep(backoff(wait, 0))
+	return nil
+}
 
-		}
+// parseRetryAfter parses the value of a Retry-After header, which is
+// either a number of seconds or an HTTP date, measured from now.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
 
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
 	}
 
-	if respBody == nil {
-		return resp.Header, nil
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
 	}
 
-	return resp.Header, json.NewDecoder(resp.Body).Decode(respBody)
+	wait := date.Sub(now)
+	if wait < 0 {
+		wait = 0
+	}
+	return wait, true
 }
 
 // userAgent builds and returns the User-Agent string to use in requests.
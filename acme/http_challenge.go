@@ -1,13 +1,14 @@
 package acme
 
 import (
+	"context"
 	"fmt"
-	"log"
 )
 
 type httpChallenge struct {
 	jws      *jws
 	validate validateFunc
+	tracker  *challengeTracker
 	provider ChallengeProvider
 }
 
@@ -16,7 +17,7 @@ func HTTP01ChallengePath(token string) string {
 	return "/.well-known/acme-challenge/" + token
 }
 
-func (s *httpChallenge) Solve(chlng challenge, domain string) error {
+func (s *httpChallenge) Solve(ctx context.Context, chlng challenge, domain string) error {
 
 	logf("[INFO][%s] acme: Trying to solve HTTP-01", domain)
 
@@ -26,16 +27,20 @@ func (s *httpChallenge) Solve(chlng challenge, domain string) error {
 		return err
 	}
 
-	err = s.provider.Present(domain, chlng.Token, keyAuth)
+	s.tracker.add(domain, chlng)
+	defer s.tracker.remove(domain, chlng.Token)
+
+	err = presentChallenge(ctx, s.provider, domain, chlng.Token, keyAuth)
 	if err != nil {
 		return fmt.Errorf("[%s] error presenting token: %v", domain, err)
 	}
+	s.tracker.presented(domain, chlng.Token)
 	defer func() {
-		err := s.provider.CleanUp(domain, chlng.Token, keyAuth)
+		err := cleanUpChallenge(s.provider, domain, chlng.Token, keyAuth)
 		if err != nil {
-			log.Printf("[%s] error cleaning up: %v", domain, err)
+			logf("[%s] error cleaning up: %v", domain, err)
 		}
 	}()
 
-	return s.validate(s.jws, domain, chlng.URI, challenge{Resource: "challenge", Type: chlng.Type, Token: chlng.Token, KeyAuthorization: keyAuth})
+	return s.validate(ctx, s.jws, domain, chlng.URI, challenge{Resource: "challenge", Type: chlng.Type, Token: chlng.Token, KeyAuthorization: keyAuth})
 }
@@ -1,6 +1,7 @@
 package acme
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"net/http"
@@ -15,6 +16,7 @@ type HTTPProviderServer struct {
 	port     string
 	done     chan bool
 	listener net.Listener
+	server   *http.Server
 }
 
 // NewHTTPProviderServer creates a new HTTPProviderServer on the selected interface and port.
@@ -36,22 +38,49 @@ func (s *HTTPProviderServer) Present(domain, token, keyAuth string) error {
 		return fmt.Errorf("Could not start HTTP server for challenge -> %v", err)
 	}
 
+	s.server = &http.Server{
+		Handler: challengeHandler(domain, token, keyAuth),
+	}
+	// Once the server is shut down we don't want any lingering
+	// connections, so disable KeepAlives.
+	s.server.SetKeepAlivesEnabled(false)
+
 	s.done = make(chan bool)
-	go s.serve(domain, token, keyAuth)
+	go s.serve()
 	return nil
 }
 
 // CleanUp closes the HTTP server and removes the token from `HTTP01ChallengePath(token)`
 func (s *HTTPProviderServer) CleanUp(domain, token, keyAuth string) error {
-	if s.listener == nil {
+	return s.Shutdown(context.Background())
+}
+
+// Shutdown stops the HTTP server and releases its port. Requests that are
+// being served are allowed to complete until ctx is done, after which their
+// connections are closed.
+func (s *HTTPProviderServer) Shutdown(ctx context.Context) error {
+	if s.server == nil {
 		return nil
 	}
-	s.listener.Close()
+
+	err := s.server.Shutdown(ctx)
+	if err != nil {
+		s.server.Close()
+	}
 	<-s.done
-	return nil
+
+	s.server = nil
+	s.listener = nil
+	return err
+}
+
+func (s *HTTPProviderServer) serve() {
+	s.server.Serve(s.listener)
+	s.done <- true
 }
 
-func (s *HTTPProviderServer) serve(domain, token, keyAuth string) {
+// challengeHandler serves keyAuth at `HTTP01ChallengePath(token)` to requests for domain.
+func challengeHandler(domain, token, keyAuth string) http.Handler {
 	path := HTTP01ChallengePath(token)
 
 	// The handler validates the HOST header and request type.
@@ -64,16 +93,9 @@ func (s *HTTPProviderServer) serve(domain, token, keyAuth string) {
 			logf("[INFO][%s] Served key authentication", domain)
 		} else {
 			logf("[WARN] Received request for domain %s with method %s but the domain did not match any challenge. Please ensure your are passing the HOST header properly.", r.Host, r.Method)
-			w.Write([]byte("TEST"))
+			http.NotFound(w, r)
 		}
 	})
 
-	httpServer := &http.Server{
-		Handler: mux,
-	}
-	// Once httpServer is shut down we don't want any lingering
-	// connections, so disable KeepAlives.
-	httpServer.SetKeepAlivesEnabled(false)
-	httpServer.Serve(s.listener)
-	s.done <- true
+	return mux
 }
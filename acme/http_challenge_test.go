@@ -1,18 +1,22 @@
 package acme
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"io/ioutil"
+	"net"
+	"net/http"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestHTTPChallenge(t *testing.T) {
 	privKey, _ := rsa.GenerateKey(rand.Reader, 512)
 	j := &jws{privKey: privKey}
 	clientChallenge := challenge{Type: HTTP01, Token: "http1"}
-	mockValidate := func(_ *jws, _, _ string, chlng challenge) error {
+	mockValidate := func(_ context.Context, _ *jws, _, _ string, chlng challenge) error {
 		uri := "http://localhost:23457/.well-known/acme-challenge/" + chlng.Token
 		resp, err := httpGet(uri)
 		if err != nil {
@@ -38,7 +42,7 @@ func TestHTTPChallenge(t *testing.T) {
 	}
 	solver := &httpChallenge{jws: j, validate: mockValidate, provider: &HTTPProviderServer{port: "23457"}}
 
-	if err := solver.Solve(clientChallenge, "localhost:23457"); err != nil {
+	if err := solver.Solve(context.Background(), clientChallenge, "localhost:23457"); err != nil {
 		t.Errorf("Solve error: got %v, want nil", err)
 	}
 }
@@ -49,9 +53,101 @@ func TestHTTPChallengeInvalidPort(t *testing.T) {
 	clientChallenge := challenge{Type: HTTP01, Token: "http2"}
 	solver := &httpChallenge{jws: j, validate: stubValidate, provider: &HTTPProviderServer{port: "123456"}}
 
-	if err := solver.Solve(clientChallenge, "localhost:123456"); err == nil {
+	if err := solver.Solve(context.Background(), clientChallenge, "localhost:123456"); err == nil {
 		t.Errorf("Solve error: got %v, want error", err)
 	} else if want, want18 := "invalid port 123456", "123456: invalid port"; !strings.HasSuffix(err.Error(), want) && !strings.HasSuffix(err.Error(), want18) {
 		t.Errorf("Solve error: got %q, want suffix %q", err.Error(), want)
 	}
 }
+
+func TestHTTPProviderServerInterface(t *testing.T) {
+	provider := NewHTTPProviderServer("127.0.0.1", "0")
+	if err := provider.Present("127.0.0.1", "http3", "keyAuth3"); err != nil {
+		t.Fatalf("Present error: got %v, want nil", err)
+	}
+	defer provider.CleanUp("127.0.0.1", "http3", "keyAuth3")
+
+	addr := provider.listener.Addr().String()
+	if host, _, _ := net.SplitHostPort(addr); host != "127.0.0.1" {
+		t.Errorf("Expected the server to listen on 127.0.0.1 but it listens on %s", addr)
+	}
+
+	tsts := []struct {
+		name   string
+		host   string
+		path   string
+		status int
+		body   string
+	}{
+		{"token", "", HTTP01ChallengePath("http3"), http.StatusOK, "keyAuth3"},
+		{"unknown-token", "", HTTP01ChallengePath("other"), http.StatusNotFound, ""},
+		{"other-host", "example.com", HTTP01ChallengePath("http3"), http.StatusNotFound, ""},
+	}
+
+	for _, tst := range tsts {
+		req, err := http.NewRequest("GET", "http://"+addr+tst.path, nil)
+		if err != nil {
+			t.Fatalf("[%s] NewRequest error: %v", tst.name, err)
+		}
+		if tst.host != "" {
+			req.Host = tst.host
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Errorf("[%s] Get error: got %v, want nil", tst.name, err)
+			continue
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != tst.status {
+			t.Errorf("[%s] Get status: got %d, want %d", tst.name, resp.StatusCode, tst.status)
+		}
+		if tst.body != "" && string(body) != tst.body {
+			t.Errorf("[%s] Get body: got %q, want %q", tst.name, body, tst.body)
+		}
+	}
+}
+
+func TestHTTPProviderServerShutdown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not find a free port: %v", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	_, port, _ := net.SplitHostPort(addr)
+
+	provider := NewHTTPProviderServer("127.0.0.1", port)
+
+	// A long-lived process solves challenges on the same port again and again.
+	for i := 0; i < 2; i++ {
+		if err := provider.Present("127.0.0.1", "token", "keyAuth"); err != nil {
+			t.Fatalf("Present error: got %v, want nil", err)
+		}
+
+		resp, err := http.Get("http://" + addr + HTTP01ChallengePath("token"))
+		if err != nil {
+			t.Fatalf("Get error: got %v, want nil", err)
+		}
+		resp.Body.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		err = provider.Shutdown(ctx)
+		cancel()
+		if err != nil {
+			t.Fatalf("Shutdown error: got %v, want nil", err)
+		}
+	}
+
+	l, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("Expected the port to be released after Shutdown, got %v", err)
+	}
+	l.Close()
+
+	if err := provider.CleanUp("127.0.0.1", "token", "keyAuth"); err != nil {
+		t.Errorf("Expected CleanUp after Shutdown to be a no-op, got %v", err)
+	}
+}
@@ -1,10 +1,22 @@
 package acme
 
 import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"gopkg.in/square/go-jose.v1"
 )
 
 func TestHTTPHeadUserAgent(t *testing.T) {
@@ -73,28 +85,302 @@ func TestHTTPPostUserAgent(t *testing.T) {
 }
 
 func TestUserAgent(t *testing.T) {
-	ua := userAgent()
+	defer func(ua string) { UserAgent = ua }(UserAgent)
+
+	var ua string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ua = r.Header.Get("User-Agent")
+	}))
+	defer ts.Close()
 
-	if !strings.Contains(ua, defaultGoUserAgent) {
-		t.Errorf("Expected UA to contain %s, got '%s'", defaultGoUserAgent, ua)
+	tsts := []struct {
+		name   string
+		custom string
+		suffix string
+	}{
+		{"default", "", ourUserAgent},
+		// customize the UA by appending a value
+		{"custom", "MyApp/1.2.3", ourUserAgent + " MyApp/1.2.3"},
 	}
-	if !strings.Contains(ua, ourUserAgent) {
-		t.Errorf("Expected UA to contain %s, got '%s'", ourUserAgent, ua)
+
+	for _, tst := range tsts {
+		UserAgent = tst.custom
+		res, err := httpPost(ts.URL, "text/plain", strings.NewReader("falalalala"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if ua != userAgent() {
+			t.Errorf("[%s] Expected the request to send UA '%s', got '%s'", tst.name, userAgent(), ua)
+		}
+		if !strings.Contains(ua, defaultGoUserAgent) {
+			t.Errorf("[%s] Expected UA to contain %s, got '%s'", tst.name, defaultGoUserAgent, ua)
+		}
+		if !strings.HasSuffix(ua, tst.suffix) {
+			t.Errorf("[%s] Expected UA to end with '%s', got '%s'", tst.name, tst.suffix, ua)
+		}
 	}
-	if strings.HasSuffix(ua, " ") {
-		t.Errorf("UA should not have trailing spaces; got '%s'", ua)
+}
+
+func TestGetJSONRetryAfter(t *testing.T) {
+	tsts := []struct {
+		name       string
+		retryAfter string
+	}{
+		{"seconds", "1"},
+		{"http-date", time.Now().Add(time.Second).UTC().Format(http.TimeFormat)},
 	}
 
-	// customize the UA by appending a value
-	UserAgent = "MyApp/1.2.3"
-	ua = userAgent()
-	if !strings.Contains(ua, defaultGoUserAgent) {
-		t.Errorf("Expected UA to contain %s, got '%s'", defaultGoUserAgent, ua)
+	for _, tst := range tsts {
+		var requests int
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			if requests == 1 {
+				w.Header().Set("Retry-After", tst.retryAfter)
+				http.Error(w, "too many requests", http.StatusTooManyRequests)
+				return
+			}
+			writeJSONResponse(w, directory{NewRegURL: "http://example.com/new-reg"})
+		}))
+
+		var dir directory
+		if _, err := getJSON(ts.URL, &dir, nil); err != nil {
+			t.Errorf("[%s] getJSON error: got %v, want nil", tst.name, err)
+		}
+		if requests != 2 {
+			t.Errorf("[%s] Expected the request to be retried once but the server got %d requests", tst.name, requests)
+		}
+		if dir.NewRegURL != "http://example.com/new-reg" {
+			t.Errorf("[%s] Expected the retried response to be decoded, got %+v", tst.name, dir)
+		}
+		ts.Close()
 	}
-	if !strings.Contains(ua, ourUserAgent) {
-		t.Errorf("Expected UA to contain %s, got '%s'", ourUserAgent, ua)
+}
+
+func TestPostJSONRateLimitError(t *testing.T) {
+	defer func(d time.Duration) { MaxRetryAfter = d }(MaxRetryAfter)
+	MaxRetryAfter = time.Second
+
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Replay-Nonce", "12345")
+		if r.Method != "POST" {
+			return
+		}
+		requests++
+		w.Header().Set("Retry-After", "120")
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.WriteHeader(http.StatusTooManyRequests)
+		writeJSONResponse(w, RemoteError{Type: "urn:acme:error:rateLimited", Detail: "slow down"})
+	}))
+	defer ts.Close()
+
+	privKey, _ := rsa.GenerateKey(rand.Reader, 512)
+	j := &jws{privKey: privKey, directoryURL: ts.URL}
+
+	_, err := postJSON(j, ts.URL, map[string]string{"resource": "new-reg"}, nil)
+	rateLimitErr, ok := err.(RateLimitError)
+	if !ok {
+		t.Fatalf("Expected a RateLimitError but got %T: %v", err, err)
+	}
+	if rateLimitErr.RetryAfter != 120*time.Second {
+		t.Errorf("Expected RetryAfter to be 2m0s but was %s", rateLimitErr.RetryAfter)
+	}
+	if rateLimitErr.StatusCode != http.StatusTooManyRequests || rateLimitErr.Detail != "slow down" {
+		t.Errorf("Expected the server's problem in the error but got %+v", rateLimitErr.RemoteError)
+	}
+	if requests != 1 {
+		t.Errorf("Expected no retry beyond MaxRetryAfter but the server got %d requests", requests)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tsts := []struct {
+		value string
+		ok    bool
+		min   time.Duration
+		max   time.Duration
+	}{
+		{"", false, 0, 0},
+		{"garbage", false, 0, 0},
+		{"-5", false, 0, 0},
+		{"30", true, 30 * time.Second, 30 * time.Second},
+		{time.Now().Add(time.Minute).UTC().Format(http.TimeFormat), true, 58 * time.Second, time.Minute},
+		{time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat), true, 0, 0},
+	}
+
+	for _, tst := range tsts {
+		wait, ok := parseRetryAfter(tst.value, time.Now())
+		if ok != tst.ok || wait < tst.min || wait > tst.max {
+			t.Errorf("parseRetryAfter(%q): got %s, %t; want between %s and %s, %t", tst.value, wait, ok, tst.min, tst.max, tst.ok)
+		}
+	}
+}
+
+func TestPostJSONBadNonce(t *testing.T) {
+	tsts := []struct {
+		name      string
+		badNonces int
+		errType   string
+		requests  int
+		wantErr   bool
+	}{
+		{"badNonce once", 1, "urn:ietf:params:acme:error:badNonce", 2, false},
+		{"ACME v1 badNonce", 1, "urn:acme:error:badNonce", 2, false},
+		{"badNonce every time", 10, "urn:ietf:params:acme:error:badNonce", 1 + maxBadNonceRetries, true},
+		{"other error", 10, "urn:acme:error:unauthorized", 1, true},
+	}
+
+	privKey, _ := rsa.GenerateKey(rand.Reader, 512)
+	for _, tst := range tsts {
+		var nonces []string
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "POST" {
+				w.Header().Add("Replay-Nonce", "nonce-0")
+				return
+			}
+			body, _ := ioutil.ReadAll(r.Body)
+			signed, err := jose.ParseSigned(string(body))
+			if err != nil {
+				t.Errorf("[%s] Could not parse JWS: %v", tst.name, err)
+				return
+			}
+			nonces = append(nonces, signed.Signatures[0].Header.Nonce)
+			w.Header().Add("Replay-Nonce", fmt.Sprintf("nonce-%d", len(nonces)))
+			if len(nonces) <= tst.badNonces {
+				w.Header().Set("Content-Type", "application/problem+json")
+				w.WriteHeader(http.StatusBadRequest)
+				writeJSONResponse(w, RemoteError{Type: tst.errType, Detail: "bad request"})
+				return
+			}
+			writeJSONResponse(w, map[string]string{"status": "valid"})
+		}))
+
+		j := &jws{privKey: privKey, directoryURL: ts.URL}
+		var resp struct {
+			Status string `json:"status"`
+		}
+		_, err := postJSON(j, ts.URL, map[string]string{"resource": "new-reg"}, &resp)
+		if tst.wantErr && err == nil {
+			t.Errorf("[%s] Expected an error", tst.name)
+		}
+		if !tst.wantErr && (err != nil || resp.Status != "valid") {
+			t.Errorf("[%s] Expected the retried response to be decoded, got %+v, %v", tst.name, resp, err)
+		}
+		if len(nonces) != tst.requests {
+			t.Errorf("[%s] Expected %d requests but the server got %d", tst.name, tst.requests, len(nonces))
+		}
+		for i := 1; i < len(nonces); i++ {
+			if want := fmt.Sprintf("nonce-%d", i); nonces[i] != want {
+				t.Errorf("[%s] Expected retry %d to be signed with the fresh nonce %s, got %s", tst.name, i, want, nonces[i])
+			}
+		}
+		ts.Close()
+	}
+}
+
+func TestNewCertPool(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "lego-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// httptest.Server.Certificate needs Go 1.9.
+	serverCert, err := x509.ParseCertificate(ts.TLS.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(caFile, pemEncode(derCertificateBytes(serverCert.Raw)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	emptyFile := filepath.Join(dir, "empty.pem")
+	if err := ioutil.WriteFile(emptyFile, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(pool *x509.CertPool) error {
+		client := http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+		resp, err := client.Get(ts.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	for _, useSystem := range []string{"", "true"} {
+		pool, err := newCertPool(caFile, useSystem)
+		if err != nil {
+			t.Fatalf("newCertPool(%q) error: got %v, want nil", useSystem, err)
+		}
+		if err := get(pool); err != nil {
+			t.Errorf("Expected the custom root to be trusted with useSystem=%q, got %v", useSystem, err)
+		}
+	}
+
+	if pool, err := newCertPool("", ""); pool != nil || err != nil {
+		t.Errorf("Expected no pool without a bundle, got %v, %v", pool, err)
+	}
+	if err := get(nil); err == nil {
+		t.Error("Expected the test server not to be trusted by the system roots")
+	}
+
+	for _, paths := range []string{emptyFile, filepath.Join(dir, "missing.pem"), caFile + string(filepath.ListSeparator) + emptyFile} {
+		if _, err := newCertPool(paths, ""); err == nil {
+			t.Errorf("Expected an error for %s", paths)
+		}
+	}
+}
+
+func TestCertPool(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "lego-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	serverCert, err := x509.ParseCertificate(ts.TLS.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
 	}
-	if !strings.Contains(ua, UserAgent) {
-		t.Errorf("Expected custom UA to contain %s, got '%s'", UserAgent, ua)
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(caFile, pemEncode(derCertificateBytes(serverCert.Raw)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	transport := HTTPClient.Transport.(*http.Transport)
+	defer func() {
+		os.Unsetenv(caCertificatesEnvVar)
+		caCertPoolOnce = sync.Once{}
+		transport.TLSClientConfig.RootCAs = nil
+	}()
+
+	os.Setenv(caCertificatesEnvVar, filepath.Join(dir, "missing.pem"))
+	caCertPoolOnce = sync.Once{}
+	key, err := rsa.GenerateKey(rand.Reader, 512)
+	if err != nil {
+		t.Fatal("Could not generate test key:", err)
+	}
+	if _, err := NewClient(ts.URL, mockUser{email: "test@test.com", privatekey: key}, RSA2048); err == nil || !strings.Contains(err.Error(), caCertificatesEnvVar) {
+		t.Errorf("Expected NewClient to fail with an unreadable %s, got %v", caCertificatesEnvVar, err)
+	}
+
+	os.Setenv(caCertificatesEnvVar, caFile)
+	caCertPoolOnce = sync.Once{}
+	if pool, err := CertPool(); pool == nil || err != nil {
+		t.Fatalf("CertPool: got %v, %v; want a pool and nil", pool, err)
+	}
+	resp, err := HTTPClient.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("Expected HTTPClient to trust the loaded certificates, got %v", err)
 	}
+	resp.Body.Close()
 }
@@ -0,0 +1,101 @@
+package acme
+
+import (
+	"sort"
+	"sync"
+)
+
+// ChallengeInfo describes a challenge that a solver is working on.
+type ChallengeInfo struct {
+	Domain string
+	Type   Challenge
+	Token  string
+	// Presented is true once the provider presented the challenge and
+	// until it is cleaned up again.
+	Presented bool
+}
+
+// InFlightChallenges returns the challenges the solvers of the client are
+// working on right now, sorted by domain and token. The result is a copy and
+// can be used while the client keeps solving challenges.
+func (c *Client) InFlightChallenges() []ChallengeInfo {
+	return c.inFlight.snapshot()
+}
+
+// challengeTracker records the challenges the solvers of a client are
+// working on. A nil tracker records nothing.
+type challengeTracker struct {
+	mu         sync.Mutex
+	challenges map[string]map[string]*ChallengeInfo
+}
+
+func newChallengeTracker() *challengeTracker {
+	return &challengeTracker{challenges: make(map[string]map[string]*ChallengeInfo)}
+}
+
+// add records that the challenge with token is being solved for domain.
+func (t *challengeTracker) add(domain string, chlng challenge) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tokens, ok := t.challenges[domain]
+	if !ok {
+		tokens = make(map[string]*ChallengeInfo)
+		t.challenges[domain] = tokens
+	}
+	tokens[chlng.Token] = &ChallengeInfo{Domain: domain, Type: chlng.Type, Token: chlng.Token}
+}
+
+// presented marks the challenge with token for domain as presented.
+func (t *challengeTracker) presented(domain, token string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if info, ok := t.challenges[domain][token]; ok {
+		info.Presented = true
+	}
+}
+
+// remove forgets the challenge with token for domain.
+func (t *challengeTracker) remove(domain, token string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.challenges[domain], token)
+	if len(t.challenges[domain]) == 0 {
+		delete(t.challenges, domain)
+	}
+}
+
+// snapshot returns a copy of the recorded challenges, sorted by domain and
+// token.
+func (t *challengeTracker) snapshot() []ChallengeInfo {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var infos []ChallengeInfo
+	for _, tokens := range t.challenges {
+		for _, info := range tokens {
+			infos = append(infos, *info)
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Domain != infos[j].Domain {
+			return infos[i].Domain < infos[j].Domain
+		}
+		return infos[i].Token < infos[j].Token
+	})
+	return infos
+}
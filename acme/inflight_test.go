@@ -0,0 +1,84 @@
+package acme
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestInFlightChallengesSnapshot(t *testing.T) {
+	client := &Client{inFlight: newChallengeTracker()}
+	client.inFlight.add("www.example.com", challenge{Type: HTTP01, Token: "token2"})
+	client.inFlight.add("example.com", challenge{Type: DNS01, Token: "token1"})
+	client.inFlight.add("example.com", challenge{Type: HTTP01, Token: "token3"})
+	client.inFlight.presented("example.com", "token1")
+
+	want := []ChallengeInfo{
+		{Domain: "example.com", Type: DNS01, Token: "token1", Presented: true},
+		{Domain: "example.com", Type: HTTP01, Token: "token3"},
+		{Domain: "www.example.com", Type: HTTP01, Token: "token2"},
+	}
+	got := client.InFlightChallenges()
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Expected in-flight challenges %+v, got %+v", want, got)
+	}
+
+	got[1].Presented = true
+	if again := client.InFlightChallenges(); !reflect.DeepEqual(again, want) {
+		t.Errorf("Expected the snapshot to be a copy, got %+v after changing it", again)
+	}
+
+	client.inFlight.remove("example.com", "token1")
+	client.inFlight.remove("example.com", "token3")
+	client.inFlight.remove("www.example.com", "token2")
+	if got := client.InFlightChallenges(); len(got) != 0 {
+		t.Errorf("Expected no in-flight challenges after removing them, got %+v", got)
+	}
+}
+
+func TestInFlightChallengesWithoutTracker(t *testing.T) {
+	client := &Client{}
+	if got := client.InFlightChallenges(); got != nil {
+		t.Errorf("Expected no in-flight challenges, got %+v", got)
+	}
+}
+
+func TestInFlightChallengesDuringSolve(t *testing.T) {
+	privKey, _ := rsa.GenerateKey(rand.Reader, 512)
+	client := &Client{inFlight: newChallengeTracker()}
+
+	var during []ChallengeInfo
+	validate := func(ctx context.Context, j *jws, domain, uri string, chlng challenge) error {
+		during = client.InFlightChallenges()
+		return nil
+	}
+	solver := &httpChallenge{jws: &jws{privKey: privKey}, validate: validate, tracker: client.inFlight, provider: &recordingProvider{}}
+
+	if err := solver.Solve(context.Background(), challenge{Type: HTTP01, Token: "token"}, "example.com"); err != nil {
+		t.Fatalf("Solve error: got %v, want nil", err)
+	}
+
+	want := []ChallengeInfo{{Domain: "example.com", Type: HTTP01, Token: "token", Presented: true}}
+	if !reflect.DeepEqual(during, want) {
+		t.Errorf("Expected in-flight challenges %+v during validation, got %+v", want, during)
+	}
+	if got := client.InFlightChallenges(); len(got) != 0 {
+		t.Errorf("Expected no in-flight challenges after Solve, got %+v", got)
+	}
+}
+
+func TestInFlightChallengesPresentFailure(t *testing.T) {
+	privKey, _ := rsa.GenerateKey(rand.Reader, 512)
+	client := &Client{inFlight: newChallengeTracker()}
+	solver := &dnsChallenge{jws: &jws{privKey: privKey}, validate: stubValidate, tracker: client.inFlight, provider: &recordingProvider{err: errors.New("API unavailable")}}
+
+	if err := solver.Solve(context.Background(), challenge{Type: DNS01, Token: "token"}, "example.com"); err == nil {
+		t.Fatal("Solve error: got nil, want error")
+	}
+	if got := client.InFlightChallenges(); len(got) != 0 {
+		t.Errorf("Expected no in-flight challenges after a failed Present, got %+v", got)
+	}
+}
@@ -5,10 +5,17 @@ import (
 	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"sync"
+	"time"
 
 	"gopkg.in/square/go-jose.v1"
 )
@@ -17,6 +24,19 @@ type jws struct {
 	directoryURL string
 	privKey      crypto.PrivateKey
 	nonces       nonceManager
+
+	rateLimitMu sync.Mutex
+	rateLimit   *RateLimit
+
+	clock Clock
+}
+
+// now returns the current time of the clock set with Client.SetClock.
+func (j *jws) now() time.Time {
+	if j == nil {
+		return time.Now()
+	}
+	return clockNow(j.clock)
 }
 
 func keyAsJWK(key interface{}) *jose.JsonWebKey {
@@ -49,14 +69,107 @@ func (j *jws) post(url string, content []byte) (*http.Response, error) {
 	if nonceErr == nil {
 		j.nonces.Push(nonce)
 	}
+	j.recordRateLimit(url, resp)
 
 	return resp, nil
 }
 
 func (j *jws) signContent(content []byte) (*jose.JsonWebSignature, error) {
+	signer, err := newSigner(j.privKey)
+	if err != nil {
+		return nil, err
+	}
+	signer.SetNonceSource(j)
+
+	signed, err := signer.Sign(content)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to sign content -> %s", err.Error())
+	}
+	return signed, nil
+}
+
+// signInnerContent signs content with privKey for a JWS that is itself the
+// payload of another one, like the inner JWS of a key change. Its protected
+// header embeds the public key and the url it is posted to, but no nonce.
+// See RFC 8555 section 7.3.5. go-jose cannot add the url header, so the JWS
+// is put together here.
+func signInnerContent(url string, privKey crypto.PrivateKey, content []byte) ([]byte, error) {
+	signer, ok := privKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported account key type")
+	}
+	jwk := keyAsJWK(signer.Public())
+	if jwk == nil {
+		return nil, errors.New("unsupported account key type")
+	}
+	encJWK, err := jwk.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+
+	var alg string
+	var hash crypto.Hash
+	switch k := privKey.(type) {
+	case *rsa.PrivateKey:
+		alg, hash = "RS256", crypto.SHA256
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256():
+			alg, hash = "ES256", crypto.SHA256
+		case elliptic.P384():
+			alg, hash = "ES384", crypto.SHA384
+		default:
+			return nil, errors.New("unsupported account key type")
+		}
+	}
+
+	protected, err := json.Marshal(map[string]interface{}{"alg": alg, "jwk": json.RawMessage(encJWK), "url": url})
+	if err != nil {
+		return nil, err
+	}
 
+	encProtected := base64.RawURLEncoding.EncodeToString(protected)
+	encPayload := base64.RawURLEncoding.EncodeToString(content)
+
+	h := hash.New()
+	h.Write([]byte(encProtected + "." + encPayload))
+	sig, err := signDigest(privKey, hash, h.Sum(nil))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to sign content -> %s", err.Error())
+	}
+
+	return json.Marshal(map[string]string{
+		"protected": encProtected,
+		"payload":   encPayload,
+		"signature": base64.RawURLEncoding.EncodeToString(sig),
+	})
+}
+
+// signDigest signs digest with privKey in the form JWS expects: PKCS #1 v1.5
+// for RSA keys and the fixed size r || s for ECDSA keys.
+func signDigest(privKey crypto.PrivateKey, hash crypto.Hash, digest []byte) ([]byte, error) {
+	switch k := privKey.(type) {
+	case *rsa.PrivateKey:
+		return rsa.SignPKCS1v15(rand.Reader, k, hash, digest)
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest)
+		if err != nil {
+			return nil, err
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		sig := make([]byte, 2*size)
+		rBytes, sBytes := r.Bytes(), s.Bytes()
+		copy(sig[size-len(rBytes):size], rBytes)
+		copy(sig[2*size-len(sBytes):], sBytes)
+		return sig, nil
+	default:
+		return nil, errors.New("unsupported account key type")
+	}
+}
+
+func newSigner(privKey crypto.PrivateKey) (jose.Signer, error) {
 	var alg jose.SignatureAlgorithm
-	switch k := j.privKey.(type) {
+	switch k := privKey.(type) {
 	case *rsa.PrivateKey:
 		alg = jose.RS256
 	case *ecdsa.PrivateKey:
@@ -67,17 +180,46 @@ func (j *jws) signContent(content []byte) (*jose.JsonWebSignature, error) {
 		}
 	}
 
-	signer, err := jose.NewSigner(alg, j.privKey)
+	signer, err := jose.NewSigner(alg, privKey)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to create jose signer -> %s", err.Error())
 	}
-	signer.SetNonceSource(j)
+	return signer, nil
+}
 
-	signed, err := signer.Sign(content)
+// signEABContent returns the external account binding for the account
+// key privKey: a JWS over its public JWK, MACed with hmacKey using HS256.
+// See RFC 8555 section 7.3.4.
+func signEABContent(url, kid string, hmacKey []byte, privKey crypto.PrivateKey) ([]byte, error) {
+	signer, ok := privKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported account key type")
+	}
+	jwk := keyAsJWK(signer.Public())
+	if jwk == nil {
+		return nil, errors.New("unsupported account key type")
+	}
+	payload, err := jwk.MarshalJSON()
 	if err != nil {
-		return nil, fmt.Errorf("Failed to sign content -> %s", err.Error())
+		return nil, err
 	}
-	return signed, nil
+
+	protected, err := json.Marshal(map[string]string{"alg": "HS256", "kid": kid, "url": url})
+	if err != nil {
+		return nil, err
+	}
+
+	encProtected := base64.RawURLEncoding.EncodeToString(protected)
+	encPayload := base64.RawURLEncoding.EncodeToString(payload)
+
+	mac := hmac.New(sha256.New, hmacKey)
+	mac.Write([]byte(encProtected + "." + encPayload))
+
+	return json.Marshal(map[string]string{
+		"protected": encProtected,
+		"payload":   encPayload,
+		"signature": base64.RawURLEncoding.EncodeToString(mac.Sum(nil)),
+	})
 }
 
 func (j *jws) Nonce() (string, error) {
@@ -1,22 +1,30 @@
 package acme
 
 import (
+	"encoding/json"
 	"time"
 
 	"gopkg.in/square/go-jose.v1"
 )
 
 type directory struct {
-	NewAuthzURL   string `json:"new-authz"`
-	NewCertURL    string `json:"new-cert"`
-	NewRegURL     string `json:"new-reg"`
-	RevokeCertURL string `json:"revoke-cert"`
+	NewAuthzURL    string `json:"new-authz"`
+	NewCertURL     string `json:"new-cert"`
+	NewRegURL      string `json:"new-reg"`
+	RevokeCertURL  string `json:"revoke-cert"`
+	KeyChangeURL   string `json:"key-change"`
+	RenewalInfoURL string `json:"renewalInfo"`
+	Meta           struct {
+		TermsOfService          string `json:"terms-of-service"`
+		ExternalAccountRequired bool   `json:"externalAccountRequired"`
+	} `json:"meta"`
 }
 
 type registrationMessage struct {
-	Resource string   `json:"resource"`
-	Contact  []string `json:"contact"`
-	Delete   bool     `json:"delete,omitempty"`
+	Resource               string          `json:"resource"`
+	Contact                []string        `json:"contact"`
+	Delete                 bool            `json:"delete,omitempty"`
+	ExternalAccountBinding json.RawMessage `json:"externalAccountBinding,omitempty"`
 }
 
 // Registration is returned by the ACME server after the registration
@@ -88,9 +96,15 @@ type csrMessage struct {
 	Authorizations []string `json:"authorizations"`
 }
 
+type keyChangeMessage struct {
+	Account string           `json:"account"`
+	OldKey  *jose.JsonWebKey `json:"oldKey"`
+}
+
 type revokeCertMessage struct {
 	Resource    string `json:"resource"`
 	Certificate string `json:"certificate"`
+	Reason      int    `json:"reason,omitempty"`
 }
 
 type deactivateAuthMessage struct {
@@ -0,0 +1,91 @@
+package acme
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MultiProviderError is returned by MultiDNSProvider.Present if none of
+// its providers could present the challenge. It holds the error of each
+// provider, in order.
+type MultiProviderError []error
+
+func (e MultiProviderError) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = fmt.Sprintf("provider %d: %v", i, err)
+	}
+	return "All DNS providers failed: " + strings.Join(msgs, "; ")
+}
+
+// MultiDNSProvider implements ChallengeProvider for redundant DNS setups.
+// Present tries each of its providers in order until one succeeds, and
+// CleanUp cleans up with the provider that presented the challenge.
+type MultiDNSProvider struct {
+	providers []ChallengeProvider
+
+	mu        sync.Mutex
+	presented map[string]ChallengeProvider
+}
+
+// NewMultiDNSProvider returns a MultiDNSProvider trying the given providers
+// in order.
+func NewMultiDNSProvider(providers ...ChallengeProvider) *MultiDNSProvider {
+	return &MultiDNSProvider{providers: providers, presented: make(map[string]ChallengeProvider)}
+}
+
+// Present presents the challenge with the first provider that succeeds.
+func (m *MultiDNSProvider) Present(domain, token, keyAuth string) error {
+	var errs MultiProviderError
+	for _, provider := range m.providers {
+		err := provider.Present(domain, token, keyAuth)
+		if err == nil {
+			m.mu.Lock()
+			m.presented[domain+"|"+token] = provider
+			m.mu.Unlock()
+			return nil
+		}
+		errs = append(errs, err)
+	}
+
+	if len(errs) == 0 {
+		return fmt.Errorf("No DNS providers configured to present the challenge for %s", domain)
+	}
+	return errs
+}
+
+// CleanUp removes the challenge with the provider that presented it.
+func (m *MultiDNSProvider) CleanUp(domain, token, keyAuth string) error {
+	key := domain + "|" + token
+
+	m.mu.Lock()
+	provider, ok := m.presented[key]
+	delete(m.presented, key)
+	m.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("No DNS provider presented the challenge for %s", domain)
+	}
+	return provider.CleanUp(domain, token, keyAuth)
+}
+
+// Timeout returns the longest timeout and interval of its providers, so
+// that the DNS propagation check waits long enough for whichever one
+// presents the challenge.
+func (m *MultiDNSProvider) Timeout() (timeout, interval time.Duration) {
+	timeout, interval = 60*time.Second, 2*time.Second
+	for _, provider := range m.providers {
+		if p, ok := provider.(ChallengeProviderTimeout); ok {
+			t, i := p.Timeout()
+			if t > timeout {
+				timeout = t
+			}
+			if i > interval {
+				interval = i
+			}
+		}
+	}
+	return timeout, interval
+}
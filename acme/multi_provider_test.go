@@ -0,0 +1,71 @@
+package acme
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+type recordingProvider struct {
+	err        error
+	cleanUpErr error
+	timeout    time.Duration
+	present    []string
+	cleanUps   []string
+}
+
+func (p *recordingProvider) Present(domain, token, keyAuth string) error {
+	p.present = append(p.present, domain)
+	return p.err
+}
+
+func (p *recordingProvider) CleanUp(domain, token, keyAuth string) error {
+	p.cleanUps = append(p.cleanUps, domain)
+	return p.cleanUpErr
+}
+
+func (p *recordingProvider) Timeout() (timeout, interval time.Duration) {
+	return p.timeout, time.Second
+}
+
+func TestMultiDNSProviderFailover(t *testing.T) {
+	failing := &recordingProvider{err: errors.New("API unavailable")}
+	working := &recordingProvider{timeout: 5 * time.Minute}
+	provider := NewMultiDNSProvider(failing, working)
+
+	if err := provider.Present("example.com", "token", "keyAuth"); err != nil {
+		t.Fatalf("Present error: got %v, want nil", err)
+	}
+	if len(failing.present) != 1 || len(working.present) != 1 {
+		t.Errorf("Expected Present to try both providers once, got %d and %d calls", len(failing.present), len(working.present))
+	}
+
+	if err := provider.CleanUp("example.com", "token", "keyAuth"); err != nil {
+		t.Fatalf("CleanUp error: got %v, want nil", err)
+	}
+	if len(failing.cleanUps) != 0 || len(working.cleanUps) != 1 {
+		t.Errorf("Expected CleanUp to target only the presenting provider, got %d and %d calls", len(failing.cleanUps), len(working.cleanUps))
+	}
+
+	if err := provider.CleanUp("example.com", "token", "keyAuth"); err == nil {
+		t.Error("Expected a second CleanUp for the same challenge to fail")
+	}
+
+	if timeout, _ := provider.Timeout(); timeout != 5*time.Minute {
+		t.Errorf("Expected the longest provider timeout 5m0s but got %s", timeout)
+	}
+}
+
+func TestMultiDNSProviderAllFail(t *testing.T) {
+	errA, errB := errors.New("bad credentials"), errors.New("zone not found")
+	provider := NewMultiDNSProvider(&recordingProvider{err: errA}, &recordingProvider{err: errB})
+
+	err := provider.Present("example.com", "token", "keyAuth")
+	multiErr, ok := err.(MultiProviderError)
+	if !ok {
+		t.Fatalf("Expected a MultiProviderError but got %T: %v", err, err)
+	}
+	if len(multiErr) != 2 || multiErr[0] != errA || multiErr[1] != errB {
+		t.Errorf("Expected the errors of both providers in order but got %v", multiErr)
+	}
+}
@@ -0,0 +1,39 @@
+package acme
+
+import (
+	"crypto/rand"
+	"fmt"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// ToPKCS12 encodes the certificate, its issuer chain and its private key as
+// PKCS#12, the .pfx or .p12 file format read by Windows and Java. The password
+// may be empty. The file is laid out as OpenSSL's PKCS12_create does, with the
+// private key encrypted using 3DES and the certificates using RC2.
+func (c CertificateResource) ToPKCS12(password string) ([]byte, error) {
+	if len(c.PrivateKey) == 0 {
+		return nil, fmt.Errorf("[%s] Certificate resource has no private key", c.Domain)
+	}
+	privKey, err := ParsePrivateKeyPEM(c.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("[%s] %v", c.Domain, err)
+	}
+	leaf, err := c.Leaf()
+	if err != nil {
+		return nil, err
+	}
+	issuers, err := c.Issuers()
+	if err != nil {
+		return nil, err
+	}
+	if !publicKeyMatches(leaf, privKey) {
+		return nil, fmt.Errorf("[%s] Private key does not match the certificate", c.Domain)
+	}
+
+	pfx, err := pkcs12.Encode(rand.Reader, privKey, leaf, issuers, password)
+	if err != nil {
+		return nil, fmt.Errorf("[%s] %v", c.Domain, err)
+	}
+	return pfx, nil
+}
@@ -0,0 +1,134 @@
+package acme
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/pkcs12"
+)
+
+func TestCertificateResourceToPKCS12(t *testing.T) {
+	caKey, caCert, leafKey := newTestCA(t)
+	leaf := newTestLeaf(t, caKey, caCert, leafKey, time.Now().Add(time.Hour), nil)
+
+	cert := CertificateResource{
+		Domain:            "example.com",
+		Certificate:       pemEncode(derCertificateBytes(leaf.Raw)),
+		IssuerCertificate: pemEncode(derCertificateBytes(caCert.Raw)),
+		PrivateKey:        pemEncode(leafKey),
+	}
+
+	pfx, err := cert.ToPKCS12("s3cret")
+	if err != nil {
+		t.Fatalf("ToPKCS12 error: got %v, want nil", err)
+	}
+
+	if _, err := pkcs12.ToPEM(pfx, "wrong"); err != pkcs12.ErrIncorrectPassword {
+		t.Errorf("Expected %v for a wrong password, got %v", pkcs12.ErrIncorrectPassword, err)
+	}
+
+	blocks, err := pkcs12.ToPEM(pfx, "s3cret")
+	if err != nil {
+		t.Fatalf("Could not decode PKCS#12: %v", err)
+	}
+
+	var certs [][]byte
+	var key *pem.Block
+	for _, block := range blocks {
+		switch block.Type {
+		case "CERTIFICATE":
+			certs = append(certs, block.Bytes)
+		case "PRIVATE KEY":
+			key = block
+		}
+	}
+	if len(certs) != 2 || !bytes.Equal(certs[0], leaf.Raw) || !bytes.Equal(certs[1], caCert.Raw) {
+		t.Fatalf("Expected the leaf and the CA certificate, got %d certificates", len(certs))
+	}
+	if key == nil {
+		t.Fatal("Expected a private key")
+	}
+	if !bytes.Equal(key.Bytes, x509.MarshalPKCS1PrivateKey(leafKey)) {
+		t.Error("Expected the private key of the leaf")
+	}
+	if id := key.Headers["localKeyId"]; id == "" || blocks[0].Headers["localKeyId"] != id {
+		t.Errorf("Expected the leaf and the key to share a local key ID, got %q and %q", blocks[0].Headers["localKeyId"], id)
+	}
+}
+
+func TestCertificateResourceToPKCS12ECWithoutPassword(t *testing.T) {
+	caKey, caCert, _ := newTestCA(t)
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("Error generating private key:", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &leafKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal("Error generating leaf cert:", err)
+	}
+
+	cert := CertificateResource{
+		Domain:      "example.com",
+		Certificate: pemEncode(derCertificateBytes(der)),
+		PrivateKey:  pemEncode(leafKey),
+	}
+
+	pfx, err := cert.ToPKCS12("")
+	if err != nil {
+		t.Fatalf("ToPKCS12 error: got %v, want nil", err)
+	}
+
+	privKey, leaf, err := pkcs12.Decode(pfx, "")
+	if err != nil {
+		t.Fatalf("Could not decode PKCS#12: %v", err)
+	}
+	if !bytes.Equal(leaf.Raw, der) {
+		t.Error("Expected the leaf certificate")
+	}
+	ecKey, ok := privKey.(*ecdsa.PrivateKey)
+	if !ok || ecKey.D.Cmp(leafKey.D) != 0 {
+		t.Errorf("Expected the EC private key of the leaf, got %T", privKey)
+	}
+}
+
+func TestCertificateResourceToPKCS12Errors(t *testing.T) {
+	caKey, caCert, leafKey := newTestCA(t)
+	leaf := newTestLeaf(t, caKey, caCert, leafKey, time.Now().Add(time.Hour), nil)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal("Error generating private key:", err)
+	}
+
+	tests := []struct {
+		name     string
+		cert     CertificateResource
+		password string
+	}{
+		{"no private key", CertificateResource{Certificate: pemEncode(derCertificateBytes(leaf.Raw))}, ""},
+		{"other private key", CertificateResource{Certificate: pemEncode(derCertificateBytes(leaf.Raw)), PrivateKey: pemEncode(otherKey)}, ""},
+		{"no certificate", CertificateResource{PrivateKey: pemEncode(leafKey)}, ""},
+		{"password outside the BMP", CertificateResource{Certificate: pemEncode(derCertificateBytes(leaf.Raw)), PrivateKey: pemEncode(leafKey)}, "\U0001F512"},
+	}
+
+	for _, tt := range tests {
+		if _, err := tt.cert.ToPKCS12(tt.password); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+}
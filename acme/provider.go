@@ -1,6 +1,9 @@
 package acme
 
-import "time"
+import (
+	"context"
+	"time"
+)
 
 // ChallengeProvider enables implementing a custom challenge
 // provider. Present presents the solution to a challenge available to
@@ -26,3 +29,35 @@ type ChallengeProviderTimeout interface {
 	ChallengeProvider
 	Timeout() (timeout, interval time.Duration)
 }
+
+// ChallengeProviderWithContext allows for implementing a
+// ChallengeProvider whose work can be cancelled. If an implementor of
+// a ChallengeProvider provides PresentContext and CleanUpContext, the
+// acme package calls them instead of Present and CleanUp.
+//
+// CleanUpContext is not handed the context used for PresentContext;
+// it receives one that outlives a cancelled solve, so that anything
+// presented is still removed.
+type ChallengeProviderWithContext interface {
+	ChallengeProvider
+	PresentContext(ctx context.Context, domain, token, keyAuth string) error
+	CleanUpContext(ctx context.Context, domain, token, keyAuth string) error
+}
+
+// presentChallenge calls PresentContext if the provider supports it
+// and falls back to Present otherwise.
+func presentChallenge(ctx context.Context, p ChallengeProvider, domain, token, keyAuth string) error {
+	if pc, ok := p.(ChallengeProviderWithContext); ok {
+		return pc.PresentContext(ctx, domain, token, keyAuth)
+	}
+	return p.Present(domain, token, keyAuth)
+}
+
+// cleanUpChallenge calls CleanUpContext if the provider supports it
+// and falls back to CleanUp otherwise.
+func cleanUpChallenge(p ChallengeProvider, domain, token, keyAuth string) error {
+	if pc, ok := p.(ChallengeProviderWithContext); ok {
+		return pc.CleanUpContext(context.Background(), domain, token, keyAuth)
+	}
+	return p.CleanUp(domain, token, keyAuth)
+}
@@ -0,0 +1,91 @@
+package acme
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RateLimit is what the CA revealed about its rate limits in a response to a
+// signed request, so that automation can pace itself.
+type RateLimit struct {
+	// URL is the request the response was for.
+	URL string
+	// Limit is the X-RateLimit-Limit header, or -1 if the CA did not send it.
+	Limit int
+	// Remaining is the X-RateLimit-Remaining header, or -1 if the CA did
+	// not send it. If the request was rate limited without the header, it
+	// is 0.
+	Remaining int
+	// Reset is when the limit resets, from the X-RateLimit-Reset header or
+	// the Retry-After header of a rate limited request. It is zero if
+	// unknown.
+	Reset time.Time
+	// Limited is true if the request was rejected with 429 Too Many Requests.
+	Limited bool
+}
+
+// LastRateLimit returns the rate limit information of the most recent
+// response that had any, i.e. that carried X-RateLimit headers or was
+// rejected with 429 Too Many Requests. It returns false if there was none.
+func (c *Client) LastRateLimit() (RateLimit, bool) {
+	c.jws.rateLimitMu.Lock()
+	defer c.jws.rateLimitMu.Unlock()
+
+	if c.jws.rateLimit == nil {
+		return RateLimit{}, false
+	}
+	return *c.jws.rateLimit, true
+}
+
+// recordRateLimit keeps the rate limit information of resp, if it has any.
+func (j *jws) recordRateLimit(url string, resp *http.Response) {
+	rateLimit, ok := parseRateLimit(url, resp, j.now())
+	if !ok {
+		return
+	}
+
+	j.rateLimitMu.Lock()
+	j.rateLimit = &rateLimit
+	j.rateLimitMu.Unlock()
+}
+
+// parseRateLimit reads the rate limit information of resp. X-RateLimit-Reset
+// may be seconds since the epoch or, if smaller, seconds from now.
+func parseRateLimit(url string, resp *http.Response, now time.Time) (RateLimit, bool) {
+	rateLimit := RateLimit{
+		URL:       url,
+		Limit:     headerInt(resp.Header, "X-RateLimit-Limit"),
+		Remaining: headerInt(resp.Header, "X-RateLimit-Remaining"),
+		Limited:   resp.StatusCode == http.StatusTooManyRequests,
+	}
+
+	if reset := headerInt(resp.Header, "X-RateLimit-Reset"); reset >= 0 {
+		if epoch := time.Unix(int64(reset), 0); epoch.After(now.AddDate(-1, 0, 0)) {
+			rateLimit.Reset = epoch
+		} else {
+			rateLimit.Reset = now.Add(time.Duration(reset) * time.Second)
+		}
+	}
+
+	if rateLimit.Limited {
+		if rateLimit.Remaining < 0 {
+			rateLimit.Remaining = 0
+		}
+		if wait, ok := parseRetryAfter(resp.Header.Get("Retry-After"), now); ok && rateLimit.Reset.IsZero() {
+			rateLimit.Reset = now.Add(wait)
+		}
+	}
+
+	ok := rateLimit.Limited || rateLimit.Limit >= 0 || rateLimit.Remaining >= 0 || !rateLimit.Reset.IsZero()
+	return rateLimit, ok
+}
+
+// headerInt returns the non-negative integer in the header key, or -1.
+func headerInt(header http.Header, key string) int {
+	value, err := strconv.Atoi(header.Get(key))
+	if err != nil || value < 0 {
+		return -1
+	}
+	return value
+}
@@ -0,0 +1,119 @@
+package acme
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+
+	tests := []struct {
+		name   string
+		status int
+		header http.Header
+		ok     bool
+		want   RateLimit
+	}{
+		{
+			name:   "headers",
+			status: http.StatusCreated,
+			header: http.Header{"X-Ratelimit-Limit": {"300"}, "X-Ratelimit-Remaining": {"299"}, "X-Ratelimit-Reset": {"1500003600"}},
+			ok:     true,
+			want:   RateLimit{Limit: 300, Remaining: 299, Reset: now.Add(time.Hour)},
+		},
+		{
+			name:   "relative reset",
+			status: http.StatusCreated,
+			header: http.Header{"X-Ratelimit-Remaining": {"5"}, "X-Ratelimit-Reset": {"60"}},
+			ok:     true,
+			want:   RateLimit{Limit: -1, Remaining: 5, Reset: now.Add(time.Minute)},
+		},
+		{
+			name:   "429 without headers",
+			status: http.StatusTooManyRequests,
+			header: http.Header{"Retry-After": {"120"}},
+			ok:     true,
+			want:   RateLimit{Limit: -1, Remaining: 0, Reset: now.Add(2 * time.Minute), Limited: true},
+		},
+		{
+			name:   "429 with headers",
+			status: http.StatusTooManyRequests,
+			header: http.Header{"X-Ratelimit-Limit": {"20"}, "X-Ratelimit-Remaining": {"0"}, "Retry-After": {"120"}, "X-Ratelimit-Reset": {"30"}},
+			ok:     true,
+			want:   RateLimit{Limit: 20, Remaining: 0, Reset: now.Add(30 * time.Second), Limited: true},
+		},
+		{
+			name:   "no information",
+			status: http.StatusCreated,
+			header: http.Header{},
+		},
+	}
+
+	for _, tt := range tests {
+		got, ok := parseRateLimit("https://ca.example.com/acme/new-cert", &http.Response{StatusCode: tt.status, Header: tt.header}, now)
+		if ok != tt.ok {
+			t.Errorf("%s: expected ok to be %t", tt.name, tt.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		tt.want.URL = "https://ca.example.com/acme/new-cert"
+		if got != tt.want {
+			t.Errorf("%s: expected %+v, got %+v", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestLastRateLimit(t *testing.T) {
+	limited := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Replay-Nonce", "12345")
+		if r.Method != "POST" {
+			return
+		}
+		if limited {
+			w.Header().Set("Content-Type", "application/problem+json")
+			w.Header().Set("Retry-After", "3600")
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"type":"urn:acme:error:rateLimited","detail":"too many certificates already issued"}`))
+			return
+		}
+		w.Header().Set("X-RateLimit-Limit", "50")
+		w.Header().Set("X-RateLimit-Remaining", "49")
+		writeJSONResponse(w, map[string]string{})
+	}))
+	defer ts.Close()
+
+	privKey, err := rsa.GenerateKey(rand.Reader, 512)
+	if err != nil {
+		t.Fatal("Could not generate test key:", err)
+	}
+	client := &Client{jws: &jws{privKey: privKey, directoryURL: ts.URL}}
+
+	if _, ok := client.LastRateLimit(); ok {
+		t.Error("Expected no rate limit information before the first request")
+	}
+
+	if _, err := postJSON(client.jws, ts.URL, map[string]string{}, nil); err != nil {
+		t.Fatalf("postJSON error: got %v, want nil", err)
+	}
+	rateLimit, ok := client.LastRateLimit()
+	if !ok || rateLimit.Limit != 50 || rateLimit.Remaining != 49 || rateLimit.Limited {
+		t.Errorf("Expected 49 of 50 requests remaining, got %+v", rateLimit)
+	}
+
+	limited = true
+	if _, err := postJSON(client.jws, ts.URL, map[string]string{}, nil); err == nil {
+		t.Fatal("Expected the rate limited request to fail")
+	}
+	rateLimit, ok = client.LastRateLimit()
+	if !ok || !rateLimit.Limited || rateLimit.Remaining != 0 || time.Until(rateLimit.Reset) < 59*time.Minute {
+		t.Errorf("Expected to be rate limited for an hour, got %+v", rateLimit)
+	}
+}
@@ -0,0 +1,75 @@
+package acme
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+)
+
+// ErrRenewalInfoNotSupported is returned by GetRenewalInfo if the CA does
+// not offer ACME Renewal Information.
+var ErrRenewalInfoNotSupported = errors.New("acme: the server does not support renewal information")
+
+// RenewalInfo is the renewal information suggested by the CA for a
+// certificate. See draft-ietf-acme-ari.
+type RenewalInfo struct {
+	SuggestedWindow struct {
+		Start time.Time `json:"start"`
+		End   time.Time `json:"end"`
+	} `json:"suggestedWindow"`
+	ExplanationURL string `json:"explanationURL,omitempty"`
+
+	// RetryAfter is how long to wait before asking for the renewal
+	// information again, as requested by the CA. It is zero if the CA
+	// did not say.
+	RetryAfter time.Duration `json:"-"`
+}
+
+// GetRenewalInfo asks the CA when cert should be renewed.
+// It returns ErrRenewalInfoNotSupported if the CA's directory has no
+// renewalInfo resource.
+func (c *Client) GetRenewalInfo(cert *x509.Certificate) (*RenewalInfo, error) {
+	if c.directory.RenewalInfoURL == "" {
+		return nil, ErrRenewalInfoNotSupported
+	}
+
+	certID, err := renewalInfoCertID(cert)
+	if err != nil {
+		return nil, err
+	}
+
+	var info RenewalInfo
+	hdr, err := getJSON(strings.TrimSuffix(c.directory.RenewalInfoURL, "/")+"/"+certID, &info, c.clock)
+	if err != nil {
+		return nil, err
+	}
+
+	if wait, ok := parseRetryAfter(hdr.Get("Retry-After"), c.now()); ok {
+		info.RetryAfter = wait
+	}
+
+	return &info, nil
+}
+
+// renewalInfoCertID builds the ARI identifier of cert: its authority key
+// identifier and the DER encoded value of its serial number, each base64url
+// encoded and joined by a dot.
+func renewalInfoCertID(cert *x509.Certificate) (string, error) {
+	if len(cert.AuthorityKeyId) == 0 {
+		return "", errors.New("acme: the certificate has no authority key identifier")
+	}
+	if cert.SerialNumber == nil || cert.SerialNumber.Sign() <= 0 {
+		return "", errors.New("acme: the certificate has no valid serial number")
+	}
+
+	// The DER encoding of a positive integer has a leading zero byte
+	// if its most significant bit is set.
+	serial := cert.SerialNumber.Bytes()
+	if serial[0]&0x80 != 0 {
+		serial = append([]byte{0}, serial...)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(cert.AuthorityKeyId) + "." + base64.RawURLEncoding.EncodeToString(serial), nil
+}
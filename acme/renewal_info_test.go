@@ -0,0 +1,68 @@
+package acme
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestGetRenewalInfo(t *testing.T) {
+	cert := &x509.Certificate{
+		AuthorityKeyId: []byte{0x69, 0x88, 0x5b, 0x6b, 0x87, 0x46, 0x40, 0x41, 0xe1, 0xb3, 0x7b, 0x84, 0x7b, 0xa0, 0xae, 0x2c, 0xde, 0x01, 0xc8, 0xd4},
+		SerialNumber:   big.NewInt(0x87654321),
+	}
+	// The example from draft-ietf-acme-ari: the serial's high bit is set,
+	// so its DER encoding has a leading zero byte.
+	wantPath := "/renewal-info/aYhba4dGQEHhs3uEe6CuLN4ByNQ.AIdlQyE"
+
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Replay-Nonce", "12345")
+		switch r.URL.Path {
+		case "/":
+			writeJSONResponse(w, directory{NewAuthzURL: ts.URL, NewCertURL: ts.URL, NewRegURL: ts.URL, RevokeCertURL: ts.URL, RenewalInfoURL: ts.URL + "/renewal-info/"})
+		case wantPath:
+			w.Header().Set("Retry-After", "21600")
+			w.Write([]byte(`{"suggestedWindow": {"start": "2021-01-03T00:00:00Z", "end": "2021-01-07T00:00:00Z"}, "explanationURL": "https://example.com/docs/ari"}`))
+		default:
+			t.Errorf("Unexpected request for %s", r.URL.Path)
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	key, _ := rsa.GenerateKey(rand.Reader, 512)
+	client, err := NewClient(ts.URL+"/", mockUser{email: "test@test.com", privatekey: key}, RSA2048)
+	if err != nil {
+		t.Fatalf("Could not create client: %v", err)
+	}
+
+	info, err := client.GetRenewalInfo(cert)
+	if err != nil {
+		t.Fatalf("Expected GetRenewalInfo to return no error but got %v", err)
+	}
+	if want := time.Date(2021, 1, 3, 0, 0, 0, 0, time.UTC); !info.SuggestedWindow.Start.Equal(want) {
+		t.Errorf("Expected the window to start at %s but got %s", want, info.SuggestedWindow.Start)
+	}
+	if want := time.Date(2021, 1, 7, 0, 0, 0, 0, time.UTC); !info.SuggestedWindow.End.Equal(want) {
+		t.Errorf("Expected the window to end at %s but got %s", want, info.SuggestedWindow.End)
+	}
+	if info.ExplanationURL != "https://example.com/docs/ari" {
+		t.Errorf("Expected the explanation URL to be parsed but got %q", info.ExplanationURL)
+	}
+	if info.RetryAfter != 6*time.Hour {
+		t.Errorf("Expected RetryAfter to be 6h0m0s but was %s", info.RetryAfter)
+	}
+}
+
+func TestGetRenewalInfoNotSupported(t *testing.T) {
+	client := &Client{}
+	if _, err := client.GetRenewalInfo(&x509.Certificate{}); err != ErrRenewalInfoNotSupported {
+		t.Errorf("Expected %v but got %v", ErrRenewalInfoNotSupported, err)
+	}
+}
@@ -0,0 +1,92 @@
+package acme
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/asn1"
+	"strings"
+	"testing"
+)
+
+func TestTLSALPNChallenge(t *testing.T) {
+	domain := "localhost:23457"
+
+	privKey, _ := rsa.GenerateKey(rand.Reader, 512)
+	j := &jws{privKey: privKey}
+	clientChallenge := challenge{Type: TLSALPN01, Token: "tlsalpn1"}
+	mockValidate := func(_ context.Context, _ *jws, _, _ string, chlng challenge) error {
+		conn, err := tls.Dial("tcp", domain, &tls.Config{
+			InsecureSkipVerify: true,
+			NextProtos:         []string{ACMETLS1Protocol},
+		})
+		if err != nil {
+			t.Fatalf("Expected to connect to challenge server without an error. %s", err.Error())
+		}
+		defer conn.Close()
+
+		// Expect the server to negotiate the ACME-TLS/1 protocol
+		connState := conn.ConnectionState()
+		if connState.NegotiatedProtocol != ACMETLS1Protocol {
+			t.Errorf("Expected the challenge server to negotiate %q but got %q", ACMETLS1Protocol, connState.NegotiatedProtocol)
+		}
+
+		// Expect the server to only return one certificate
+		if count := len(connState.PeerCertificates); count != 1 {
+			t.Fatalf("Expected the challenge server to return exactly one certificate but got %d", count)
+		}
+
+		remoteCert := connState.PeerCertificates[0]
+		if count := len(remoteCert.DNSNames); count != 1 {
+			t.Errorf("Expected the challenge certificate to have exactly one DNSNames entry but had %d", count)
+		} else if remoteCert.DNSNames[0] != domain {
+			t.Errorf("Expected the challenge certificate DNSName to match %s but was %s", domain, remoteCert.DNSNames[0])
+		}
+
+		zBytes := sha256.Sum256([]byte(chlng.KeyAuthorization))
+		value, err := asn1.Marshal(zBytes[:sha256.Size])
+		if err != nil {
+			t.Fatalf("Expected marshaling of the keyAuth to return no error, but was %v", err)
+		}
+
+		var found bool
+		for _, ext := range remoteCert.Extensions {
+			if !ext.Id.Equal(idPeAcmeIdentifierV1) {
+				continue
+			}
+			found = true
+			if !ext.Critical {
+				t.Error("Expected the acmeIdentifier extension to be critical")
+			}
+			if !bytes.Equal(ext.Value, value) {
+				t.Errorf("Expected the acmeIdentifier extension value to be %x but was %x", value, ext.Value)
+			}
+		}
+		if !found {
+			t.Error("Expected the challenge certificate to contain the acmeIdentifier extension")
+		}
+
+		return nil
+	}
+	solver := &tlsALPNChallenge{jws: j, validate: mockValidate, provider: &TLSALPNProviderServer{port: "23457"}}
+
+	if err := solver.Solve(context.Background(), clientChallenge, domain); err != nil {
+		t.Errorf("Solve error: got %v, want nil", err)
+	}
+}
+
+func TestTLSALPNChallengeInvalidPort(t *testing.T) {
+	privKey, _ := rsa.GenerateKey(rand.Reader, 128)
+	j := &jws{privKey: privKey}
+	clientChallenge := challenge{Type: TLSALPN01, Token: "tlsalpn2"}
+	solver := &tlsALPNChallenge{jws: j, validate: stubValidate, provider: &TLSALPNProviderServer{port: "123456"}}
+
+	if err := solver.Solve(context.Background(), clientChallenge, "localhost:123456"); err == nil {
+		t.Errorf("Solve error: got %v, want error", err)
+	} else if want, want18 := "invalid port 123456", "123456: invalid port"; !strings.HasSuffix(err.Error(), want) && !strings.HasSuffix(err.Error(), want18) {
+		t.Errorf("Solve error: got %q, want suffix %q", err.Error(), want)
+	}
+}
@@ -1,21 +1,22 @@
 package acme
 
 import (
+	"context"
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/tls"
 	"encoding/hex"
 	"fmt"
-	"log"
 )
 
 type tlsSNIChallenge struct {
 	jws      *jws
 	validate validateFunc
+	tracker  *challengeTracker
 	provider ChallengeProvider
 }
 
-func (t *tlsSNIChallenge) Solve(chlng challenge, domain string) error {
+func (t *tlsSNIChallenge) Solve(ctx context.Context, chlng challenge, domain string) error {
 	// FIXME: https://github.com/ietf-wg-acme/acme/pull/22
 	// Currently we implement this challenge to track boulder, not the current spec!
 
@@ -27,17 +28,21 @@ func (t *tlsSNIChallenge) Solve(chlng challenge, domain string) error {
 		return err
 	}
 
-	err = t.provider.Present(domain, chlng.Token, keyAuth)
+	t.tracker.add(domain, chlng)
+	defer t.tracker.remove(domain, chlng.Token)
+
+	err = presentChallenge(ctx, t.provider, domain, chlng.Token, keyAuth)
 	if err != nil {
 		return fmt.Errorf("[%s] error presenting token: %v", domain, err)
 	}
+	t.tracker.presented(domain, chlng.Token)
 	defer func() {
-		err := t.provider.CleanUp(domain, chlng.Token, keyAuth)
+		err := cleanUpChallenge(t.provider, domain, chlng.Token, keyAuth)
 		if err != nil {
-			log.Printf("[%s] error cleaning up: %v", domain, err)
+			logf("[%s] error cleaning up: %v", domain, err)
 		}
 	}()
-	return t.validate(t.jws, domain, chlng.URI, challenge{Resource: "challenge", Type: chlng.Type, Token: chlng.Token, KeyAuthorization: keyAuth})
+	return t.validate(ctx, t.jws, domain, chlng.URI, challenge{Resource: "challenge", Type: chlng.Type, Token: chlng.Token, KeyAuthorization: keyAuth})
 }
 
 // TLSSNI01ChallengeCert returns a certificate and target domain for the `tls-sni-01` challenge
@@ -53,7 +58,7 @@ func TLSSNI01ChallengeCert(keyAuth string) (tls.Certificate, string, error) {
 	zBytes := sha256.Sum256([]byte(keyAuth))
 	z := hex.EncodeToString(zBytes[:sha256.Size])
 	domain := fmt.Sprintf("%s.%s.acme.invalid", z[:32], z[32:])
-	tempCertPEM, err := generatePemCert(rsaPrivKey, domain)
+	tempCertPEM, err := generatePemCert(rsaPrivKey, domain, nil)
 	if err != nil {
 		return tls.Certificate{}, "", err
 	}
@@ -1,16 +1,68 @@
 package acme
 
 import (
+	"context"
 	"fmt"
+	"math/rand"
+	"sync"
 	"time"
 )
 
+// Jitter enables exponential backoff with jitter for the polling and retry
+// sleeps, so that many clients started at the same time, e.g. from cron, do
+// not all hit the CA and the DNS providers in lockstep. Every retry of an
+// operation waits twice as long as the one before, up to a minute, and is
+// lengthened by a random fraction of up to Jitter. A Jitter of 0.5 sleeps
+// between 1x and 1.5x the backed off interval. The default of 0 disables
+// both, so that every sleep is exactly the interval.
+var Jitter float64
+
+// maxBackoff is the longest that backoff doubles an interval to. Longer
+// intervals, e.g. asked for by a Retry-After header, are not doubled.
+const maxBackoff = time.Minute
+
+var (
+	jitterMu   sync.Mutex
+	jitterRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// backoff returns how long to wait after the attempt-th try, counted from 0,
+// of an operation that is retried every d. See Jitter.
+func backoff(d time.Duration, attempt int) time.Duration {
+	if Jitter <= 0 || d <= 0 {
+		return d
+	}
+
+	max := maxBackoff
+	if d > max {
+		max = d
+	}
+	for i := 0; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+
+	jitterMu.Lock()
+	f := jitterRand.Float64()
+	jitterMu.Unlock()
+	return d + time.Duration(f*Jitter*float64(d))
+}
+
 // WaitFor polls the given function 'f', once every 'interval', up to 'timeout'.
 func WaitFor(timeout, interval time.Duration, f func() (bool, error)) error {
+	return waitFor(context.Background(), timeout, interval, f)
+}
+
+// waitFor is like WaitFor, but returns ctx.Err() as soon as ctx is done.
+func waitFor(ctx context.Context, timeout, interval time.Duration, f func() (bool, error)) error {
 	var lastErr string
 	timeup := time.After(timeout)
-	for {
+	for attempt := 0; ; attempt++ {
 		select {
+		case <-ctx.Done():
+			return ctx.Err()
 		case <-timeup:
 			return fmt.Errorf("Time limit exceeded. Last error: %s", lastErr)
 		default:
@@ -24,6 +76,10 @@ func WaitFor(timeout, interval time.Duration, f func() (bool, error)) error {
 			lastErr = err.Error()
 		}
 
-		time.Sleep(interval)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff(interval, attempt)):
+		}
 	}
 }
@@ -24,3 +24,31 @@ func TestWaitForTimeout(t *testing.T) {
 		}
 	}
 }
+
+func TestBackoff(t *testing.T) {
+	defer func(j float64) { Jitter = j }(Jitter)
+
+	Jitter = 0
+	if d := backoff(time.Second, 3); d != time.Second {
+		t.Errorf("Expected no backoff or jitter by default, got %s", d)
+	}
+
+	Jitter = 0.5
+	tsts := []struct {
+		interval time.Duration
+		attempt  int
+		min      time.Duration
+	}{
+		{time.Second, 0, time.Second},
+		{time.Second, 2, 4 * time.Second},
+		{time.Second, 10, maxBackoff},
+		{2 * time.Minute, 3, 2 * time.Minute},
+	}
+	for _, tst := range tsts {
+		for i := 0; i < 1000; i++ {
+			if d := backoff(tst.interval, tst.attempt); d < tst.min || d > tst.min*3/2 {
+				t.Fatalf("backoff(%s, %d): expected a duration between %s and %s, got %s", tst.interval, tst.attempt, tst.min, tst.min*3/2, d)
+			}
+		}
+	}
+}
@@ -128,6 +128,11 @@ func main() {
 			Name:  "accept-tos, a",
 			Usage: "By setting this flag to true you indicate that you accept the current Let's Encrypt terms of service.",
 		},
+		cli.StringFlag{
+			Name:   "account-key",
+			Usage:  "PEM encoded private key of the account, used instead of the key stored in the account folder. Best passed through the environment.",
+			EnvVar: "LEGO_ACCOUNT_KEY",
+		},
 		cli.StringFlag{
 			Name:  "key-type, k",
 			Value: "rsa2048",
@@ -140,7 +145,7 @@ func main() {
 		},
 		cli.StringSliceFlag{
 			Name:  "exclude, x",
-			Usage: "Explicitly disallow solvers by name from being used. Solvers: \"http-01\", \"tls-sni-01\".",
+			Usage: "Explicitly disallow solvers by name from being used. Solvers: \"http-01\", \"tls-sni-01\", \"tls-alpn-01\".",
 		},
 		cli.StringFlag{
 			Name:  "webroot",
@@ -170,14 +175,39 @@ func main() {
 			Name:  "dns-timeout",
 			Usage: "Set the DNS timeout value to a specific value in seconds. The default is 10 seconds.",
 		},
+		cli.StringFlag{
+			Name:  "dns-ip-family",
+			Usage: "Restrict DNS queries to nameservers reachable over one IP family. Supported: 4, 6. The default is to use either.",
+		},
 		cli.StringSliceFlag{
-			Name:  "dns-resolvers",
-			Usage: "Set the resolvers to use for performing recursive DNS queries. Supported: host:port. The default is to use Google's DNS resolvers.",
+			Name:   "dns-resolvers",
+			Usage:  "Set the resolvers to use for performing recursive DNS queries. Supported: host:port. The default is to use Google's DNS resolvers.",
+			EnvVar: "LEGO_DNS_RESOLVERS",
+		},
+		cli.StringFlag{
+			Name:   "dns-protocol",
+			Usage:  "Set the protocol used for DNS queries, e.g. to check that the TXT records have propagated. Supported: udp, tcp, doh. The default is udp.",
+			EnvVar: "LEGO_DNS_PROTOCOL",
+		},
+		cli.StringFlag{
+			Name:   "dns-doh-url",
+			Usage:  "Set the URL of the DNS over HTTPS resolver used with --dns-protocol doh.",
+			EnvVar: "LEGO_DNS_DOH_URL",
+		},
+		cli.BoolFlag{
+			Name:   "dns-disable-precheck",
+			Usage:  "Ask the CA to validate DNS challenges without first checking that the TXT records have propagated.",
+			EnvVar: "LEGO_DNS_DISABLE_PRECHECK",
 		},
 		cli.BoolFlag{
 			Name:  "pem",
 			Usage: "Generate a .pem file by concatanating the .key and .crt files together.",
 		},
+		cli.StringFlag{
+			Name:   "user-agent",
+			Usage:  "Add a product token to the User-Agent header of all requests, after lego/<version>.",
+			EnvVar: "LEGO_USER_AGENT",
+		},
 	}
 
 	err = app.Run(os.Args)
@@ -37,15 +37,38 @@ func setup(c *cli.Context) (*Configuration, *Account, *acme.Client) {
 		acme.DNSTimeout = time.Duration(c.GlobalInt("dns-timeout")) * time.Second
 	}
 
+	if c.GlobalIsSet("dns-ip-family") {
+		switch c.GlobalString("dns-ip-family") {
+		case "4":
+			acme.DNSIPFamily = acme.IPv4Only
+		case "6":
+			acme.DNSIPFamily = acme.IPv6Only
+		default:
+			logger().Fatalf("The --dns-ip-family switch only accepts 4 or 6 for its argument.")
+		}
+	}
+
+	if c.GlobalString("dns-protocol") != "" {
+		protocol, err := acme.ParseDNSProtocol(c.GlobalString("dns-protocol"))
+		if err != nil {
+			logger().Fatal(err)
+		}
+		if protocol == acme.DoHProtocol && c.GlobalString("dns-doh-url") == "" {
+			logger().Fatal("The doh DNS protocol needs the URL of a resolver in --dns-doh-url.")
+		}
+		acme.DNSQueryProtocol = protocol
+		acme.DNSOverHTTPSURL = c.GlobalString("dns-doh-url")
+	}
+
+	if c.GlobalString("user-agent") != "" {
+		acme.UserAgent = c.GlobalString("user-agent")
+	}
+
 	if len(c.GlobalStringSlice("dns-resolvers")) > 0 {
-		resolvers := []string{}
-		for _, resolver := range c.GlobalStringSlice("dns-resolvers") {
-			if !strings.Contains(resolver, ":") {
-				resolver += ":53"
-			}
-			resolvers = append(resolvers, resolver)
+		err := acme.SetRecursiveNameservers(c.GlobalStringSlice("dns-resolvers"))
+		if err != nil {
+			logger().Fatalf("Could not set DNS resolvers: %s", err.Error())
 		}
-		acme.RecursiveNameservers = resolvers
 	}
 
 	err := checkFolder(c.GlobalString("path"))
@@ -85,7 +108,7 @@ func setup(c *cli.Context) (*Configuration, *Account, *acme.Client) {
 
 		// --webroot=foo indicates that the user specifically want to do a HTTP challenge
 		// infer that the user also wants to exclude all other challenges
-		client.ExcludeChallenges([]acme.Challenge{acme.DNS01, acme.TLSSNI01})
+		client.ExcludeChallenges([]acme.Challenge{acme.DNS01, acme.TLSSNI01, acme.TLSALPN01})
 	}
 	if c.GlobalIsSet("memcached-host") {
 		provider, err := memcached.NewMemcachedProvider(c.GlobalStringSlice("memcached-host"))
@@ -97,7 +120,7 @@ func setup(c *cli.Context) (*Configuration, *Account, *acme.Client) {
 
 		// --memcached-host=foo:11211 indicates that the user specifically want to do a HTTP challenge
 		// infer that the user also wants to exclude all other challenges
-		client.ExcludeChallenges([]acme.Challenge{acme.DNS01, acme.TLSSNI01})
+		client.ExcludeChallenges([]acme.Challenge{acme.DNS01, acme.TLSSNI01, acme.TLSALPN01})
 	}
 	if c.GlobalIsSet("http") {
 		if strings.Index(c.GlobalString("http"), ":") == -1 {
@@ -120,10 +143,11 @@ func setup(c *cli.Context) (*Configuration, *Account, *acme.Client) {
 		}
 
 		client.SetChallengeProvider(acme.DNS01, provider)
+		client.DisableDNSPropagationCheck(c.GlobalBool("dns-disable-precheck"))
 
 		// --dns=foo indicates that the user specifically want to do a DNS challenge
 		// infer that the user also wants to exclude all other challenges
-		client.ExcludeChallenges([]acme.Challenge{acme.HTTP01, acme.TLSSNI01})
+		client.ExcludeChallenges([]acme.Challenge{acme.HTTP01, acme.TLSSNI01, acme.TLSALPN01})
 	}
 
 	return conf, acc, client
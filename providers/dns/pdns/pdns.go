@@ -4,9 +4,12 @@ package pdns
 
 import (
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -22,6 +25,7 @@ type DNSProvider struct {
 	apiKey     string
 	host       *url.URL
 	apiVersion int
+	client     *http.Client
 }
 
 // NewDNSProvider returns a DNSProvider instance configured for pdns.
@@ -48,15 +52,40 @@ func NewDNSProviderCredentials(host *url.URL, key string) (*DNSProvider, error)
 		return nil, fmt.Errorf("PDNS API URL missing")
 	}
 
+	pool, err := acme.CertPool()
+	if err != nil {
+		return nil, err
+	}
+
 	provider := &DNSProvider{
 		host:   host,
 		apiKey: key,
+		client: newHTTPClient(pool),
 	}
 	provider.getAPIVersion()
 
 	return provider, nil
 }
 
+// newHTTPClient returns a client for the API that trusts the CA certificates
+// in pool, e.g. those of a self-hosted API. Its transport has the timeouts of
+// http.DefaultTransport.
+func newHTTPClient(pool *x509.CertPool) *http.Client {
+	return &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			Dial: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).Dial,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: 1 * time.Second,
+			TLSClientConfig:       &tls.Config{RootCAs: pool},
+		},
+	}
+}
+
 // Timeout returns the timeout and interval to use when checking for DNS
 // propagation. Adjusting here to cope with spikes in propagation times.
 func (c *DNSProvider) Timeout() (timeout, interval time.Duration) {
@@ -272,8 +301,7 @@ func (c *DNSProvider) makeRequest(method, uri string, body io.Reader) (json.RawM
 
 	req.Header.Set("X-API-Key", c.apiKey)
 
-	client := http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
+	resp, err := c.client.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("Error talking to PDNS API -> %v", err)
 	}
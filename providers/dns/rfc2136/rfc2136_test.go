@@ -161,6 +161,39 @@ func TestRFC2136ValidUpdatePacket(t *testing.T) {
 	}
 }
 
+func TestRFC2136DelegationZone(t *testing.T) {
+	acme.ClearFqdnCache()
+	acme.SetChallengeDelegationZone("challenge." + rfc2136TestZone)
+	defer acme.SetChallengeDelegationZone("")
+	dns.HandleFunc(rfc2136TestZone, serverHandlerPassBackRequest)
+	defer dns.HandleRemove(rfc2136TestZone)
+
+	server, addrstr, err := runLocalDNSTestServer("127.0.0.1:0", false)
+	if err != nil {
+		t.Fatalf("Failed to start test server: %v", err)
+	}
+	defer server.Shutdown()
+
+	provider, err := NewDNSProviderCredentials(addrstr, "", "", "", "")
+	if err != nil {
+		t.Fatalf("Expected NewDNSProviderCredentials() to return no error but the error was -> %v", err)
+	}
+	if err := provider.Present(rfc2136TestDomain, "", rfc2136TestKeyAuth); err != nil {
+		t.Errorf("Expected Present() to return no error but the error was -> %v", err)
+	}
+
+	rcvMsg := <-reqChan
+	target := acme.ChallengeDelegationTarget(rfc2136TestDomain)
+	for _, rr := range rcvMsg.Ns {
+		if rr.Header().Name != target {
+			t.Errorf("Expected the TXT record to be written to %s but got %s", target, rr.Header().Name)
+		}
+	}
+	if len(rcvMsg.Ns) == 0 {
+		t.Error("Expected an update of the TXT record")
+	}
+}
+
 func runLocalDNSTestServer(listenAddr string, tsig bool) (*dns.Server, string, error) {
 	pc, err := net.ListenPacket("udp", listenAddr)
 	if err != nil {
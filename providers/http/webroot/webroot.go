@@ -10,6 +10,13 @@ import (
 	"github.com/xenolf/lego/acme"
 )
 
+// mkdirAll and writeFile create the challenge file. They can be replaced in
+// tests, e.g. to deny permission even to root.
+var (
+	mkdirAll  = os.MkdirAll
+	writeFile = ioutil.WriteFile
+)
+
 // HTTPProvider implements ChallengeProvider for `http-01` challenge
 type HTTPProvider struct {
 	path string
@@ -33,12 +40,18 @@ func (w *HTTPProvider) Present(domain, token, keyAuth string) error {
 	var err error
 
 	challengeFilePath := path.Join(w.path, acme.HTTP01ChallengePath(token))
-	err = os.MkdirAll(path.Dir(challengeFilePath), 0755)
+	err = mkdirAll(path.Dir(challengeFilePath), 0755)
+	if os.IsPermission(err) {
+		return fmt.Errorf("Could not create required directories in webroot for HTTP challenge: permission denied, make sure %s is writable by lego -> %v", w.path, err)
+	}
 	if err != nil {
 		return fmt.Errorf("Could not create required directories in webroot for HTTP challenge -> %v", err)
 	}
 
-	err = ioutil.WriteFile(challengeFilePath, []byte(keyAuth), 0644)
+	err = writeFile(challengeFilePath, []byte(keyAuth), 0644)
+	if os.IsPermission(err) {
+		return fmt.Errorf("Could not write file in webroot for HTTP challenge: permission denied, make sure %s is writable by lego -> %v", path.Dir(challengeFilePath), err)
+	}
 	if err != nil {
 		return fmt.Errorf("Could not write file in webroot for HTTP challenge -> %v", err)
 	}
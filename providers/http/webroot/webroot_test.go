@@ -3,6 +3,8 @@ package webroot
 import (
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -44,3 +46,99 @@ func TestHTTPProvider(t *testing.T) {
 		t.Errorf("Webroot provider CleanUp() error: got %v, want nil", err)
 	}
 }
+
+func TestHTTPProviderCreatesDirectories(t *testing.T) {
+	webroot, err := ioutil.TempDir("", "webroot")
+	if err != nil {
+		t.Fatalf("TempDir error: got %v, want nil", err)
+	}
+	defer os.RemoveAll(webroot)
+
+	token := "token"
+	keyAuth := "keyAuth"
+	challengeFilePath := filepath.Join(webroot, ".well-known", "acme-challenge", token)
+
+	provider, err := NewHTTPProvider(webroot)
+	if err != nil {
+		t.Fatalf("Webroot provider error: got %v, want nil", err)
+	}
+
+	if err := provider.Present("domain", token, keyAuth); err != nil {
+		t.Fatalf("Webroot provider present() error: got %v, want nil", err)
+	}
+
+	data, err := ioutil.ReadFile(challengeFilePath)
+	if err != nil {
+		t.Fatalf("Webroot provider ReadFile() error: got %v, want nil", err)
+	}
+	if string(data) != keyAuth {
+		t.Errorf("Challenge file content: got %q, want %q", data, keyAuth)
+	}
+
+	if err := provider.CleanUp("domain", token, keyAuth); err != nil {
+		t.Errorf("Webroot provider CleanUp() error: got %v, want nil", err)
+	}
+	if _, err := os.Stat(challengeFilePath); !os.IsNotExist(err) {
+		t.Error("Challenge file was not removed from webroot")
+	}
+}
+
+func TestHTTPProviderPermissionDenied(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("Permissions are not enforced for root, see TestHTTPProviderPermissionDeniedMessage")
+	}
+
+	webroot, err := ioutil.TempDir("", "webroot")
+	if err != nil {
+		t.Fatalf("TempDir error: got %v, want nil", err)
+	}
+	defer os.RemoveAll(webroot)
+
+	if err := os.Chmod(webroot, 0555); err != nil {
+		t.Fatalf("Chmod error: got %v, want nil", err)
+	}
+	defer os.Chmod(webroot, 0755)
+
+	provider, err := NewHTTPProvider(webroot)
+	if err != nil {
+		t.Fatalf("Webroot provider error: got %v, want nil", err)
+	}
+
+	err = provider.Present("domain", "token", "keyAuth")
+	if want := "make sure " + webroot + " is writable"; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("Webroot provider present() error: got %v, want a permission error with %q", err, want)
+	}
+}
+
+func TestHTTPProviderPermissionDeniedMessage(t *testing.T) {
+	defer func() { mkdirAll, writeFile = os.MkdirAll, ioutil.WriteFile }()
+
+	webroot, err := ioutil.TempDir("", "webroot")
+	if err != nil {
+		t.Fatalf("TempDir error: got %v, want nil", err)
+	}
+	defer os.RemoveAll(webroot)
+
+	provider, err := NewHTTPProvider(webroot)
+	if err != nil {
+		t.Fatalf("Webroot provider error: got %v, want nil", err)
+	}
+
+	denied := &os.PathError{Op: "open", Path: webroot, Err: os.ErrPermission}
+	challengeDir := filepath.Join(webroot, ".well-known", "acme-challenge")
+
+	// Deny creating the challenge directory.
+	mkdirAll = func(string, os.FileMode) error { return denied }
+	err = provider.Present("domain", "token", "keyAuth")
+	if want := "make sure " + webroot + " is writable"; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("Webroot provider present() error: got %v, want a permission error with %q", err, want)
+	}
+
+	// Deny writing the challenge file.
+	mkdirAll = os.MkdirAll
+	writeFile = func(string, []byte, os.FileMode) error { return denied }
+	err = provider.Present("domain", "token", "keyAuth")
+	if want := "make sure " + challengeDir + " is writable"; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("Webroot provider present() error: got %v, want a permission error with %q", err, want)
+	}
+}